@@ -0,0 +1,186 @@
+package claudecode
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// deltaAggregator coalesces the stream events of partial messages into whole
+// assistant messages, so consumers never see individual deltas. The CLI's own
+// assistant messages for an aggregated message are dropped as duplicates.
+type deltaAggregator struct {
+	current *partialMessage
+	seen    map[string]bool
+}
+
+// partialMessage accumulates the stream events of one API message
+type partialMessage struct {
+	id              string
+	model           string
+	stopReason      string
+	sessionID       string
+	parentToolUseID any
+	blocks          []*partialBlock
+}
+
+// partialBlock accumulates the deltas of one content block
+type partialBlock struct {
+	block map[string]any
+	text  strings.Builder
+	input strings.Builder
+}
+
+// streamEvent is the envelope of a partial message event from the CLI
+type streamEvent struct {
+	SessionID       string `json:"session_id"`
+	ParentToolUseID any    `json:"parent_tool_use_id"`
+	Event           struct {
+		Type    string `json:"type"`
+		Index   int    `json:"index"`
+		Message struct {
+			ID    string `json:"id"`
+			Model string `json:"model"`
+		} `json:"message"`
+		ContentBlock map[string]any `json:"content_block"`
+		Delta        struct {
+			Type        string `json:"type"`
+			Text        string `json:"text"`
+			Thinking    string `json:"thinking"`
+			PartialJSON string `json:"partial_json"`
+			StopReason  string `json:"stop_reason"`
+		} `json:"delta"`
+	} `json:"event"`
+}
+
+func newDeltaAggregator() *deltaAggregator {
+	return &deltaAggregator{seen: make(map[string]bool)}
+}
+
+// filter processes a raw message of the given type. It returns the message to
+// deliver, which is a consolidated assistant message when a partial message
+// completes, and false when nothing should be delivered.
+func (a *deltaAggregator) filter(raw json.RawMessage, msgType string) (json.RawMessage, bool) {
+	switch msgType {
+	case "stream_event":
+		return a.addEvent(raw)
+	case string(MessageTypeAssistant):
+		var envelope struct {
+			Message struct {
+				ID string `json:"id"`
+			} `json:"message"`
+		}
+		_ = json.Unmarshal(raw, &envelope)
+		if envelope.Message.ID != "" && a.seen[envelope.Message.ID] {
+			return nil, false
+		}
+	}
+	return raw, true
+}
+
+// addEvent applies a stream event, returning the consolidated message once
+// the partial message stops
+func (a *deltaAggregator) addEvent(raw json.RawMessage) (json.RawMessage, bool) {
+	var se streamEvent
+	if err := json.Unmarshal(raw, &se); err != nil {
+		return nil, false
+	}
+	event := se.Event
+
+	if event.Type == "message_start" {
+		a.current = &partialMessage{
+			id:              event.Message.ID,
+			model:           event.Message.Model,
+			sessionID:       se.SessionID,
+			parentToolUseID: se.ParentToolUseID,
+		}
+		if event.Message.ID != "" {
+			a.seen[event.Message.ID] = true
+		}
+		return nil, false
+	}
+
+	m := a.current
+	if m == nil {
+		return nil, false
+	}
+
+	switch event.Type {
+	case "content_block_start":
+		for len(m.blocks) <= event.Index {
+			m.blocks = append(m.blocks, nil)
+		}
+		m.blocks[event.Index] = &partialBlock{block: event.ContentBlock}
+	case "content_block_delta":
+		if event.Index >= len(m.blocks) || m.blocks[event.Index] == nil {
+			return nil, false
+		}
+		b := m.blocks[event.Index]
+		switch event.Delta.Type {
+		case "text_delta":
+			b.text.WriteString(event.Delta.Text)
+		case "thinking_delta":
+			b.text.WriteString(event.Delta.Thinking)
+		case "input_json_delta":
+			b.input.WriteString(event.Delta.PartialJSON)
+		}
+	case "message_delta":
+		if event.Delta.StopReason != "" {
+			m.stopReason = event.Delta.StopReason
+		}
+	case "message_stop":
+		a.current = nil
+		data, err := json.Marshal(m.assemble())
+		if err != nil {
+			return nil, false
+		}
+		return data, true
+	}
+	return nil, false
+}
+
+// assemble builds the stream-json assistant message for m
+func (m *partialMessage) assemble() map[string]any {
+	content := make([]any, 0, len(m.blocks))
+	for _, b := range m.blocks {
+		if b == nil {
+			continue
+		}
+		block := make(map[string]any, len(b.block)+1)
+		for k, v := range b.block {
+			block[k] = v
+		}
+		switch block["type"] {
+		case "text":
+			block["text"] = b.text.String()
+		case "thinking":
+			block["thinking"] = b.text.String()
+		case "tool_use":
+			var input map[string]any
+			if err := json.Unmarshal([]byte(b.input.String()), &input); err == nil {
+				block["input"] = input
+			}
+		}
+		content = append(content, block)
+	}
+
+	message := map[string]any{"role": "assistant", "content": content}
+	if m.id != "" {
+		message["id"] = m.id
+	}
+	if m.model != "" {
+		message["model"] = m.model
+	}
+	if m.stopReason != "" {
+		message["stop_reason"] = m.stopReason
+	}
+
+	raw := map[string]any{
+		"type":               string(MessageTypeAssistant),
+		"message":            message,
+		"parent_tool_use_id": m.parentToolUseID,
+	}
+	if m.sessionID != "" {
+		raw["session_id"] = m.sessionID
+	}
+	return raw
+}
@@ -0,0 +1,81 @@
+package claudecode
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAggregateDeltas tests that partial message deltas are coalesced into a
+// single assistant message and the CLI's duplicate copy is dropped
+func TestAggregateDeltas(t *testing.T) {
+	argsPath := filepath.Join(t.TempDir(), "args.txt")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4-5"}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello, "}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"world"}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_stop","index":0}}'
+echo '{"type":"assistant","session_id":"s1","message":{"id":"msg_1","role":"assistant","content":[{"type":"text","text":"Hello, world"}]}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"Read","input":{}}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"file_path\":"}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"main.go\"}"}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"content_block_stop","index":1}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"message_delta","delta":{"stop_reason":"tool_use"}}}'
+echo '{"type":"stream_event","session_id":"s1","event":{"type":"message_stop"}}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithAggregateDeltas(true),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Hello")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	var assistants []*AssistantMessage
+	for _, msg := range messages {
+		if m, ok := msg.(*AssistantMessage); ok {
+			assistants = append(assistants, m)
+		}
+	}
+	if len(assistants) != 1 {
+		t.Fatalf("Expected 1 assistant message, got %d", len(assistants))
+	}
+
+	m := assistants[0]
+	if m.ID != "msg_1" || m.Model != "claude-sonnet-4-5" || m.StopReason != "tool_use" {
+		t.Errorf("Unexpected message metadata: id=%q model=%q stop_reason=%q", m.ID, m.Model, m.StopReason)
+	}
+	if len(m.Content) != 2 {
+		t.Fatalf("Expected 2 content blocks, got %d", len(m.Content))
+	}
+	if text := m.Content[0].Text; text == nil || *text != "Hello, world" {
+		t.Errorf("Expected coalesced text %q, got %v", "Hello, world", text)
+	}
+	if tool := m.Content[1].Tool; tool == nil || tool.Name != "Read" || tool.Input["file_path"] != "main.go" {
+		t.Errorf("Unexpected tool use block: %+v", tool)
+	}
+
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	if !strings.Contains(string(data), "--include-partial-messages\n") {
+		t.Errorf("Expected --include-partial-messages in args, got %q", data)
+	}
+}
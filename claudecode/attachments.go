@@ -0,0 +1,116 @@
+package claudecode
+
+import (
+	"context"
+	"html"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// QueryWithAttachments sends a one-shot query that refers Claude to files it
+// should read with its tools, rather than inlining their contents. Relative
+// paths are resolved against the query's working directory. Each file must
+// exist within the working directory or an added directory, otherwise an
+// INVALID_ATTACHMENT error is returned before the CLI is started.
+func (c *client) QueryWithAttachments(ctx context.Context, prompt string, files []string, opts ...QueryOption) ([]Message, error) {
+	qOpts := &queryOptions{}
+	for _, opt := range opts {
+		opt(qOpts)
+	}
+
+	workingDir := qOpts.workingDir
+	if workingDir == "" {
+		workingDir = c.options.WorkingDirectory
+	}
+	if workingDir == "" {
+		var err error
+		if workingDir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The CLI runs in workingDir, so relative added directories are
+	// resolved against it rather than the process's current directory
+	roots := []string{workingDir}
+	for _, dir := range c.options.AddDirs {
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(workingDir, dir)
+		}
+		roots = append(roots, dir)
+	}
+
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		path, err := resolveAttachment(file, workingDir, roots)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+
+	return c.Query(ctx, attachmentPrompt(prompt, paths), opts...)
+}
+
+// resolveAttachment returns the absolute path of file, checking that it is an
+// existing file within one of roots
+func resolveAttachment(file, workingDir string, roots []string) (string, error) {
+	path := file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDir, path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", &ClaudeError{
+			Code:    "INVALID_ATTACHMENT",
+			Message: "attachment does not exist: " + file,
+			Err:     err,
+		}
+	}
+	if info, err := os.Stat(resolved); err != nil || info.IsDir() {
+		return "", &ClaudeError{
+			Code:    "INVALID_ATTACHMENT",
+			Message: "attachment is not a file: " + file,
+			Err:     err,
+		}
+	}
+
+	for _, root := range roots {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if evaluated, err := filepath.EvalSymlinks(absRoot); err == nil {
+			absRoot = evaluated
+		}
+		rel, err := filepath.Rel(absRoot, resolved)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.Clean(path), nil
+		}
+	}
+
+	return "", &ClaudeError{
+		Code:    "INVALID_ATTACHMENT",
+		Message: "attachment is outside the working and added directories: " + file,
+	}
+}
+
+// attachmentPrompt appends references to the attached files to prompt,
+// escaping the paths so that they cannot break out of the file element
+func attachmentPrompt(prompt string, paths []string) string {
+	if len(paths) == 0 {
+		return prompt
+	}
+
+	var b strings.Builder
+	b.WriteString(prompt)
+	b.WriteString("\n\n<attachments>\n")
+	for _, path := range paths {
+		b.WriteString("<file path=\"")
+		b.WriteString(html.EscapeString(path))
+		b.WriteString("\"/>\n")
+	}
+	b.WriteString("</attachments>\nRead the attached files with your tools as needed.")
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQueryWithAttachments tests that attached files are referenced in the
+// prompt and that files outside the allowed directories are rejected
+func TestQueryWithAttachments(t *testing.T) {
+	root := t.TempDir()
+	workDir := filepath.Join(root, "repo")
+	docsDir := filepath.Join(root, "docs")
+	for _, dir := range []string{workDir, docsDir, filepath.Join(workDir, "pkg")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	for _, file := range []string{filepath.Join(workDir, "pkg", "main.go"), filepath.Join(docsDir, "spec.md"), filepath.Join(root, "secret.txt")} {
+		if err := os.WriteFile(file, []byte("content"), 0o644); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+
+	argsPath := filepath.Join(root, "args.txt")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithWorkingDirectory(workDir),
+		WithAddDirs(docsDir),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	files := []string{"pkg/main.go", filepath.Join(docsDir, "spec.md")}
+	if _, err := c.QueryWithAttachments(ctx, "Does the code match the spec?", files); err != nil {
+		t.Fatalf("QueryWithAttachments failed: %v", err)
+	}
+
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	for _, want := range []string{
+		"Does the code match the spec?",
+		`<file path="` + filepath.Join(workDir, "pkg", "main.go") + `"/>`,
+		`<file path="` + filepath.Join(docsDir, "spec.md") + `"/>`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected prompt to contain %q, got:\n%s", want, data)
+		}
+	}
+
+	for _, file := range []string{filepath.Join(root, "secret.txt"), "../secret.txt", "pkg/missing.go"} {
+		_, err := c.QueryWithAttachments(ctx, "Read this", []string{file})
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) || claudeErr.Code != "INVALID_ATTACHMENT" {
+			t.Errorf("%s: expected INVALID_ATTACHMENT error, got %v", file, err)
+		}
+	}
+}
+
+// TestQueryWithAttachmentsRelativeAddDir tests that relative added
+// directories are resolved against the working directory and that attached
+// paths are escaped in the prompt
+func TestQueryWithAttachmentsRelativeAddDir(t *testing.T) {
+	root := t.TempDir()
+	workDir := filepath.Join(root, "repo")
+	docsDir := filepath.Join(root, "docs")
+	for _, dir := range []string{workDir, docsDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	file := filepath.Join(docsDir, `a"b<c>.md`)
+	if err := os.WriteFile(file, []byte("content"), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", file, err)
+	}
+
+	argsPath := filepath.Join(root, "args.txt")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithWorkingDirectory(workDir),
+		WithAddDirs(filepath.Join("..", "docs")),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.QueryWithAttachments(ctx, "Summarize", []string{file}); err != nil {
+		t.Fatalf("QueryWithAttachments failed: %v", err)
+	}
+
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	want := `<file path="` + filepath.Join(docsDir, "a&#34;b&lt;c&gt;.md") + `"/>`
+	if !strings.Contains(string(data), want) {
+		t.Errorf("Expected prompt to contain %q, got:\n%s", want, data)
+	}
+}
@@ -0,0 +1,40 @@
+package claudecode
+
+import "context"
+
+// Broadcast fans the messages of in out to n channels, each of which receives
+// every message in order, so that one stream can be displayed and logged
+// without running the query twice. Each output channel buffers up to buffer
+// messages; once a consumer's buffer is full, delivery waits for it, so every
+// output must be drained. The outputs are closed when in is closed or ctx is
+// done.
+//
+// Consumers share the same Message values and must not modify them.
+func Broadcast(ctx context.Context, in <-chan Message, n, buffer int) []<-chan Message {
+	outs := make([]chan Message, n)
+	result := make([]<-chan Message, n)
+	for i := range outs {
+		outs[i] = make(chan Message, buffer)
+		result[i] = outs[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+
+		for msg := range in {
+			for _, out := range outs {
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return result
+}
@@ -0,0 +1,57 @@
+package claudecode
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBroadcast tests that every consumer receives the full stream in order
+func TestBroadcast(t *testing.T) {
+	c, err := New(WithCLIPath(writeFakeCLI(t, fakeConversationScript(5))))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgChan, err := c.QueryStream(ctx, "Hello")
+	if err != nil {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+
+	outs := Broadcast(ctx, msgChan, 2, 1)
+	if len(outs) != 2 {
+		t.Fatalf("Expected 2 outputs, got %d", len(outs))
+	}
+
+	received := make([][]Message, len(outs))
+	var wg sync.WaitGroup
+	for i, out := range outs {
+		wg.Add(1)
+		go func(i int, out <-chan Message) {
+			defer wg.Done()
+			for msg := range out {
+				received[i] = append(received[i], msg)
+			}
+		}(i, out)
+	}
+	wg.Wait()
+
+	for i, msgs := range received {
+		if len(msgs) != 6 {
+			t.Fatalf("Consumer %d: expected 6 messages, got %d", i, len(msgs))
+		}
+		if _, ok := msgs[len(msgs)-1].(*ResultMessage); !ok {
+			t.Errorf("Consumer %d: expected the stream to end with a result, got %T", i, msgs[len(msgs)-1])
+		}
+	}
+	for j := range received[0] {
+		if received[0][j] != received[1][j] {
+			t.Errorf("Message %d differs between consumers", j)
+		}
+	}
+}
@@ -4,14 +4,20 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"os"
 	"sync"
+	"time"
 )
 
 // client implements the Client interface
 type client struct {
-	options *Options
-	logger  *slog.Logger
-	mu      sync.Mutex
+	options    *Options
+	logger     *slog.Logger
+	mu         sync.Mutex
+	persistent *persistentProcess
+
+	// persistentMu serializes the queries run on the persistent process
+	persistentMu sync.Mutex
 }
 
 // New creates a new Claude client with the given options
@@ -24,7 +30,7 @@ func New(opts ...Option) (Client, error) {
 	}
 
 	// Validate options
-	if err := options.validate(); err != nil {
+	if err := options.Validate(); err != nil {
 		return nil, err
 	}
 
@@ -39,106 +45,692 @@ func New(opts ...Option) (Client, error) {
 	}, nil
 }
 
+// queryScope returns the options and logger for a single query. When a
+// request ID is set, it is attached to every log record of the client and
+// transport for that query. When AllowedToolsFunc is set, the allowed tools
+// are computed from the prompt, and a per-query working directory replaces the
+// client's after checking that it exists.
+func (c *client) queryScope(prompt string, qOpts *queryOptions) (*Options, *slog.Logger, error) {
+	routed := qOpts.taskHint != "" && c.options.ModelRouter != nil
+	if qOpts.requestID == "" && qOpts.workingDir == "" && c.options.AllowedToolsFunc == nil && !routed {
+		return c.options, c.logger, nil
+	}
+
+	scoped := c.options.clone()
+	if scoped.AllowedToolsFunc != nil {
+		scoped.AllowedTools = scoped.AllowedToolsFunc(prompt)
+	}
+	if routed {
+		if model := scoped.ModelRouter(qOpts.taskHint); model != "" {
+			scoped.Model = model
+		}
+	}
+	if qOpts.workingDir != "" {
+		if _, err := os.Stat(qOpts.workingDir); err != nil {
+			return nil, nil, &ClaudeError{
+				Code:    "INVALID_OPTIONS",
+				Message: "working directory does not exist",
+				Err:     err,
+			}
+		}
+		if scoped.RequireGitRepo {
+			if err := requireGitRepo(qOpts.workingDir); err != nil {
+				return nil, nil, err
+			}
+		}
+		scoped.WorkingDirectory = qOpts.workingDir
+	}
+	if qOpts.requestID == "" {
+		return scoped, c.logger, nil
+	}
+
+	base := scoped.Logger
+	if base == nil {
+		base = slog.Default()
+	}
+	scoped.Logger = base.With("request_id", qOpts.requestID)
+
+	return scoped, c.logger.With("request_id", qOpts.requestID), nil
+}
+
 // Query sends a single prompt to Claude and blocks until the complete response is received.
-// It collects all messages until a ResultMessage is encountered, then returns them as a slice.
+// It collects all messages until the final ResultMessage is encountered, then returns them as a slice.
 // Use this for simple request-response interactions where you need the complete result at once.
 func (c *client) Query(ctx context.Context, prompt string, opts ...QueryOption) ([]Message, error) {
-	qOpts := &queryOptions{sessionID: "default"}
+	qOpts := &queryOptions{}
 	for _, opt := range opts {
 		opt(qOpts)
 	}
+	if qOpts.sessionID == "" {
+		qOpts.sessionID = c.options.newSessionID()
+		qOpts.generatedID = c.options.SessionIDGenerator != nil
+	}
+
+	options, logger, err := c.queryScope(prompt, qOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	err = retryQuery(ctx, options, logger, func() error {
+		var err error
+		messages, err = c.queryOnce(ctx, prompt, qOpts, options, logger)
+		return err
+	})
+	return messages, err
+}
+
+// retryQuery runs attempt until it succeeds or the retry policy, if any,
+// gives up, returning the error of the last attempt
+func retryQuery(ctx context.Context, options *Options, logger *slog.Logger, attempt func() error) error {
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || options.RetryPolicy == nil || ctx.Err() != nil {
+			return err
+		}
 
-	transport := NewOneShotTransport(c.options, prompt)
+		retry, backoff := options.RetryPolicy(err, n)
+		if !retry {
+			return err
+		}
+		logger.Warn("query failed, retrying",
+			slog.Int("attempt", n),
+			slog.Duration("backoff", backoff),
+			slog.Any("error", err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// queryOnce runs a single attempt of Query
+func (c *client) queryOnce(ctx context.Context, prompt string, qOpts *queryOptions, options *Options, logger *slog.Logger) ([]Message, error) {
+	// The warm process was started with the client's command line and
+	// directory, so queries that change either get their own process
+	if options.PersistentProcess && options.AllowedToolsFunc == nil && qOpts.workingDir == "" && options.Model == c.options.Model {
+		return c.queryPersistent(ctx, prompt, qOpts, options, logger)
+	}
+
+	var transport *SubprocessTransport
+	if qOpts.promptOnStdin {
+		promptChan, err := newPromptChan(options, prompt, qOpts.sessionID)
+		if err != nil {
+			return nil, err
+		}
+		transport = NewStreamingTransport(options, promptChan, true)
+	} else {
+		transport = NewOneShotTransport(options, prompt)
+		// The CLI rejects a --session-id that is not a UUID, so only
+		// generated UUIDs name the conversation; other IDs are only
+		// envelope metadata, which one-shot queries do not send
+		if qOpts.generatedID && isUUID(qOpts.sessionID) {
+			transport.sessionID = qOpts.sessionID
+		}
+	}
 
 	if err := transport.Connect(ctx); err != nil {
 		return nil, err
 	}
 	defer transport.Close()
 
-	msgChan, err := transport.Receive(ctx)
+	msgChan, err := transport.receiveMessages(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	var messages []Message
-	for rawMsg := range msgChan {
-		msg, err := ParseMessage(rawMsg)
+	collector := newQueryCollector(options, logger, qOpts)
+	for received := range msgChan {
+		// Stdin is closed once the prompt is written, so the CLI cannot be
+		// interrupted; closing the transport on return terminates it
+		done, err := collector.add(received)
 		if err != nil {
-			c.logger.Warn("failed to parse message", "error", err, "data", rawMsg)
-			continue
+			return collector.messages, err
 		}
-		messages = append(messages, msg)
-		if _, ok := msg.(*ResultMessage); ok {
-			break
+		if done {
+			return collector.messages, nil
 		}
 	}
 
-	return messages, nil
+	// The output ended without a result. A CLI that fails on startup
+	// produces no messages, and one that crashes mid-run leaves them
+	// incomplete; either way surface the exit status and stderr rather than
+	// a successful result
+	if err := transport.ExitError(); err != nil {
+		return collector.messages, err
+	}
+
+	return collector.messages, nil
+}
+
+// maxArgPrompt is the largest prompt QueryFile passes on the command line;
+// larger prompts are written to the CLI's stdin to stay within the limits on
+// argument length
+const maxArgPrompt = 64 * 1024
+
+// QueryFile sends the contents of the file at path as a one-shot query. It
+// behaves like Query, including retries and ResultOnly, whichever way the
+// prompt reaches the CLI.
+func (c *client) QueryFile(ctx context.Context, path string, opts ...QueryOption) ([]Message, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt file: %w", err)
+	}
+	prompt := string(data)
+
+	if len(prompt) > maxArgPrompt {
+		opts = append(opts, withPromptOnStdin())
+	}
+	return c.Query(ctx, prompt, opts...)
+}
+
+// newPromptChan returns a closed channel holding prompt encoded as the single
+// message of a streamed query
+func newPromptChan(options *Options, prompt, sessionID string) (chan map[string]any, error) {
+	promptMsg, err := options.encodeMessage(NewUserMessage(prompt), MessageMeta{SessionID: sessionID})
+	if err != nil {
+		return nil, err
+	}
+
+	promptChan := make(chan map[string]any, 1)
+	promptChan <- promptMsg
+	close(promptChan)
+	return promptChan, nil
+}
+
+// queryCollector accumulates the messages of a single query
+type queryCollector struct {
+	options  *Options
+	logger   *slog.Logger
+	qOpts    *queryOptions
+	limiter  *toolUseLimiter
+	failures *toolFailureDetector
+	progress *progressLine
+	turns    *turnTracker
+	messages []Message
+}
+
+// newQueryCollector creates a collector for a query with the given options
+func newQueryCollector(options *Options, logger *slog.Logger, qOpts *queryOptions) *queryCollector {
+	return &queryCollector{
+		options:  options,
+		logger:   logger,
+		qOpts:    qOpts,
+		limiter:  &toolUseLimiter{max: options.MaxToolUsesPerTurn},
+		failures: newToolFailureDetector(options),
+		progress: newProgressLine(options),
+		turns:    newTurnTracker(options),
+	}
+}
+
+// add processes a raw message and reports whether the query is complete. It
+// returns an error when the tool use limit is exceeded.
+func (q *queryCollector) add(received receivedMessage) (bool, error) {
+	observeReceived(q.options, q.turns, &received)
+
+	// Skipped messages are still parsed when the tool use limit or tool
+	// failures must be checked against them
+	skip := q.qOpts.resultOnly && received.envelope.Type != string(MessageTypeResult)
+	if skip && q.limiter.max <= 0 && q.failures == nil {
+		return false, nil
+	}
+
+	msg, err := received.parse(q.options.ProtocolVersion)
+	if err != nil {
+		if skip {
+			return false, nil
+		}
+		if q.options.StrictParsing {
+			return true, err
+		}
+		q.logger.Warn("failed to parse message", "error", err, "data", received.decode())
+		return false, nil
+	}
+	if !skip {
+		q.messages = append(q.messages, msg)
+		q.progress.update(msg)
+	}
+
+	if q.limiter.observe(msg) {
+		return true, toolLimitError(q.limiter.max)
+	}
+	if err := q.failures.observe(msg); err != nil {
+		return true, err
+	}
+	if result, ok := finalResult(msg); ok {
+		writeSummary(q.options, result)
+		if q.qOpts.onResult != nil {
+			q.qOpts.onResult(result)
+		}
+		if budget := q.options.CostBudgetUSD; budget > 0 && result.TotalCostUSD != nil && *result.TotalCostUSD > budget {
+			return true, budgetError(budget, *result.TotalCostUSD)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// sendStreamError delivers the ErrorMessage that ends a stream, such as when
+// a message fails to parse in strict parsing mode
+func sendStreamError(ctx context.Context, msgChan chan<- Message, errorType string, err error, rawMsg map[string]any) {
+	msg := &ErrorMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeError},
+		ErrorType:   errorType,
+		Message:     err.Error(),
+		Data:        rawMsg,
+	}
+	select {
+	case msgChan <- msg:
+	case <-ctx.Done():
+	}
 }
 
 // QueryStream sends a query and returns a channel for streaming responses
 func (c *client) QueryStream(ctx context.Context, prompt string, opts ...QueryOption) (<-chan Message, error) {
-	qOpts := &queryOptions{sessionID: "default"}
+	msgChan, _, err := c.queryStream(ctx, prompt, opts...)
+	return msgChan, err
+}
+
+// queryStream starts a streaming query, returning its message channel and a
+// function reporting the error that ended the stream, if any, once the
+// channel has closed. The transport is closed before the channel is.
+func (c *client) queryStream(ctx context.Context, prompt string, opts ...QueryOption) (<-chan Message, func() error, error) {
+	qOpts := &queryOptions{}
 	for _, opt := range opts {
 		opt(qOpts)
 	}
+	if qOpts.sessionID == "" {
+		qOpts.sessionID = c.options.newSessionID()
+	}
+
+	options, logger, err := c.queryScope(prompt, qOpts)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Create channel for single prompt
-	promptChan := make(chan map[string]any, 1)
-	promptChan <- map[string]any{
-		"type": "user",
-		"message": map[string]any{
-			"role":    "user",
-			"content": prompt,
-		},
-		"parent_tool_use_id": nil,
-		"session_id":         qOpts.sessionID,
+	promptChan, err := newPromptChan(options, prompt, qOpts.sessionID)
+	if err != nil {
+		return nil, nil, err
 	}
-	close(promptChan)
 
 	// Create streaming transport with closeStdinAfterPrompt=true
-	transport := NewStreamingTransport(c.options, promptChan, true)
+	transport := NewStreamingTransport(options, promptChan, true)
+
+	// When the result must be delivered, keep the process alive past
+	// cancellation of the consumer's context so it can be drained
+	transportCtx := ctx
+	if qOpts.onResult != nil {
+		transportCtx = context.WithoutCancel(ctx)
+	}
 
 	// Connect
-	if err := transport.Connect(ctx); err != nil {
-		return nil, err
+	if err := transport.Connect(transportCtx); err != nil {
+		return nil, nil, err
 	}
 
 	// Receive messages
-	rawChan, err := transport.Receive(ctx)
+	rawChan, err := transport.receiveMessages(transportCtx)
 	if err != nil {
 		transport.Close()
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Convert raw messages to typed messages
+	// Convert raw messages to typed messages. When the result must be
+	// delivered, messages are queued for the consumer so that one that stops
+	// receiving without cancelling ctx cannot hold up the result.
 	msgChan := make(chan Message)
+	out := msgChan
+	if qOpts.onResult != nil {
+		out = make(chan Message)
+		go forwardMessages(ctx, msgChan, out)
+	}
+
+	// stopErr is set when the stream is stopped early, and sawResult once the
+	// result is delivered, before msgChan closes
+	var (
+		stopErr   error
+		sawResult bool
+	)
+	streamErr := func() error {
+		if stopErr != nil {
+			return stopErr
+		}
+		if sawResult {
+			return nil
+		}
+		return transport.ExitError()
+	}
 
 	go func() {
 		defer close(msgChan)
 		defer transport.Close()
 
-		for rawMsg := range rawChan {
-			msg, err := ParseMessage(rawMsg)
+		limiter := &toolUseLimiter{max: options.MaxToolUsesPerTurn}
+		failures := newToolFailureDetector(options)
+		progress := newProgressLine(options)
+		turns := newTurnTracker(options)
+		for received := range rawChan {
+			observeReceived(options, turns, &received)
+
+			msg, err := received.parse(options.ProtocolVersion)
 			if err != nil {
-				c.logger.Warn("failed to parse message", "error", err, "data", rawMsg)
+				if options.StrictParsing {
+					sendStreamError(ctx, msgChan, "parse_error", err, received.decode())
+					return
+				}
+				logger.Warn("failed to parse message", "error", err, "data", received.decode())
 				continue
 			}
+			progress.update(msg)
+			if qOpts.stream != nil {
+				qOpts.stream.observe(msg)
+			}
+
+			// Stdin is closed after the prompt, so the CLI cannot be
+			// interrupted; the stream is stopped once msg is delivered
+			var stopType string
+			if limiter.observe(msg) {
+				logger.Warn("tool use limit exceeded, stopping", "max", limiter.max)
+				stopType, stopErr = "tool_limit_exceeded", toolLimitError(limiter.max)
+			} else if toolErr := failures.observe(msg); toolErr != nil {
+				logger.Warn("tool failed, stopping", "tool", toolErr.ToolName, "error", toolErr.Message)
+				stopType, stopErr = "tool_failed", toolErr
+			}
+
+			result, isResult := finalResult(msg)
+			if isResult {
+				writeSummary(options, result)
+				if qOpts.onResult != nil {
+					qOpts.onResult(result)
+				}
+				if budget := options.CostBudgetUSD; budget > 0 && stopErr == nil && result.TotalCostUSD != nil && *result.TotalCostUSD > budget {
+					logger.Warn("cost budget exceeded", "budget", budget)
+					stopType, stopErr = "budget_exceeded", budgetError(budget, *result.TotalCostUSD)
+				}
+			}
 
 			select {
 			case msgChan <- msg:
+				sawResult = sawResult || isResult
 			case <-ctx.Done():
+				if !isResult && qOpts.onResult != nil {
+					drainResult(logger, rawChan, options.ProtocolVersion, qOpts.onResult)
+				}
+				return
+			}
+
+			if stopErr != nil {
+				sendStreamError(ctx, msgChan, stopType, stopErr, nil)
 				return
 			}
 
 			// Stop after ResultMessage
-			if _, ok := msg.(*ResultMessage); ok {
+			if isResult {
 				return
 			}
 		}
 	}()
 
-	return msgChan, nil
+	return out, streamErr, nil
+}
+
+// forwardMessages passes the messages from in to out in order, queueing them
+// so that the sender never waits for the consumer. Once ctx is done the
+// queued and remaining messages are discarded. out is closed after in is.
+func forwardMessages(ctx context.Context, in <-chan Message, out chan<- Message) {
+	defer close(out)
+
+	var queue []Message
+	for in != nil || len(queue) > 0 {
+		var send chan<- Message
+		var next Message
+		if len(queue) > 0 {
+			send, next = out, queue[0]
+		}
+
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			queue = append(queue, msg)
+		case send <- next:
+			queue = queue[1:]
+		case <-ctx.Done():
+			if in != nil {
+				for range in {
+				}
+			}
+			return
+		}
+	}
+}
+
+// drainResult consumes remaining raw messages until the final ResultMessage
+// arrives and passes it to onResult
+func drainResult(logger *slog.Logger, rawChan <-chan receivedMessage, version ProtocolVersion, onResult func(*ResultMessage)) {
+	for received := range rawChan {
+		if received.envelope.Type != string(MessageTypeResult) {
+			continue
+		}
+
+		msg, err := received.parse(version)
+		if err != nil {
+			logger.Warn("failed to parse message", "error", err, "data", received.decode())
+			continue
+		}
+		if result, ok := finalResult(msg); ok {
+			onResult(result)
+			return
+		}
+	}
+}
+
+// observeReceived runs the tool, usage, and turn callbacks for a received
+// message, decoding it as a map only when one of them is configured
+func observeReceived(opts *Options, turns *turnTracker, received *receivedMessage) {
+	if opts.OnToolUse == nil && opts.OnToolResult == nil && opts.EditFilter == nil && opts.OnUsage == nil && turns == nil {
+		return
+	}
+
+	rawMsg := received.decode()
+	dispatchToolCallbacks(opts, rawMsg)
+	dispatchUsage(opts, rawMsg)
+	turns.observe(rawMsg)
+}
+
+// dispatchToolCallbacks invokes the tool callbacks configured in opts for the
+// tool_use and tool_result blocks of a raw message
+func dispatchToolCallbacks(opts *Options, rawMsg map[string]any) {
+	// Edits are applied without a permission prompt in accept-edits mode,
+	// so the edit filter can only report them
+	auditEdits := opts.EditFilter != nil && opts.PermissionMode == PermissionModeAcceptEdits
+	if opts.OnToolUse == nil && opts.OnToolResult == nil && !auditEdits {
+		return
+	}
+
+	content, ok := nestedContent(rawMsg)
+	if !ok {
+		return
+	}
+
+	for _, block := range decodeContentBlocks(content) {
+		if block.Tool != nil && auditEdits {
+			auditEdit(opts, block.Tool)
+		}
+		switch {
+		case block.Tool != nil && opts.OnToolUse != nil:
+			opts.OnToolUse(block.Tool)
+		case block.Result != nil && opts.OnToolResult != nil:
+			opts.OnToolResult(block.Result)
+		}
+	}
+}
+
+// auditEdit logs an edit the edit filter rejects but cannot block
+func auditEdit(opts *Options, tool *ToolUse) {
+	op, ok := editOp(tool.Name, tool.Input)
+	if !ok || opts.EditFilter(op) {
+		return
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.Warn("edit filter rejected an edit applied in accept-edits mode",
+		"tool", op.Tool, "file_path", op.FilePath)
+}
+
+// CountTokens returns an approximate token count for prompt, combined with
+// the configured system prompts, using EstimateTokens
+func (c *client) CountTokens(ctx context.Context, prompt string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return EstimateTokens(c.options.SystemPrompt) +
+		EstimateTokens(c.options.appendedSystemPrompt()) +
+		EstimateTokens(prompt), nil
+}
+
+// toolUseLimiter counts tool_use blocks per turn, where a turn ends with a
+// ResultMessage
+type toolUseLimiter struct {
+	max     int
+	count   int
+	tripped bool
+}
+
+// observe records the tool uses in msg and reports whether the limit was
+// exceeded by it. It reports true at most once per turn.
+func (l *toolUseLimiter) observe(msg Message) bool {
+	if l.max <= 0 {
+		return false
+	}
+
+	switch m := msg.(type) {
+	case *AssistantMessage:
+		for _, block := range m.Content {
+			if block.Tool != nil {
+				l.count++
+			}
+		}
+		if l.count > l.max && !l.tripped {
+			l.tripped = true
+			return true
+		}
+	case *ResultMessage:
+		if m.IsFinal() {
+			l.count = 0
+			l.tripped = false
+		}
+	}
+	return false
+}
+
+// toolFailureDetector finds failed tool results, remembering the names of
+// the tool uses they answer. A nil toolFailureDetector finds nothing.
+type toolFailureDetector struct {
+	names map[string]string
+}
+
+// newToolFailureDetector returns a detector if opts aborts on tool errors
+func newToolFailureDetector(opts *Options) *toolFailureDetector {
+	if !opts.AbortOnToolError {
+		return nil
+	}
+	return &toolFailureDetector{names: make(map[string]string)}
+}
+
+// observe records the tool uses in msg and returns the error of the first
+// failed tool result in it, if any
+func (d *toolFailureDetector) observe(msg Message) *ToolError {
+	if d == nil {
+		return nil
+	}
+
+	switch m := msg.(type) {
+	case *AssistantMessage:
+		for _, block := range m.Content {
+			if block.Tool != nil {
+				d.names[block.Tool.ID] = block.Tool.Name
+			}
+		}
+	case *UserMessage:
+		for _, block := range m.Blocks {
+			if block.Result == nil {
+				continue
+			}
+			if toolErr := block.Result.toolError(); toolErr != nil {
+				toolErr.ToolName = d.names[toolErr.ToolUseID]
+				return toolErr
+			}
+		}
+	}
+	return nil
+}
+
+// turnTracker reports turn progress from the turn numbers carried by system
+// and result messages. A nil turnTracker reports nothing.
+type turnTracker struct {
+	fn   func(turn int)
+	last int
+}
+
+// newTurnTracker returns a turn tracker for opts, or nil if no turn callback
+// is configured
+func newTurnTracker(opts *Options) *turnTracker {
+	if opts.OnTurn == nil {
+		return nil
+	}
+	return &turnTracker{fn: opts.OnTurn}
+}
+
+// observe calls the turn callback when rawMsg carries a turn number beyond
+// the last one reported. A final result starts the count over for the next
+// run.
+func (t *turnTracker) observe(rawMsg map[string]any) {
+	if t == nil {
+		return
+	}
+
+	var turn float64
+	switch rawMsg["type"] {
+	case string(MessageTypeSystem):
+		turn, _ = rawMsg["num_turns"].(float64)
+		if data, ok := rawMsg["data"].(map[string]any); ok && turn == 0 {
+			turn, _ = data["num_turns"].(float64)
+		}
+	case string(MessageTypeResult):
+		turn, _ = rawMsg["num_turns"].(float64)
+	default:
+		return
+	}
+
+	if int(turn) > t.last {
+		t.last = int(turn)
+		t.fn(t.last)
+	}
+	if rawMsg["type"] == string(MessageTypeResult) && rawMsg["parent_tool_use_id"] == nil {
+		t.last = 0
+	}
+}
+
+// toolLimitError returns the error reported when the tool use limit is exceeded
+func toolLimitError(limit int) error {
+	return fmt.Errorf("%w: more than %d tool uses in one turn", ErrToolLimitExceeded, limit)
+}
+
+// budgetError returns the error reported when spend exceeds the cost budget
+func budgetError(budget, spent float64) error {
+	return fmt.Errorf("%w: spent $%.4f of $%.4f", ErrBudgetExceeded, spent, budget)
 }
 
 // NewSession creates a new interactive session
@@ -148,26 +740,55 @@ func (c *client) NewSession(ctx context.Context, opts ...SessionOption) (Session
 		opt(sOpts)
 	}
 
-	// Create empty prompt channel for interactive mode
-	promptChan := make(chan map[string]any)
+	// Apply per-session overrides to a copy of the client options
+	options := c.options
+	resume := sOpts.resume
+	if sOpts.restoreState != nil {
+		resume = sOpts.restoreState.SessionID
+	}
+	if sOpts.allowedTools != nil || resume != "" {
+		options = c.options.clone()
+		if sOpts.allowedTools != nil {
+			options.AllowedTools = sOpts.allowedTools
+		}
+		if resume != "" {
+			options.Resume = resume
+			options.Continue = false
+			options.ContinueOrNew = false
+		}
+	}
+
+	// Outbound messages carry envelopeID until the CLI reports the session
+	// ID, which is only known up front when resuming
+	envelopeID := resume
+	if envelopeID == "" {
+		envelopeID = c.options.newSessionID()
+	}
 
-	// If initial prompt provided, send it
+	// Context messages go ahead of the initial prompt
+	initialPrompts := append([]string(nil), sOpts.contextMessages...)
 	if sOpts.initialPrompt != "" {
-		go func() {
-			promptChan <- map[string]any{
-				"type": "user",
-				"message": map[string]any{
-					"role":    "user",
-					"content": sOpts.initialPrompt,
-				},
-				"parent_tool_use_id": nil,
-				"session_id":         "default",
-			}
-		}()
+		initialPrompts = append(initialPrompts, sOpts.initialPrompt)
+	}
+	initialMsgs := make([]map[string]any, 0, len(initialPrompts))
+	for _, prompt := range initialPrompts {
+		msg, err := options.encodeMessage(NewUserMessage(prompt), MessageMeta{SessionID: envelopeID})
+		if err != nil {
+			return nil, err
+		}
+		initialMsgs = append(initialMsgs, msg)
+	}
+
+	// Queue the initial messages on the prompt channel so that Connect writes
+	// them before anything sent on the session, and before it waits for the
+	// init message, which the CLI only emits once it has input
+	promptChan := make(chan map[string]any, len(initialMsgs))
+	for _, msg := range initialMsgs {
+		promptChan <- msg
 	}
 
 	// Create streaming transport with closeStdinAfterPrompt=false for interactive mode
-	transport := NewStreamingTransport(c.options, promptChan, false)
+	transport := NewStreamingTransport(options, promptChan, false)
 
 	// Connect
 	if err := transport.Connect(ctx); err != nil {
@@ -175,15 +796,38 @@ func (c *client) NewSession(ctx context.Context, opts ...SessionOption) (Session
 	}
 
 	sess := &session{
+		options:    options,
 		transport:  transport,
+		ready:      transport.Ready(),
 		logger:     c.logger.With("component", "session"),
 		ctx:        ctx,
 		promptChan: promptChan,
+		sessionID:  resume,
+		envelopeID: envelopeID,
+		inFlight:   len(initialMsgs),
+		msgs:       make(chan Message),
+		done:       make(chan struct{}),
+	}
+	if state := sOpts.restoreState; state != nil {
+		sess.sessionID = state.SessionID
+		sess.baseCostUSD = state.TotalCostUSD
+		sess.totalCostUSD = state.TotalCostUSD
+		sess.numTurns = state.NumTurns
+	}
+	if sOpts.transcript {
+		sess.transcript = &transcript{}
+		for _, prompt := range initialPrompts {
+			sess.transcript.addUser(prompt)
+		}
 	}
 
 	// Monitor context cancellation
 	go func() {
 		<-ctx.Done()
+		// Let the transport interrupt the CLI before the session closes it
+		if options.InterruptOnContextCancel {
+			<-transport.closeCh
+		}
 		// If context is cancelled, ensure cleanup happens
 		// Don't log here as it might race with other cleanup
 		_ = sess.Close()
@@ -192,115 +836,330 @@ func (c *client) NewSession(ctx context.Context, opts ...SessionOption) (Session
 	return sess, nil
 }
 
+// RestoreSession creates a session that resumes the conversation saved with
+// Session.SaveState
+func (c *client) RestoreSession(ctx context.Context, path string, opts ...SessionOption) (Session, error) {
+	state, err := LoadSessionState(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewSession(ctx, append(opts, withRestoreState(state))...)
+}
+
 // Close closes the client
 func (c *client) Close() error {
-	// Currently no persistent resources to clean up
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closePersistent()
 	return nil
 }
 
 // session implements the Session interface
 type session struct {
-	transport  Transport
+	options    *Options
+	transport  *SubprocessTransport
 	logger     *slog.Logger
 	ctx        context.Context
 	promptChan chan<- map[string]any
 	mu         sync.Mutex
 	closed     bool
-	sessionID  string
+	sessionID  string // reported by the CLI, or resumed
+	envelopeID string // sent with messages until sessionID is known
+	transcript *transcript
+	ready      <-chan struct{}
+
+	// Cumulative totals across the session's results. The CLI reports cost
+	// as a running total for its process, which is added to baseCostUSD,
+	// the cost restored from a saved state.
+	baseCostUSD       float64
+	totalCostUSD      float64
+	numTurns          int
+	budgetInterrupted bool
+
+	// Prompts sent while turns are in flight are held until they complete
+	inFlight int
+	pending  []pendingPrompt
+
+	// Tool results received so far, by tool use ID
+	toolResults map[string]*ToolResult
+
+	// The CLI's output is read by one pump for the lifetime of the session
+	// and handed to the receive calls through msgs; messages taken by a call
+	// that stopped before delivering them are kept in unread
+	receiveOnce sync.Once
+	receiveErr  error
+	msgs        chan Message
+	unread      []Message
+	done        chan struct{}
+}
+
+// pendingPrompt is an encoded message waiting for the turn in flight
+type pendingPrompt struct {
+	raw map[string]any
+	msg Message
+}
+
+// budgetErrLocked returns ErrBudgetExceeded if the cumulative cost exceeds the
+// configured budget. The caller must hold s.mu.
+func (s *session) budgetErrLocked() error {
+	if budget := s.options.CostBudgetUSD; budget > 0 && s.totalCostUSD > budget {
+		return budgetError(budget, s.totalCostUSD)
+	}
+	return nil
+}
+
+// budgetErr returns ErrBudgetExceeded if the cumulative cost exceeds the
+// configured budget
+func (s *session) budgetErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.budgetErrLocked()
 }
 
 // Send sends a message in the session
 func (s *session) Send(ctx context.Context, message string) error {
+	return s.SendMessage(ctx, NewUserMessage(message))
+}
+
+// SendMessage sends a pre-constructed message
+func (s *session) SendMessage(ctx context.Context, msg Message) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.closed {
 		return ErrStreamClosed
 	}
+	if err := s.budgetErrLocked(); err != nil {
+		return err
+	}
 
 	// Get session ID while we already hold the lock
 	sessionID := s.sessionID
 	if sessionID == "" {
-		sessionID = "default"
+		sessionID = s.envelopeID
 	}
 
-	msg := map[string]any{
-		"type": "user",
-		"message": map[string]any{
-			"role":    "user",
-			"content": message,
-		},
-		"parent_tool_use_id": nil,
-		"session_id":         sessionID,
+	rawMsg, err := s.options.encodeMessage(msg, MessageMeta{SessionID: sessionID})
+	if err != nil {
+		return err
 	}
 
-	return s.transport.Send(ctx, []map[string]any{msg})
+	if s.inFlight > 0 {
+		s.pending = append(s.pending, pendingPrompt{raw: rawMsg, msg: msg})
+		return nil
+	}
+	return s.writeLocked(ctx, rawMsg, msg)
 }
 
-// SendMessage sends a pre-constructed message
-func (s *session) SendMessage(ctx context.Context, msg Message) error {
+// writeLocked writes an encoded message to the CLI, starting a turn. The
+// caller must hold s.mu.
+func (s *session) writeLocked(ctx context.Context, rawMsg map[string]any, msg Message) error {
+	if err := s.transport.Send(ctx, []map[string]any{rawMsg}); err != nil {
+		return err
+	}
+	s.inFlight++
+	if userMsg, ok := msg.(*UserMessage); ok && s.transcript != nil {
+		s.transcript.addUser(userMsg.Content)
+	}
+	return nil
+}
+
+// sendPending ends a turn in flight and, once none remain, writes the next
+// queued prompt. Queued prompts are dropped once the cost budget is exceeded.
+func (s *session) sendPending(ctx context.Context) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.closed {
-		return ErrStreamClosed
+	if s.inFlight > 0 {
+		s.inFlight--
+	}
+	if s.inFlight > 0 || s.closed || len(s.pending) == 0 {
+		return
+	}
+	if err := s.budgetErrLocked(); err != nil {
+		s.logger.Warn("dropping queued prompts", "count", len(s.pending), "error", err)
+		s.pending = nil
+		return
 	}
 
-	// Convert Message to raw format
-	// For now, only support UserMessage
-	userMsg, ok := msg.(*UserMessage)
-	if !ok {
-		return fmt.Errorf("%w: only UserMessage supported for sending", ErrInvalidMessage)
+	next := s.pending[0]
+	s.pending = s.pending[1:]
+	if err := s.writeLocked(ctx, next.raw, next.msg); err != nil {
+		s.logger.Warn("failed to send queued prompt", "error", err)
 	}
+}
 
-	// Get session ID while we already hold the lock
-	sessionID := s.sessionID
-	if sessionID == "" {
-		sessionID = "default"
+// CancelPending discards prompts that are queued behind the turn in flight
+// and have not been written to the CLI, returning how many were discarded
+func (s *session) CancelPending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.pending)
+	s.pending = nil
+	return n
+}
+
+// startReceive starts the session's receive pump on first use. The pump reads
+// the CLI's output for the lifetime of the session, so that the context of a
+// single receive call never stops it. It returns ErrNotConnected once the
+// session is closed.
+func (s *session) startReceive() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrNotConnected
 	}
 
-	rawMsg := map[string]any{
-		"type": "user",
-		"message": map[string]any{
-			"role":    "user",
-			"content": userMsg.Content,
-		},
-		"parent_tool_use_id": nil,
-		"session_id":         sessionID,
+	s.receiveOnce.Do(func() {
+		rawChan, err := s.transport.receiveMessages(s.ctx)
+		if err != nil {
+			s.receiveErr = err
+			close(s.msgs)
+			return
+		}
+		go s.pump(rawChan)
+	})
+	return s.receiveErr
+}
+
+// pump converts the raw messages read from the CLI, applies the session's
+// limits and bookkeeping, and hands the messages to the receive calls
+func (s *session) pump(rawChan <-chan receivedMessage) {
+	defer close(s.msgs)
+
+	ctx := s.ctx
+	limiter := &toolUseLimiter{max: s.options.MaxToolUsesPerTurn}
+	failures := newToolFailureDetector(s.options)
+	progress := newProgressLine(s.options)
+	turns := newTurnTracker(s.options)
+	for received := range rawChan {
+		observeReceived(s.options, turns, &received)
+
+		msg, err := received.parse(s.options.ProtocolVersion)
+		if err != nil {
+			if s.options.StrictParsing {
+				msg = &ErrorMessage{
+					BaseMessage: BaseMessage{MessageType: MessageTypeError},
+					ErrorType:   "parse_error",
+					Message:     err.Error(),
+					Data:        received.decode(),
+				}
+				select {
+				case s.msgs <- msg:
+				case <-s.done:
+				}
+				return
+			}
+			s.logger.Warn("failed to parse message", "error", err, "data", received.decode())
+			continue
+		}
+		progress.update(msg)
+
+		if limiter.observe(msg) {
+			s.logger.Warn("tool use limit exceeded, interrupting", "max", limiter.max)
+			if err := s.transport.Interrupt(ctx); err != nil {
+				s.logger.Warn("failed to interrupt", "error", err)
+			}
+		}
+		if toolErr := failures.observe(msg); toolErr != nil {
+			s.logger.Warn("tool failed, interrupting", "tool", toolErr.ToolName, "error", toolErr.Message)
+			if err := s.transport.Interrupt(ctx); err != nil {
+				s.logger.Warn("failed to interrupt", "error", err)
+			}
+		}
+
+		if s.transcript != nil {
+			s.transcript.add(msg)
+		}
+		s.indexToolResults(msg)
+
+		// Update session ID and totals if we get a final result message
+		if result, ok := finalResult(msg); ok {
+			writeSummary(s.options, result)
+
+			s.mu.Lock()
+			if result.SessionID != "" {
+				s.sessionID = result.SessionID
+			}
+			if result.TotalCostUSD != nil {
+				s.totalCostUSD = s.baseCostUSD + *result.TotalCostUSD
+			}
+			s.numTurns += result.NumTurns
+			overBudget := s.budgetErrLocked() != nil && !s.budgetInterrupted
+			if overBudget {
+				s.budgetInterrupted = true
+			}
+			s.mu.Unlock()
+
+			if overBudget {
+				s.logger.Warn("cost budget exceeded, interrupting", "budget", s.options.CostBudgetUSD)
+				if err := s.transport.Interrupt(ctx); err != nil {
+					s.logger.Warn("failed to interrupt", "error", err)
+				}
+			}
+
+			s.sendPending(ctx)
+		}
+
+		select {
+		case s.msgs <- msg:
+		case <-s.done:
+			return
+		}
 	}
+}
+
+// next returns the next message for a receive call. It reports false once
+// the session's output has ended or ctx is done.
+func (s *session) next(ctx context.Context) (Message, bool) {
+	s.mu.Lock()
+	if len(s.unread) > 0 {
+		msg := s.unread[0]
+		s.unread = s.unread[1:]
+		s.mu.Unlock()
+		return msg, true
+	}
+	s.mu.Unlock()
 
-	return s.transport.Send(ctx, []map[string]any{rawMsg})
+	select {
+	case msg, ok := <-s.msgs:
+		return msg, ok
+	case <-ctx.Done():
+		return nil, false
+	}
 }
 
-// Receive returns a channel for receiving messages
+// putBack returns a message taken by next but not delivered, so that the
+// next receive call gets it first
+func (s *session) putBack(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unread = append([]Message{msg}, s.unread...)
+}
+
+// Receive returns a channel for receiving messages. The channel closes when
+// ctx is done or the session's output ends; messages not yet received are
+// left for the next receive call.
 func (s *session) Receive(ctx context.Context) (<-chan Message, error) {
-	rawChan, err := s.transport.Receive(ctx)
-	if err != nil {
+	if err := s.startReceive(); err != nil {
 		return nil, err
 	}
 
 	msgChan := make(chan Message)
-
 	go func() {
 		defer close(msgChan)
-
-		for rawMsg := range rawChan {
-			msg, err := ParseMessage(rawMsg)
-			if err != nil {
-				s.logger.Warn("failed to parse message", "error", err, "data", rawMsg)
-				continue
-			}
-
-			// Update session ID if we get a result message
-			if result, ok := msg.(*ResultMessage); ok && result.SessionID != "" {
-				s.mu.Lock()
-				s.sessionID = result.SessionID
-				s.mu.Unlock()
+		for {
+			msg, ok := s.next(ctx)
+			if !ok {
+				return
 			}
-
 			select {
 			case msgChan <- msg:
 			case <-ctx.Done():
+				s.putBack(msg)
 				return
 			}
 		}
@@ -309,24 +1168,112 @@ func (s *session) Receive(ctx context.Context) (<-chan Message, error) {
 	return msgChan, nil
 }
 
-// ReceiveOne receives messages until a ResultMessage is received
+// ReceiveOne receives messages until the final ResultMessage is received
 func (s *session) ReceiveOne(ctx context.Context) ([]Message, error) {
-	msgChan, err := s.Receive(ctx)
-	if err != nil {
+	if err := s.startReceive(); err != nil {
 		return nil, err
 	}
 
+	// The pump interrupts the CLI when the tool use limit is exceeded or a
+	// tool fails; the turn still ends with a ResultMessage, after which the
+	// error is reported
+	limiter := &toolUseLimiter{max: s.options.MaxToolUsesPerTurn}
+	exceeded := false
+	failures := newToolFailureDetector(s.options)
+	var toolErr *ToolError
+
 	var messages []Message
-	for msg := range msgChan {
+	for {
+		msg, ok := s.next(ctx)
+		if !ok {
+			break
+		}
 		messages = append(messages, msg)
+		if limiter.observe(msg) {
+			exceeded = true
+		}
+		if err := failures.observe(msg); err != nil && toolErr == nil {
+			toolErr = err
+		}
 
-		// Stop after ResultMessage
-		if _, ok := msg.(*ResultMessage); ok {
+		// Stop after the final ResultMessage
+		if _, ok := finalResult(msg); ok {
 			break
 		}
 	}
 
-	return messages, nil
+	if exceeded {
+		return messages, toolLimitError(limiter.max)
+	}
+	if toolErr != nil {
+		return messages, toolErr
+	}
+	return messages, s.budgetErr()
+}
+
+// ReceiveUntil receives messages until a ResultMessage is received or ctx is
+// done. Messages received before the deadline are returned either way;
+// completed reports whether the ResultMessage was seen. The deadline only
+// bounds this call; later calls continue with the messages that follow.
+func (s *session) ReceiveUntil(ctx context.Context) ([]Message, bool, error) {
+	if err := s.startReceive(); err != nil {
+		return nil, false, err
+	}
+
+	var messages []Message
+	for {
+		msg, ok := s.next(ctx)
+		if !ok {
+			return messages, false, nil
+		}
+		messages = append(messages, msg)
+		if _, ok := finalResult(msg); ok {
+			return messages, true, s.budgetErr()
+		}
+	}
+}
+
+// Ready returns a channel that is closed once the CLI has reported its init
+// message. Receive must be running for the init message to be read.
+func (s *session) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Transcript returns the conversation rendered as markdown. It is empty
+// unless the session was created with WithTranscript.
+func (s *session) Transcript() string {
+	if s.transcript == nil {
+		return ""
+	}
+	return s.transcript.String()
+}
+
+// indexToolResults records the tool results carried by msg
+func (s *session) indexToolResults(msg Message) {
+	user, ok := msg.(*UserMessage)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, block := range user.Blocks {
+		if block.Result == nil {
+			continue
+		}
+		if s.toolResults == nil {
+			s.toolResults = make(map[string]*ToolResult)
+		}
+		s.toolResults[block.Result.ToolUseID] = block.Result
+	}
+}
+
+// ToolResultFor returns the result of the tool use with the given ID
+func (s *session) ToolResultFor(toolUseID string) (*ToolResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.toolResults[toolUseID]
+	return result, ok
 }
 
 // Interrupt sends an interrupt signal
@@ -345,16 +1292,17 @@ func (s *session) Close() error {
 
 	s.closed = true
 	close(s.promptChan)
+	close(s.done)
 	return s.transport.Close()
 }
 
-// getSessionID returns the current session ID
-func (s *session) getSessionID() string {
+// SessionID returns the current session ID
+func (s *session) SessionID() string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if s.sessionID == "" {
-		return "default"
+		return s.envelopeID
 	}
 	return s.sessionID
 }
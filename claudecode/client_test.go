@@ -1,10 +1,20 @@
 package claudecode
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -154,3 +164,2082 @@ func TestProperContextHandling(t *testing.T) {
 		}
 	}
 }
+
+// TestMaxStderrLines tests that the configured number of trailing stderr
+// lines is kept in the ProcessError
+func TestMaxStderrLines(t *testing.T) {
+	cliPath := writeFakeCLI(t, `i=1
+while [ $i -le 250 ]; do echo "at frame $i" >&2; i=$((i+1)); done
+exit 1
+`)
+
+	tests := []struct {
+		name  string
+		opts  []Option
+		lines int
+	}{
+		{name: "Default", lines: 100},
+		{name: "Higher", opts: []Option{WithMaxStderrLines(200)}, lines: 200},
+		{name: "AboveOutput", opts: []Option{WithMaxStderrLines(500)}, lines: 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(append([]Option{WithCLIPath(cliPath)}, tt.opts...)...)
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err = c.Query(ctx, "Hello")
+			var procErr *ProcessError
+			if !errors.As(err, &procErr) {
+				t.Fatalf("Expected *ProcessError, got %v", err)
+			}
+
+			got := strings.Split(procErr.Stderr, "\n")
+			truncated := strings.HasPrefix(got[0], "[stderr truncated")
+			if truncated {
+				got = got[1:]
+			}
+			if len(got) != tt.lines {
+				t.Fatalf("Expected %d stderr lines, got %d", tt.lines, len(got))
+			}
+			if got[len(got)-1] != "at frame 250" {
+				t.Errorf("Expected the last line to be kept, got %q", got[len(got)-1])
+			}
+			if truncated != (tt.lines < 250) {
+				t.Errorf("Truncation marker = %v, want %v", truncated, tt.lines < 250)
+			}
+		})
+	}
+}
+
+// TestQueryPartialOnCrash tests that a CLI crashing before its result returns
+// the messages received so far along with ErrProcessExited
+func TestQueryPartialOnCrash(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Step one"}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Step two"}]}}'
+echo 'Segmentation fault' >&2
+exit 139
+`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Hello")
+	if !errors.Is(err, ErrProcessExited) {
+		t.Fatalf("Expected ErrProcessExited, got messages=%v err=%v", messages, err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected the 2 messages received before the crash, got %d", len(messages))
+	}
+	for _, msg := range messages {
+		if _, ok := msg.(*AssistantMessage); !ok {
+			t.Errorf("Expected *AssistantMessage, got %T", msg)
+		}
+	}
+
+	var procErr *ProcessError
+	if !errors.As(err, &procErr) || procErr.ExitCode != 139 {
+		t.Errorf("Expected a ProcessError with exit code 139, got %v", err)
+	}
+}
+
+// TestQueryProcessExitedOnStartup tests that a CLI failing before any output is reported as an error
+func TestQueryProcessExitedOnStartup(t *testing.T) {
+	cliPath := writeFakeCLI(t, "echo 'npm ERR! cannot find module' >&2\nexit 1\n")
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Hello")
+	if !errors.Is(err, ErrProcessExited) {
+		t.Fatalf("Expected ErrProcessExited, got messages=%v err=%v", messages, err)
+	}
+
+	var procErr *ProcessError
+	if !errors.As(err, &procErr) {
+		t.Fatalf("Expected *ProcessError, got %T", err)
+	}
+	if procErr.ExitCode != 1 {
+		t.Errorf("Expected exit code 1, got %d", procErr.ExitCode)
+	}
+	if !strings.Contains(procErr.Stderr, "cannot find module") {
+		t.Errorf("Expected stderr to be captured, got %q", procErr.Stderr)
+	}
+}
+
+// fakeConversationScript returns a fake CLI script that emits n assistant messages followed by a result
+func fakeConversationScript(n int) string {
+	return fmt.Sprintf(`i=0
+while [ $i -lt %d ]; do
+  echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"thinking"}]}}'
+  i=$((i+1))
+done
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1,"result":"done"}'
+`, n)
+}
+
+// TestQueryResultOnly tests that ResultOnly returns just the result message
+func TestQueryResultOnly(t *testing.T) {
+	c, err := New(WithCLIPath(writeFakeCLI(t, fakeConversationScript(20))))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Hello", ResultOnly())
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(messages))
+	}
+	result, ok := messages[0].(*ResultMessage)
+	if !ok {
+		t.Fatalf("Expected *ResultMessage, got %T", messages[0])
+	}
+	if result.Result == nil || *result.Result != "done" {
+		t.Errorf("Expected result %q, got %v", "done", result.Result)
+	}
+}
+
+func BenchmarkQueryResultOnly(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "claude")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+fakeConversationScript(200)), 0o755); err != nil {
+		b.Fatalf("Failed to write fake CLI: %v", err)
+	}
+
+	c, err := New(WithCLIPath(path))
+	if err != nil {
+		b.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	for _, bm := range []struct {
+		name string
+		opts []QueryOption
+	}{
+		{name: "AllMessages"},
+		{name: "ResultOnly", opts: []QueryOption{ResultOnly()}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Query(context.Background(), "Hello", bm.opts...); err != nil {
+					b.Fatalf("Query failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// TestQueryStreamGracefulResultWait tests that the result callback fires when the consumer stops early
+func TestQueryStreamGracefulResultWait(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"partial"}]}}'
+sleep 0.2
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"more"}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1","total_cost_usd":0.25}'
+`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	resultChan := make(chan *ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	msgChan, err := c.QueryStream(ctx, "Hello", WithGracefulResultWait(func(r *ResultMessage) {
+		resultChan <- r
+	}))
+	if err != nil {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+
+	for msg := range msgChan {
+		if _, ok := msg.(*AssistantMessage); ok {
+			break
+		}
+	}
+	cancel()
+
+	select {
+	case result := <-resultChan:
+		if result.TotalCostUSD == nil || *result.TotalCostUSD != 0.25 {
+			t.Errorf("Expected total cost 0.25, got %v", result.TotalCostUSD)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for result callback")
+	}
+}
+
+// TestQueryStreamGracefulResultWaitAbandoned tests that the result callback fires when the consumer stops receiving without cancelling
+func TestQueryStreamGracefulResultWaitAbandoned(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"partial"}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"more"}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1","total_cost_usd":0.25}'
+`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	resultChan := make(chan *ResultMessage, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	msgChan, err := c.QueryStream(ctx, "Hello", WithGracefulResultWait(func(r *ResultMessage) {
+		resultChan <- r
+	}))
+	if err != nil {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+	<-msgChan
+
+	select {
+	case <-resultChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for result callback")
+	}
+}
+
+// TestQueryRequestIDLogging tests that log records for a query carry its request ID
+func TestQueryRequestIDLogging(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"unknown_event"}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	c, err := New(WithCLIPath(cliPath), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Query(ctx, "Hello", WithRequestID("req-123")); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	var records int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to decode log record %q: %v", line, err)
+		}
+		records++
+		if record["request_id"] != "req-123" {
+			t.Errorf("Log record missing request_id: %s", line)
+		}
+	}
+	if records < 2 {
+		t.Errorf("Expected transport and client log records, got %d", records)
+	}
+}
+
+// TestToolCallbacks tests that tool callbacks fire for a scripted tool interaction
+func TestToolCallbacks(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Reading"},{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"main.go"}}]}}'
+echo '{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"package main"}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	var toolUses []*ToolUse
+	var toolResults []*ToolResult
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithOnToolUse(func(tu *ToolUse) { toolUses = append(toolUses, tu) }),
+		WithOnToolResult(func(tr *ToolResult) { toolResults = append(toolResults, tr) }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Query(ctx, "Read main.go"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if len(toolUses) != 1 || toolUses[0].Name != "Read" || toolUses[0].ID != "toolu_1" {
+		t.Errorf("Expected one Read tool use, got %+v", toolUses)
+	}
+	if len(toolResults) != 1 || toolResults[0].ToolUseID != "toolu_1" || toolResults[0].TextContent() != "package main" {
+		t.Errorf("Expected one tool result for toolu_1, got %+v", toolResults)
+	}
+}
+
+// TestSessionAllowedToolsOverride tests that a session can override the client's allowed tools
+func TestSessionAllowedToolsOverride(t *testing.T) {
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, "cat > /dev/null")),
+		WithAllowedTools("Read", "Bash"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx, WithSessionAllowedTools("Read"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	msgChan, err := sess.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	go func() {
+		for range msgChan {
+			// Just consume
+		}
+	}()
+
+	transport := sess.(*session).transport
+	args, err := transport.buildCommand()
+	if err != nil {
+		t.Fatalf("buildCommand failed: %v", err)
+	}
+
+	allowed := ""
+	for i, arg := range args {
+		if arg == "--allowedTools" && i+1 < len(args) {
+			allowed = args[i+1]
+		}
+	}
+	if allowed != "Read" {
+		t.Errorf("Expected session --allowedTools Read, got %q", allowed)
+	}
+
+	if tools := c.(*client).options.AllowedTools; len(tools) != 2 {
+		t.Errorf("Expected client allowed tools to be unchanged, got %v", tools)
+	}
+}
+
+// TestQueryToolUseLimit tests that Query stops once a turn exceeds the tool use limit
+func TestQueryToolUseLimit(t *testing.T) {
+	cliPath := writeFakeCLI(t, `for id in 1 2 3 4; do
+  echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_'$id'","name":"Bash","input":{"command":"ls"}}]}}'
+done
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(WithCLIPath(cliPath), WithMaxToolUsesPerTurn(2))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Run commands")
+	if !errors.Is(err, ErrToolLimitExceeded) {
+		t.Fatalf("Expected ErrToolLimitExceeded, got %v", err)
+	}
+	if len(messages) != 3 {
+		t.Errorf("Expected messages up to the third tool use, got %d", len(messages))
+	}
+
+	messages, err = c.Query(ctx, "Run commands", ResultOnly())
+	if !errors.Is(err, ErrToolLimitExceeded) {
+		t.Fatalf("Expected ErrToolLimitExceeded with ResultOnly, got %v", err)
+	}
+	if len(messages) != 0 {
+		t.Errorf("Expected no messages with ResultOnly, got %d", len(messages))
+	}
+}
+
+// TestQueryStreamToolUseLimit tests that QueryStream stops the CLI and ends
+// with an ErrorMessage once a turn exceeds the tool use limit
+func TestQueryStreamToolUseLimit(t *testing.T) {
+	cliPath := writeFakeCLI(t, `cat > /dev/null
+for id in 1 2 3; do
+  echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_'$id'","name":"Bash","input":{"command":"ls"}}]}}'
+done
+sleep 10
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(WithCLIPath(cliPath), WithMaxToolUsesPerTurn(2), WithCloseTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgChan, err := c.QueryStream(ctx, "Run commands")
+	if err != nil {
+		t.Fatalf("Failed to start query: %v", err)
+	}
+
+	var last Message
+	for msg := range msgChan {
+		last = msg
+	}
+	if ctx.Err() != nil {
+		t.Fatalf("Expected the stream to stop before the CLI finished, got %v", ctx.Err())
+	}
+	errMsg, ok := last.(*ErrorMessage)
+	if !ok || errMsg.ErrorType != "tool_limit_exceeded" {
+		t.Fatalf("Expected a tool_limit_exceeded ErrorMessage, got %+v", last)
+	}
+	if !strings.Contains(errMsg.Message, ErrToolLimitExceeded.Error()) {
+		t.Errorf("Expected the limit error in the message, got %q", errMsg.Message)
+	}
+}
+
+// TestAbortOnToolError tests that a failed tool result aborts the run with
+// the tool's name and error
+func TestAbortOnToolError(t *testing.T) {
+	toolUse := `{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"Bash","input":{"command":"make"}}]}}`
+	toolResult := `{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"make: *** No rule to make target","is_error":true}]}}`
+	checkErr := func(t *testing.T, err error) {
+		t.Helper()
+		var toolErr *ToolError
+		if !errors.Is(err, ErrToolFailed) || !errors.As(err, &toolErr) {
+			t.Fatalf("Expected a *ToolError matching ErrToolFailed, got %v", err)
+		}
+		if toolErr.ToolName != "Bash" || toolErr.ToolUseID != "toolu_1" || toolErr.Message != "make: *** No rule to make target" {
+			t.Errorf("Unexpected tool error: %+v", toolErr)
+		}
+	}
+
+	t.Run("Query", func(t *testing.T) {
+		cliPath := writeFakeCLI(t, `echo '`+toolUse+`'
+echo '`+toolResult+`'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Let me try something else"}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+		c, err := New(WithCLIPath(cliPath), WithAbortOnToolError(true))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		messages, err := c.Query(ctx, "Build it")
+		checkErr(t, err)
+		if len(messages) != 2 {
+			t.Errorf("Expected messages up to the failed tool result, got %d", len(messages))
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		cliPath := writeFakeCLI(t, `cat > /dev/null
+echo '`+toolUse+`'
+echo '`+toolResult+`'
+sleep 10
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+		c, err := New(WithCLIPath(cliPath), WithAbortOnToolError(true), WithCloseTimeout(100*time.Millisecond))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var messages []Message
+		var streamErr error
+		for msg, err := range c.Stream(ctx, "Build it") {
+			if err != nil {
+				streamErr = err
+				break
+			}
+			messages = append(messages, msg)
+		}
+		checkErr(t, streamErr)
+		if len(messages) != 3 {
+			t.Fatalf("Expected the messages up to the failed tool result and an ErrorMessage, got %d", len(messages))
+		}
+		if errMsg, ok := messages[2].(*ErrorMessage); !ok || errMsg.ErrorType != "tool_failed" {
+			t.Errorf("Expected a tool_failed ErrorMessage, got %+v", messages[2])
+		}
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		outPath := filepath.Join(t.TempDir(), "stdin.jsonl")
+		cliPath := writeFakeCLI(t, `read -r line
+echo '`+toolUse+`'
+echo '`+toolResult+`'
+read -r line; echo "$line" >> "$STDIN_CAPTURE"
+echo '{"type":"result","subtype":"error_during_execution","session_id":"s1"}'
+cat > /dev/null
+`)
+
+		c, err := New(WithCLIPath(cliPath), WithEnv("STDIN_CAPTURE", outPath), WithAbortOnToolError(true))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer c.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		sess, err := c.NewSession(ctx)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		defer sess.Close()
+
+		if err := sess.Send(ctx, "Build it"); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		messages, err := sess.ReceiveOne(ctx)
+		checkErr(t, err)
+		if len(messages) != 3 {
+			t.Errorf("Expected the messages of the interrupted turn, got %d", len(messages))
+		}
+
+		data, err := os.ReadFile(outPath)
+		if err != nil {
+			t.Fatalf("Failed to read captured stdin: %v", err)
+		}
+		if !strings.Contains(string(data), `"subtype":"interrupt"`) {
+			t.Errorf("Expected an interrupt after the failed tool, got:\n%s", data)
+		}
+	})
+
+	c, err := New(WithCLIPath(writeFakeCLI(t, `echo '`+toolUse+`'
+echo '`+toolResult+`'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Query(context.Background(), "Build it"); err != nil {
+		t.Errorf("Expected tool errors to be ignored by default, got %v", err)
+	}
+}
+
+// TestCommandObserver tests that the observer receives the argv and
+// environment of each query, including per-query model overrides
+func TestCommandObserver(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"result","subtype":"success","session_id":"s1"}'`)
+
+	var argvs, envs [][]string
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithModel("claude-sonnet-4"),
+		WithModelRouter(func(hint string) string {
+			if hint == "summarize" {
+				return "claude-haiku-4"
+			}
+			return ""
+		}),
+		WithEnv("PROJECT_ID", "p-42"),
+		WithCommandObserver(func(argv []string, env []string) {
+			argvs = append(argvs, argv)
+			envs = append(envs, env)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Query(ctx, "Hello"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if _, err := c.Query(ctx, "Summarize this", WithTaskHint("summarize")); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if len(argvs) != 2 {
+		t.Fatalf("Expected the observer to be called twice, got %d", len(argvs))
+	}
+	modelOf := func(argv []string) string {
+		for i, arg := range argv {
+			if arg == "--model" && i+1 < len(argv) {
+				return argv[i+1]
+			}
+		}
+		return ""
+	}
+	if argvs[0][0] != cliPath {
+		t.Errorf("Expected argv to start with the CLI path, got %v", argvs[0])
+	}
+	if got := modelOf(argvs[0]); got != "claude-sonnet-4" {
+		t.Errorf("First query model = %q, want %q", got, "claude-sonnet-4")
+	}
+	if got := modelOf(argvs[1]); got != "claude-haiku-4" {
+		t.Errorf("Routed query model = %q, want %q", got, "claude-haiku-4")
+	}
+	if !slices.Contains(envs[0], "PROJECT_ID=p-42") {
+		t.Errorf("Expected the added environment variable, got %v", envs[0])
+	}
+}
+
+// TestSessionMessageEncoder tests that a custom encoder controls what is written to stdin
+func TestSessionMessageEncoder(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "stdin.jsonl")
+
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `cat > "$STDIN_CAPTURE"`)),
+		WithEnv("STDIN_CAPTURE", outPath),
+		WithMessageEncoder(func(msg Message, meta MessageMeta) (map[string]any, error) {
+			return map[string]any{
+				"type":    "user",
+				"version": 2,
+				"text":    msg.(*UserMessage).Content,
+				"session": meta.SessionID,
+			}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	msgChan, err := sess.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	if err := sess.Send(ctx, "Hello"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if err := sess.Close(); err != nil {
+		t.Fatalf("Failed to close session: %v", err)
+	}
+	for range msgChan {
+		// Just consume
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+	want := `{"session":"default","text":"Hello","type":"user","version":2}` + "\n"
+	if string(data) != want {
+		t.Errorf("Expected stdin %q, got %q", want, data)
+	}
+}
+
+// TestSessionReceiveUntilDeadline tests that ReceiveUntil returns the partial turn when the deadline hits first
+func TestSessionReceiveUntilDeadline(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"first"}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"second"}]}}'
+read -r line
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	deadlineCtx, deadlineCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer deadlineCancel()
+
+	messages, completed, err := sess.ReceiveUntil(deadlineCtx)
+	if err != nil {
+		t.Fatalf("ReceiveUntil failed: %v", err)
+	}
+	if completed {
+		t.Error("Expected ReceiveUntil to report a partial turn")
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 partial messages, got %d", len(messages))
+	}
+	if _, ok := messages[1].(*AssistantMessage); !ok {
+		t.Errorf("Expected assistant message, got %T", messages[1])
+	}
+
+	// A later call picks up where the deadline left off
+	if err := sess.Send(ctx, "Go on"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	messages, completed, err = sess.ReceiveUntil(ctx)
+	if err != nil {
+		t.Fatalf("Second ReceiveUntil failed: %v", err)
+	}
+	if !completed || len(messages) != 1 {
+		t.Errorf("Expected the rest of the turn to complete, got %d messages, completed=%v", len(messages), completed)
+	}
+}
+
+// TestSessionReceiveOneTurns tests that ReceiveOne can be called once per turn
+func TestSessionReceiveOneTurns(t *testing.T) {
+	cliPath := writeFakeCLI(t, `while read -r line; do
+  echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"ok"}]}}'
+  echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1}'
+done`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	for turn := 1; turn <= 3; turn++ {
+		if err := sess.Send(ctx, "Hello"); err != nil {
+			t.Fatalf("Turn %d: failed to send message: %v", turn, err)
+		}
+		messages, err := sess.ReceiveOne(ctx)
+		if err != nil {
+			t.Fatalf("Turn %d: ReceiveOne failed: %v", turn, err)
+		}
+		if len(messages) != 2 {
+			t.Fatalf("Turn %d: expected 2 messages, got %d", turn, len(messages))
+		}
+	}
+	if got := sess.State().NumTurns; got != 3 {
+		t.Errorf("Expected 3 turns, got %d", got)
+	}
+}
+
+// TestQueryAllowedToolsFunc tests that the allowed tools are computed from each query's prompt
+func TestQueryAllowedToolsFunc(t *testing.T) {
+	argsPath := filepath.Join(t.TempDir(), "args.txt")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithAllowedTools("Read"),
+		WithAllowedToolsFunc(func(prompt string) []string {
+			if strings.Contains(prompt, "ops") {
+				return []string{"Read", "Bash"}
+			}
+			return []string{"Read"}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	allowedTools := func(prompt string) string {
+		t.Helper()
+		if _, err := c.Query(ctx, prompt); err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		data, err := os.ReadFile(argsPath)
+		if err != nil {
+			t.Fatalf("Failed to read captured args: %v", err)
+		}
+		args := strings.Split(string(data), "\n")
+		for i, arg := range args {
+			if arg == "--allowedTools" && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		return ""
+	}
+
+	if got := allowedTools("Run the ops runbook"); got != "Read,Bash" {
+		t.Errorf("Expected --allowedTools Read,Bash for ops prompt, got %q", got)
+	}
+	if got := allowedTools("Summarize README.md"); got != "Read" {
+		t.Errorf("Expected --allowedTools Read for other prompt, got %q", got)
+	}
+	if tools := c.(*client).options.AllowedTools; len(tools) != 1 || tools[0] != "Read" {
+		t.Errorf("Expected client allowed tools to be unchanged, got %v", tools)
+	}
+}
+
+// TestQueryModelRouter tests that the model router's choice for a query's task hint is passed to the CLI
+func TestQueryModelRouter(t *testing.T) {
+	argsPath := filepath.Join(t.TempDir(), "args.txt")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithModel("sonnet"),
+		WithModelRouter(func(taskHint string) string {
+			switch taskHint {
+			case "code":
+				return "opus"
+			case "summarize":
+				return "haiku"
+			}
+			return ""
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	model := func(opts ...QueryOption) string {
+		t.Helper()
+		if _, err := c.Query(ctx, "Hello", opts...); err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		data, err := os.ReadFile(argsPath)
+		if err != nil {
+			t.Fatalf("Failed to read captured args: %v", err)
+		}
+		args := strings.Split(string(data), "\n")
+		for i, arg := range args {
+			if arg == "--model" && i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		return ""
+	}
+
+	tests := []struct {
+		hint string
+		want string
+	}{
+		{"code", "opus"},
+		{"summarize", "haiku"},
+		{"chat", "sonnet"},
+		{"", "sonnet"},
+	}
+	for _, tt := range tests {
+		if got := model(WithTaskHint(tt.hint)); got != tt.want {
+			t.Errorf("Expected --model %s for task hint %q, got %q", tt.want, tt.hint, got)
+		}
+	}
+	if got := c.(*client).options.Model; got != "sonnet" {
+		t.Errorf("Expected client model to be unchanged, got %q", got)
+	}
+}
+
+// TestSessionInitialPromptBeforeInit tests that the initial prompt is written before NewSession waits for the init message of required MCP servers
+func TestSessionInitialPromptBeforeInit(t *testing.T) {
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `read -r line
+echo '{"type":"system","subtype":"init","session_id":"s1","mcp_servers":[{"name":"filesystem","status":"connected"}]}'
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1}'
+cat > /dev/null`)),
+		WithRequiredMCPServers("filesystem"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx, WithInitialPrompt("Hello"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	msgs, err := sess.ReceiveOne(ctx)
+	if err != nil {
+		t.Fatalf("Failed to receive: %v", err)
+	}
+	if _, ok := msgs[len(msgs)-1].(*ResultMessage); !ok {
+		t.Errorf("Expected the turn to end with a result, got %T", msgs[len(msgs)-1])
+	}
+}
+
+// TestSessionMissingMCPServerLeak tests that a session whose required MCP
+// server is missing stops the goroutines started for it
+func TestSessionMissingMCPServerLeak(t *testing.T) {
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `read -r line
+echo '{"type":"system","subtype":"init","session_id":"s1","mcp_servers":[]}'
+cat > /dev/null`)),
+		WithRequiredMCPServers("filesystem"),
+		WithInterruptOnContextCancel(true),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	runtime.GC()
+	initialGoroutines := runtime.NumGoroutine()
+
+	if _, err := c.NewSession(ctx, WithInitialPrompt("Hello")); err == nil {
+		t.Fatal("Expected NewSession to fail without the required MCP server")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > initialGoroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > initialGoroutines {
+		t.Errorf("Goroutine leak: started with %d, ended with %d", initialGoroutines, n)
+	}
+}
+
+// TestSessionResumeWithContinueOrNew tests that a resumed session does not
+// also continue the working directory's latest conversation
+func TestSessionResumeWithContinueOrNew(t *testing.T) {
+	configDir := t.TempDir()
+	workDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to resolve working directory: %v", err)
+	}
+	projectDir := filepath.Join(configDir, "projects", projectDirPattern.ReplaceAllString(workDir, "-"))
+	if err := os.MkdirAll(projectDir, 0o755); err != nil {
+		t.Fatalf("Failed to create project directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(projectDir, "0b5c.jsonl"), []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write conversation: %v", err)
+	}
+
+	var args []string
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, "cat > /dev/null")),
+		WithWorkingDirectory(workDir),
+		WithEnv("CLAUDE_CONFIG_DIR", configDir),
+		WithContinueOrNew(true),
+		WithCommandObserver(func(argv, env []string) { args = argv }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx, WithResumeContext("sess-42"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	if slices.Contains(args, "--continue") {
+		t.Errorf("Expected no --continue when resuming, got %v", args)
+	}
+	if i := slices.Index(args, "--resume"); i < 0 || i+1 >= len(args) || args[i+1] != "sess-42" {
+		t.Errorf("Expected --resume sess-42, got %v", args)
+	}
+}
+
+// TestSessionResumeContext tests that context messages are written before the first user prompt on a resumed session
+func TestSessionResumeContext(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args.txt")
+	stdinPath := filepath.Join(dir, "stdin.jsonl")
+
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+while read -r line; do
+  printf '%s\n' "$line" >> "$STDIN_CAPTURE"
+  echo '{"type":"result","subtype":"success","session_id":"sess-42","num_turns":1}'
+done`)),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithEnv("STDIN_CAPTURE", stdinPath),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx,
+		WithResumeContext("sess-42", "main.go now returns an error", "tests were updated"),
+		WithInitialPrompt("Fix the caller"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	msgChan, err := sess.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	if err := sess.Send(ctx, "Then run the tests"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if got := sess.SessionID(); got != "sess-42" {
+		t.Errorf("Expected session ID sess-42, got %q", got)
+	}
+
+	// Each context message and prompt is its own turn
+	for results := 0; results < 4; {
+		msg, ok := <-msgChan
+		if !ok {
+			t.Fatalf("Stream closed after %d results", results)
+		}
+		if _, isResult := msg.(*ResultMessage); isResult {
+			results++
+		}
+	}
+	if err := sess.Close(); err != nil {
+		t.Fatalf("Failed to close session: %v", err)
+	}
+	for range msgChan {
+		// Just consume
+	}
+
+	args, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	if !strings.Contains(string(args), "--resume\nsess-42\n") {
+		t.Errorf("Expected --resume sess-42 in args, got:\n%s", args)
+	}
+
+	data, err := os.ReadFile(stdinPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+
+	var contents []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var msg struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("Failed to decode stdin line %q: %v", line, err)
+		}
+		contents = append(contents, msg.Message.Content)
+	}
+
+	want := []string{"main.go now returns an error", "tests were updated", "Fix the caller", "Then run the tests"}
+	if strings.Join(contents, "|") != strings.Join(want, "|") {
+		t.Errorf("Unexpected stdin order\ngot:  %q\nwant: %q", contents, want)
+	}
+}
+
+// TestQueryPersistentProcess tests that Query calls reuse one CLI process and
+// that the conversation is cleared between them
+func TestQueryPersistentProcess(t *testing.T) {
+	startsPath := filepath.Join(t.TempDir(), "starts.txt")
+	cliPath := writeFakeCLI(t, `echo start >> "$STARTS_CAPTURE"
+turns=0
+while read -r line; do
+  case "$line" in
+    */clear*)
+      turns=0
+      echo '{"type":"system","subtype":"init","session_id":"s2"}'
+      echo '{"type":"result","subtype":"success","session_id":"s2"}'
+      ;;
+    *)
+      turns=$((turns + 1))
+      echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"working"}]}}'
+      echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":'$turns'}'
+      ;;
+  esac
+done`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("STARTS_CAPTURE", startsPath),
+		WithPersistentProcess(true),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, prompt := range []string{"first", "second"} {
+		messages, err := c.Query(ctx, prompt)
+		if err != nil {
+			t.Fatalf("Query %q failed: %v", prompt, err)
+		}
+		if len(messages) != 2 {
+			t.Fatalf("Expected 2 messages for %q, got %d", prompt, len(messages))
+		}
+		result, ok := messages[1].(*ResultMessage)
+		if !ok {
+			t.Fatalf("Expected result message, got %T", messages[1])
+		}
+		if result.NumTurns != 1 {
+			t.Errorf("Query %q saw %d turns, want 1", prompt, result.NumTurns)
+		}
+	}
+
+	data, err := os.ReadFile(startsPath)
+	if err != nil {
+		t.Fatalf("Failed to read starts: %v", err)
+	}
+	if starts := strings.Count(string(data), "start"); starts != 1 {
+		t.Errorf("Expected 1 process start, got %d", starts)
+	}
+}
+
+// TestQueryPersistentProcessScoped tests that the persistent process waits
+// for required MCP servers without hanging, honors WithSessionID, and can be
+// closed while a query is in progress
+func TestQueryPersistentProcessScoped(t *testing.T) {
+	cliPath := writeFakeCLI(t, `read -r line
+echo '{"type":"system","subtype":"init","session_id":"s1","mcp_servers":[{"name":"filesystem","status":"connected"}]}'
+while :; do
+  sid=$(echo "$line" | sed -n 's/.*"session_id":"\([^"]*\)".*/\1/p')
+  case "$line" in
+    *hang*) ;;
+    *) echo '{"type":"result","subtype":"success","session_id":"'$sid'"}' ;;
+  esac
+  read -r line || exit 0
+done`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithPersistentProcess(true),
+		WithRequiredMCPServers("filesystem"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "first", WithSessionID("explicit"))
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	result, ok := messages[len(messages)-1].(*ResultMessage)
+	if !ok || result.SessionID != "explicit" {
+		t.Errorf("Expected a result for session explicit, got %+v", messages[len(messages)-1])
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Query(ctx, "hang")
+		errs <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("Expected the query in progress to fail once the client closed")
+		}
+	case <-ctx.Done():
+		t.Fatal("Timeout waiting for the query in progress to stop")
+	}
+}
+
+// TestQueryWorkingDir tests that a per-query working directory is used for that query's process
+func TestQueryWorkingDir(t *testing.T) {
+	cwdPath := filepath.Join(t.TempDir(), "cwd.txt")
+	queryDir := t.TempDir()
+
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `pwd -P > "$CWD_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'`)),
+		WithEnv("CWD_CAPTURE", cwdPath),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Query(ctx, "Hello", WithQueryWorkingDir(queryDir)); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	data, err := os.ReadFile(cwdPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured cwd: %v", err)
+	}
+	want, err := filepath.EvalSymlinks(queryDir)
+	if err != nil {
+		t.Fatalf("Failed to resolve query dir: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != want {
+		t.Errorf("Expected cwd %q, got %q", want, got)
+	}
+	if dir := c.(*client).options.WorkingDirectory; dir != "" {
+		t.Errorf("Expected client working directory to be unchanged, got %q", dir)
+	}
+
+	_, err = c.Query(ctx, "Hello", WithQueryWorkingDir(filepath.Join(queryDir, "missing")))
+	var claudeErr *ClaudeError
+	if !errors.As(err, &claudeErr) || claudeErr.Code != "INVALID_OPTIONS" {
+		t.Errorf("Expected INVALID_OPTIONS error for missing directory, got %v", err)
+	}
+}
+
+// TestSessionReady tests that Ready closes once the init message arrives so a send follows it
+func TestSessionReady(t *testing.T) {
+	cliPath := writeFakeCLI(t, `sleep 0.2
+echo '{"type":"system","subtype":"init","session_id":"s1","mcp_servers":[{"name":"db","status":"connected"}]}'
+while read -r line; do
+  echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"hello"}]}}'
+  echo '{"type":"result","subtype":"success","session_id":"s1"}'
+done`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	msgChan, err := sess.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	var types []MessageType
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for msg := range msgChan {
+			types = append(types, msg.Type())
+			if msg.Type() == MessageTypeResult {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-sess.Ready():
+	case <-ctx.Done():
+		t.Fatal("Timeout waiting for session to be ready")
+	}
+
+	if err := sess.Send(ctx, "Hi"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("Timeout waiting for result")
+	}
+
+	want := []MessageType{MessageTypeSystem, MessageTypeAssistant, MessageTypeResult}
+	if len(types) != len(want) {
+		t.Fatalf("Expected messages %v, got %v", want, types)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("Expected messages %v, got %v", want, types)
+			break
+		}
+	}
+}
+
+// TestQueryCostBudget tests that Query returns ErrBudgetExceeded when its result crosses the budget
+func TestQueryCostBudget(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"done"}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1","total_cost_usd":0.75}'`)
+
+	c, err := New(WithCLIPath(cliPath), WithCostBudget(0.5))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Hello")
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("Expected ErrBudgetExceeded, got %v", err)
+	}
+	if len(messages) != 2 {
+		t.Errorf("Expected messages up to the result, got %d", len(messages))
+	}
+}
+
+// TestQueryStreamCostBudget tests that QueryStream reports a budget error
+// after a result that crosses the budget, and that Stream returns it
+func TestQueryStreamCostBudget(t *testing.T) {
+	cliPath := writeFakeCLI(t, `cat > /dev/null
+echo '{"type":"result","subtype":"success","session_id":"s1","total_cost_usd":0.75}'`)
+
+	c, err := New(WithCLIPath(cliPath), WithCostBudget(0.5))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgChan, err := c.QueryStream(ctx, "Hello")
+	if err != nil {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+	var messages []Message
+	for msg := range msgChan {
+		messages = append(messages, msg)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("Expected the result and an error, got %d messages", len(messages))
+	}
+	if errMsg, ok := messages[1].(*ErrorMessage); !ok || errMsg.ErrorType != "budget_exceeded" {
+		t.Errorf("Expected a budget_exceeded error, got %+v", messages[1])
+	}
+
+	var streamErr error
+	for _, err := range c.Stream(ctx, "Hello") {
+		if err != nil {
+			streamErr = err
+		}
+	}
+	if !errors.Is(streamErr, ErrBudgetExceeded) {
+		t.Errorf("Expected ErrBudgetExceeded from Stream, got %v", streamErr)
+	}
+}
+
+// TestSessionCostBudget tests that a session interrupts and refuses sends once cumulative cost crosses the budget
+func TestSessionCostBudget(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "stdin.jsonl")
+	// The CLI reports the process's running total with each result
+	cliPath := writeFakeCLI(t, `n=0
+while read -r line; do
+  echo "$line" >> "$STDIN_CAPTURE"
+  case "$line" in
+    *'"type":"user"'*)
+      n=$((n + 3))
+      echo '{"type":"result","subtype":"success","session_id":"s1","total_cost_usd":0.'$n'}' ;;
+  esac
+done`)
+
+	c, err := New(WithCLIPath(cliPath), WithEnv("STDIN_CAPTURE", outPath), WithCostBudget(0.5))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	msgChan, err := sess.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	for _, prompt := range []string{"one", "two"} {
+		if err := sess.Send(ctx, prompt); err != nil {
+			t.Fatalf("Failed to send %q: %v", prompt, err)
+		}
+		select {
+		case <-msgChan:
+		case <-ctx.Done():
+			t.Fatalf("Timeout waiting for result of %q", prompt)
+		}
+	}
+
+	if err := sess.Send(ctx, "three"); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Expected ErrBudgetExceeded from Send, got %v", err)
+	}
+	if got := sess.State().TotalCostUSD; got != 0.6 {
+		t.Errorf("Total cost = %v, want 0.6", got)
+	}
+
+	if err := sess.Close(); err != nil {
+		t.Fatalf("Failed to close session: %v", err)
+	}
+	for range msgChan {
+		// Just consume
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+	if !strings.Contains(string(data), `"subtype":"interrupt"`) {
+		t.Errorf("Expected interrupt after crossing the budget, got:\n%s", data)
+	}
+	if strings.Contains(string(data), "three") {
+		t.Errorf("Expected no prompt to be sent after crossing the budget, got:\n%s", data)
+	}
+}
+
+// TestQuerySubAgentResult tests that Query continues past sub-agent results to the final result
+func TestQuerySubAgentResult(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_task","name":"Task","input":{"prompt":"research"}}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1","parent_tool_use_id":"toolu_task","result":"sub-agent findings"}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Based on the research..."}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1","parent_tool_use_id":null,"result":"final answer"}'`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Research and answer")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(messages) != 4 {
+		t.Fatalf("Expected all 4 messages, got %d", len(messages))
+	}
+
+	intermediate, ok := messages[1].(*ResultMessage)
+	if !ok || intermediate.IsFinal() {
+		t.Errorf("Expected intermediate sub-agent result, got %#v", messages[1])
+	}
+	final, ok := messages[3].(*ResultMessage)
+	if !ok || !final.IsFinal() || final.Result == nil || *final.Result != "final answer" {
+		t.Errorf("Expected final result last, got %#v", messages[3])
+	}
+}
+
+// TestSessionIDGeneratorSessionState tests that a generated session ID is
+// not saved as the session's resumable state
+func TestSessionIDGeneratorSessionState(t *testing.T) {
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `while read -r line; do
+  echo '{"type":"result","subtype":"success","session_id":"cli-1","num_turns":1}'
+done`)),
+		WithSessionIDGenerator(func() string { return "gen-1" }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := sess.SaveState(path); err == nil {
+		t.Error("Expected SaveState to fail before the CLI reports a session ID")
+	}
+
+	if err := sess.Send(ctx, "Hello"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := sess.ReceiveOne(ctx); err != nil {
+		t.Fatalf("ReceiveOne failed: %v", err)
+	}
+	if err := sess.SaveState(path); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	state, err := LoadSessionState(path)
+	if err != nil {
+		t.Fatalf("Failed to load state: %v", err)
+	}
+	if state.SessionID != "cli-1" {
+		t.Errorf("Saved session ID = %q, want %q", state.SessionID, "cli-1")
+	}
+}
+
+// TestQuerySessionIDFlag tests that one-shot queries pass generated UUID
+// session IDs to the CLI, and omit explicit and non-UUID ones
+func TestQuerySessionIDFlag(t *testing.T) {
+	const id = "0b7e3c52-5f7a-4d0e-9a57-2f3c8e1d4b6a"
+
+	tests := []struct {
+		name     string
+		generate func() string
+		opts     []QueryOption
+		want     bool
+	}{
+		{name: "generated UUID", generate: func() string { return id }, want: true},
+		{name: "generated non-UUID", generate: func() string { return "gen-1" }},
+		{name: "explicit ID", opts: []QueryOption{WithSessionID("job-7")}},
+		{name: "explicit UUID", opts: []QueryOption{WithSessionID(id)}},
+		{name: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			argsPath := filepath.Join(t.TempDir(), "args.txt")
+			opts := []Option{
+				WithCLIPath(writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'`)),
+				WithEnv("ARGS_CAPTURE", argsPath),
+			}
+			if tt.generate != nil {
+				opts = append(opts, WithSessionIDGenerator(tt.generate))
+			}
+			c, err := New(opts...)
+			if err != nil {
+				t.Fatalf("Failed to create client: %v", err)
+			}
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if _, err := c.Query(ctx, "Hello", tt.opts...); err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			args, err := os.ReadFile(argsPath)
+			if err != nil {
+				t.Fatalf("Failed to read captured args: %v", err)
+			}
+			if tt.want && !strings.Contains(string(args), "--session-id\n"+id+"\n") {
+				t.Errorf("Expected --session-id %s in args, got:\n%s", id, args)
+			}
+			if !tt.want && strings.Contains(string(args), "--session-id") {
+				t.Errorf("Expected no --session-id, got:\n%s", args)
+			}
+		})
+	}
+}
+
+// TestSessionIDGenerator tests that concurrent queries are assigned distinct
+// session IDs and that an explicit session ID takes precedence
+func TestSessionIDGenerator(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []string
+		next atomic.Int64
+	)
+
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `cat > /dev/null
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1}'`)),
+		WithSessionIDGenerator(func() string {
+			return fmt.Sprintf("gen-%d", next.Add(1))
+		}),
+		WithMessageEncoder(func(msg Message, meta MessageMeta) (map[string]any, error) {
+			mu.Lock()
+			seen = append(seen, meta.SessionID)
+			mu.Unlock()
+			return EncodeMessage(msg, meta)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const queries = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, queries)
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msgChan, err := c.QueryStream(ctx, "Hello")
+			if err != nil {
+				errs <- err
+				return
+			}
+			for range msgChan {
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+
+	msgChan, err := c.QueryStream(ctx, "Hello", WithSessionID("explicit"))
+	if err != nil {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+	for range msgChan {
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != queries+1 {
+		t.Fatalf("Expected %d encoded messages, got %d", queries+1, len(seen))
+	}
+	distinct := make(map[string]bool)
+	for _, id := range seen[:queries] {
+		if !strings.HasPrefix(id, "gen-") {
+			t.Errorf("Session ID = %q, want generated ID", id)
+		}
+		distinct[id] = true
+	}
+	if len(distinct) != queries {
+		t.Errorf("Expected %d distinct session IDs, got %v", queries, seen[:queries])
+	}
+	if seen[queries] != "explicit" {
+		t.Errorf("Session ID = %q, want %q", seen[queries], "explicit")
+	}
+}
+
+// TestSessionCancelPending tests that prompts queued behind a turn in flight
+// can be cancelled before they reach stdin
+func TestSessionCancelPending(t *testing.T) {
+	dir := t.TempDir()
+	stdinPath := filepath.Join(dir, "stdin.jsonl")
+	gatePath := filepath.Join(dir, "gate")
+
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, `while read -r line; do
+  printf '%s\n' "$line" >> "$STDIN_CAPTURE"
+  while [ ! -f "$GATE" ]; do sleep 0.01; done
+  echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1}'
+done`)),
+		WithEnv("STDIN_CAPTURE", stdinPath),
+		WithEnv("GATE", gatePath),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	msgChan, err := sess.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	for _, prompt := range []string{"first", "second", "third"} {
+		if err := sess.Send(ctx, prompt); err != nil {
+			t.Fatalf("Failed to send %q: %v", prompt, err)
+		}
+	}
+	if n := sess.CancelPending(); n != 2 {
+		t.Errorf("CancelPending() = %d, want 2", n)
+	}
+	if err := sess.Send(ctx, "fourth"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	if err := os.WriteFile(gatePath, nil, 0o644); err != nil {
+		t.Fatalf("Failed to open gate: %v", err)
+	}
+	for results := 0; results < 2; {
+		msg, ok := <-msgChan
+		if !ok {
+			t.Fatalf("Stream closed after %d results", results)
+		}
+		if _, isResult := msg.(*ResultMessage); isResult {
+			results++
+		}
+	}
+
+	data, err := os.ReadFile(stdinPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+	var contents []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var msg struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("Failed to decode stdin line %q: %v", line, err)
+		}
+		contents = append(contents, msg.Message.Content)
+	}
+
+	want := []string{"first", "fourth"}
+	if strings.Join(contents, "|") != strings.Join(want, "|") {
+		t.Errorf("Unexpected stdin\ngot:  %q\nwant: %q", contents, want)
+	}
+}
+
+// TestTurnCallback tests that the turn callback fires once per new turn number and starts over for each query
+func TestTurnCallback(t *testing.T) {
+	cliPath := writeFakeCLI(t, `
+echo '{"type":"system","subtype":"init","session_id":"s1"}'
+echo '{"type":"system","subtype":"turn","session_id":"s1","num_turns":1}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"step"}]}}'
+echo '{"type":"system","subtype":"turn","session_id":"s1","data":{"num_turns":2}}'
+echo '{"type":"system","subtype":"turn","session_id":"s1","num_turns":2}'
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":3,"parent_tool_use_id":"toolu_1"}'
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":4}'
+`)
+
+	var turns []int
+	c, err := New(WithCLIPath(cliPath), WithTurnCallback(func(turn int) {
+		turns = append(turns, turn)
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Query(ctx, "Hello"); err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+	}
+
+	want := []int{1, 2, 3, 4, 1, 2, 3, 4}
+	if fmt.Sprint(turns) != fmt.Sprint(want) {
+		t.Errorf("Turn callbacks = %v, want %v", turns, want)
+	}
+}
+
+// TestQueryRetryPolicy tests that a retry policy retries a failing query
+// until it gives up
+func TestQueryRetryPolicy(t *testing.T) {
+	countPath := filepath.Join(t.TempDir(), "count.txt")
+	cliPath := writeFakeCLI(t, `echo x >> "$COUNT_CAPTURE"
+echo 'API Error: 529 overloaded' >&2
+exit 1
+`)
+
+	var attempts []int
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("COUNT_CAPTURE", countPath),
+		WithRetryPolicy(func(err error, attempt int) (bool, time.Duration) {
+			attempts = append(attempts, attempt)
+			var procErr *ProcessError
+			retry := errors.As(err, &procErr) && strings.Contains(procErr.Stderr, "overloaded") && attempt <= 2
+			return retry, 10 * time.Millisecond
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = c.Query(ctx, "Hello")
+	if !errors.Is(err, ErrProcessExited) {
+		t.Fatalf("Expected ErrProcessExited after giving up, got %v", err)
+	}
+
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("Expected policy calls for attempts %v, got %v", want, attempts)
+	}
+
+	data, err := os.ReadFile(countPath)
+	if err != nil {
+		t.Fatalf("Failed to read attempt count: %v", err)
+	}
+	if runs := strings.Count(string(data), "x"); runs != 3 {
+		t.Errorf("Expected the CLI to run 3 times, got %d", runs)
+	}
+}
+
+// TestSessionToolResultFor tests that tool results are indexed by the ID of
+// the tool use they answer
+func TestSessionToolResultFor(t *testing.T) {
+	cliPath := writeFakeCLI(t, `read line
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"go.mod"}},{"type":"tool_use","id":"toolu_2","name":"Bash","input":{"command":"ls"}}]}}'
+echo '{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_2","content":"main.go"},{"type":"tool_result","tool_use_id":"toolu_1","content":"module example","is_error":false}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+cat > /dev/null
+`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	if _, ok := sess.ToolResultFor("toolu_1"); ok {
+		t.Fatal("Expected no result before the tool ran")
+	}
+
+	if err := sess.Send(ctx, "Look around"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := sess.ReceiveOne(ctx); err != nil {
+		t.Fatalf("ReceiveOne failed: %v", err)
+	}
+
+	for id, want := range map[string]string{"toolu_1": "module example", "toolu_2": "main.go"} {
+		result, ok := sess.ToolResultFor(id)
+		if !ok {
+			t.Errorf("Expected a result for %s", id)
+			continue
+		}
+		if got := result.TextContent(); got != want {
+			t.Errorf("ToolResultFor(%s) = %q, want %q", id, got, want)
+		}
+	}
+	if _, ok := sess.ToolResultFor("toolu_3"); ok {
+		t.Error("Expected no result for an unknown tool use")
+	}
+}
+
+// TestStrictParsing tests that an unknown message type ends the query in
+// strict mode and is skipped otherwise
+func TestStrictParsing(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"hi"}]}}'
+echo '{"type":"telemetry_v2","payload":{}}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("Off", func(t *testing.T) {
+		c, err := New(WithCLIPath(cliPath))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer c.Close()
+
+		messages, err := c.Query(ctx, "Hello")
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if len(messages) != 2 {
+			t.Fatalf("Expected the unknown message to be skipped, got %d messages", len(messages))
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		c, err := New(WithCLIPath(cliPath), WithStrictParsing(true))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer c.Close()
+
+		messages, err := c.Query(ctx, "Hello")
+		if !errors.Is(err, ErrInvalidMessage) || !strings.Contains(err.Error(), "telemetry_v2") {
+			t.Fatalf("Expected an unknown message type error, got %v", err)
+		}
+		if len(messages) != 1 {
+			t.Errorf("Expected the messages before the error, got %d", len(messages))
+		}
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		c, err := New(WithCLIPath(cliPath), WithStrictParsing(true))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer c.Close()
+
+		msgChan, err := c.QueryStream(ctx, "Hello")
+		if err != nil {
+			t.Fatalf("QueryStream failed: %v", err)
+		}
+		var messages []Message
+		for msg := range msgChan {
+			messages = append(messages, msg)
+		}
+		if len(messages) != 2 {
+			t.Fatalf("Expected the stream to end at the unknown message, got %d messages", len(messages))
+		}
+		errMsg, ok := messages[1].(*ErrorMessage)
+		if !ok || errMsg.ErrorType != "parse_error" || errMsg.Data["type"] != "telemetry_v2" {
+			t.Errorf("Expected a parse_error message, got %+v", messages[1])
+		}
+	})
+}
+
+// TestQueryFile tests that a file's contents are sent as the prompt, through
+// stdin when the file is large
+func TestQueryFile(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args.txt")
+	stdinPath := filepath.Join(dir, "stdin.jsonl")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+case "$*" in
+  *--input-format*) head -n 1 > "$STDIN_CAPTURE" ;;
+esac
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithEnv("STDIN_CAPTURE", stdinPath),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("Small", func(t *testing.T) {
+		path := filepath.Join(dir, "small.md")
+		if err := os.WriteFile(path, []byte("Review this diff"), 0o644); err != nil {
+			t.Fatalf("Failed to write prompt file: %v", err)
+		}
+		if _, err := c.QueryFile(ctx, path); err != nil {
+			t.Fatalf("QueryFile failed: %v", err)
+		}
+		data, err := os.ReadFile(argsPath)
+		if err != nil {
+			t.Fatalf("Failed to read captured args: %v", err)
+		}
+		if !strings.Contains(string(data), "--print\nReview this diff\n") {
+			t.Errorf("Expected the file contents as the prompt, got %q", data)
+		}
+	})
+
+	t.Run("Large", func(t *testing.T) {
+		path := filepath.Join(dir, "large.md")
+		content := strings.Repeat("x", maxArgPrompt+1)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write prompt file: %v", err)
+		}
+		messages, err := c.QueryFile(ctx, path)
+		if err != nil {
+			t.Fatalf("QueryFile failed: %v", err)
+		}
+		if len(messages) != 1 {
+			t.Errorf("Expected 1 message, got %d", len(messages))
+		}
+		data, err := os.ReadFile(stdinPath)
+		if err != nil {
+			t.Fatalf("Failed to read captured stdin: %v", err)
+		}
+		var msg struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Failed to decode stdin message: %v", err)
+		}
+		if msg.Message.Content != content {
+			t.Errorf("Expected the file contents on stdin, got %d bytes", len(msg.Message.Content))
+		}
+	})
+
+	t.Run("LargeExitError", func(t *testing.T) {
+		failing, err := New(WithCLIPath(writeFakeCLI(t, `cat > /dev/null
+echo "rate limited" >&2
+exit 3`)))
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+		defer failing.Close()
+
+		path := filepath.Join(dir, "large.md")
+		_, err = failing.QueryFile(ctx, path)
+		var procErr *ProcessError
+		if !errors.As(err, &procErr) || procErr.ExitCode != 3 {
+			t.Errorf("Expected a ProcessError with exit code 3, got %v", err)
+		}
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		_, err := c.QueryFile(ctx, filepath.Join(dir, "missing.md"))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Expected a not-exist error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// ControlResponse is the CLI's answer to a control request sent by the SDK,
+// such as an interrupt
+type ControlResponse struct {
+	// RequestID is the ID of the control request being answered
+	RequestID string `json:"request_id"`
+
+	// Subtype is "success" or "error"
+	Subtype string `json:"subtype"`
+
+	// Error describes why the request failed when Subtype is "error"
+	Error string `json:"error,omitempty"`
+
+	// Response holds the request-specific result, if any
+	Response map[string]any `json:"response,omitempty"`
+}
+
+// controlRequestID returns the request ID of a control request built by
+// SubprocessTransport.newControlRequest
+func controlRequestID(req map[string]any) string {
+	id, _ := req["request_id"].(string)
+	return id
+}
+
+// sendControlRequest writes req to the CLI and waits for its control
+// response, until ctx is done or the process exits. Messages must be received
+// for the response to arrive.
+func (t *SubprocessTransport) sendControlRequest(ctx context.Context, req map[string]any) (ControlResponse, error) {
+	id := controlRequestID(req)
+	ch := make(chan ControlResponse, 1)
+
+	t.controlMu.Lock()
+	if t.controlWaiters == nil {
+		t.controlWaiters = make(map[string]chan ControlResponse)
+	}
+	t.controlWaiters[id] = ch
+	t.controlMu.Unlock()
+
+	defer func() {
+		t.controlMu.Lock()
+		delete(t.controlWaiters, id)
+		t.controlMu.Unlock()
+	}()
+
+	if err := t.writeStdin(req); err != nil {
+		return ControlResponse{}, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return ControlResponse{}, ctx.Err()
+	case <-t.receiveDone:
+		return ControlResponse{}, ErrProcessExited
+	case <-t.closeCh:
+		return ControlResponse{}, ErrNotConnected
+	}
+}
+
+// handleControlResponse passes a control response from the CLI to the
+// control response callback and to the request waiting for it. Responses to
+// heartbeats are dropped.
+func (t *SubprocessTransport) handleControlResponse(raw json.RawMessage) {
+	var envelope struct {
+		Response ControlResponse `json:"response"`
+	}
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		t.logger.Debug("failed to decode control response", slog.Any("error", err))
+		return
+	}
+	resp := envelope.Response
+
+	if strings.HasPrefix(resp.RequestID, heartbeatRequestPrefix) {
+		t.logger.Debug("heartbeat acknowledged", slog.String("subtype", resp.Subtype))
+		return
+	}
+
+	if t.options.OnControlResponse != nil {
+		t.options.OnControlResponse(resp)
+	}
+
+	t.controlMu.Lock()
+	ch, ok := t.controlWaiters[resp.RequestID]
+	delete(t.controlWaiters, resp.RequestID)
+	t.controlMu.Unlock()
+
+	if ok {
+		ch <- resp
+	}
+}
+
+// controlError returns the error reported by a failed control response
+func controlError(subtype string, resp ControlResponse) error {
+	if resp.Subtype == "error" {
+		return fmt.Errorf("%s request failed: %s", subtype, resp.Error)
+	}
+	return nil
+}
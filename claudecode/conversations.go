@@ -0,0 +1,44 @@
+package claudecode
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// projectDirPattern matches the characters the CLI replaces with "-" when
+// naming the directory that holds a project's conversations
+var projectDirPattern = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// hasConversation reports whether the CLI has recorded a conversation for the
+// working directory, which --continue requires
+func (t *SubprocessTransport) hasConversation() bool {
+	configDir := t.options.Env["CLAUDE_CONFIG_DIR"]
+	if configDir == "" {
+		configDir = os.Getenv("CLAUDE_CONFIG_DIR")
+	}
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return false
+		}
+		configDir = filepath.Join(home, ".claude")
+	}
+
+	dir := t.options.WorkingDirectory
+	if dir == "" {
+		dir = "."
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	// The CLI names the directory after the resolved path of its cwd
+	if resolved, err := filepath.EvalSymlinks(absDir); err == nil {
+		absDir = resolved
+	}
+
+	projectDir := filepath.Join(configDir, "projects", projectDirPattern.ReplaceAllString(absDir, "-"))
+	matches, err := filepath.Glob(filepath.Join(projectDir, "*.jsonl"))
+	return err == nil && len(matches) > 0
+}
@@ -0,0 +1,183 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redacted replaces secret values in a diagnostic bundle
+const redacted = "[REDACTED]"
+
+// diagnosticVersionTimeout bounds how long the CLI may take to report its version
+const diagnosticVersionTimeout = 10 * time.Second
+
+// diagnosticEnvPrefixes selects the inherited environment variables that
+// affect the CLI and are listed in a diagnostic bundle
+var diagnosticEnvPrefixes = []string{"ANTHROPIC_", "CLAUDE_", "DISABLE_", "MCP_", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// secretKeyFragments mark JSON keys whose values are redacted in arguments
+var secretKeyFragments = []string{"key", "token", "secret", "password", "auth", "credential", "env", "headers"}
+
+// secretPattern matches API keys and key=value secrets in plain arguments
+var secretPattern = regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]+|(?i)((?:api[_-]?key|token|secret|password)=)\S+`)
+
+// diagnosticBundle is the JSON document returned by DiagnosticBundle
+type diagnosticBundle struct {
+	CLIPath      string            `json:"cli_path"`
+	CLIVersion   string            `json:"cli_version,omitempty"`
+	VersionError string            `json:"cli_version_error,omitempty"`
+	Argv         []string          `json:"argv"`
+	Env          map[string]string `json:"env"`
+	OS           string            `json:"os"`
+	Arch         string            `json:"arch"`
+	GoVersion    string            `json:"go_version"`
+}
+
+// DiagnosticBundle returns a JSON report of the CLI path and version, the
+// session command line, the relevant environment variable names, and the
+// platform, for attaching to bug reports. Secrets in the command line, such
+// as MCP server credentials and API keys, are redacted, as are all
+// environment variable values.
+func (c *client) DiagnosticBundle(ctx context.Context) ([]byte, error) {
+	transport := NewStreamingTransport(c.options, nil, false)
+
+	cliPath, err := transport.findCLI()
+	if err != nil {
+		return nil, err
+	}
+	argv, err := transport.commandArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := diagnosticBundle{
+		CLIPath:   cliPath,
+		Argv:      make([]string, len(argv)),
+		Env:       make(map[string]string),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		GoVersion: runtime.Version(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, diagnosticVersionTimeout)
+	defer cancel()
+	if out, err := exec.CommandContext(ctx, cliPath, "--version").Output(); err != nil {
+		bundle.VersionError = err.Error()
+	} else {
+		bundle.CLIVersion = strings.TrimSpace(string(out))
+	}
+
+	for i, arg := range argv {
+		bundle.Argv[i] = redactArg(arg)
+	}
+
+	for _, name := range diagnosticEnvNames(c.options) {
+		bundle.Env[name] = redacted
+	}
+
+	return json.MarshalIndent(bundle, "", "  ")
+}
+
+// diagnosticEnvNames returns the sorted names of the environment variables
+// set for the CLI that are relevant to a bug report
+func diagnosticEnvNames(opts *Options) []string {
+	seen := make(map[string]bool)
+	for key := range opts.Env {
+		seen[key] = true
+	}
+
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if opts.EnvPassthrough != nil && !slices.Contains(opts.EnvPassthrough, name) {
+			continue
+		}
+		for _, prefix := range diagnosticEnvPrefixes {
+			if strings.HasPrefix(strings.ToUpper(name), prefix) {
+				seen[name] = true
+				break
+			}
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// redactArg redacts secrets in a command line argument. JSON arguments, such
+// as an inline MCP config, have the values of secret-looking keys replaced.
+func redactArg(arg string) string {
+	trimmed := strings.TrimSpace(arg)
+	if strings.HasPrefix(trimmed, "{") {
+		var v any
+		if err := json.Unmarshal([]byte(trimmed), &v); err == nil {
+			if data, err := json.Marshal(redactJSON(v)); err == nil {
+				return string(data)
+			}
+		}
+	}
+	return secretPattern.ReplaceAllStringFunc(arg, func(match string) string {
+		if prefix := secretPattern.FindStringSubmatch(match)[1]; prefix != "" {
+			return prefix + redacted
+		}
+		return redacted
+	})
+}
+
+// redactJSON replaces the values of secret-looking keys in a decoded JSON value
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if isSecretKey(key) {
+				v[key] = redactValue(value)
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = redactJSON(item)
+		}
+		return v
+	case string:
+		return redactArg(v)
+	}
+	return v
+}
+
+// redactValue redacts a secret value, keeping the keys of an object such as
+// an MCP server's env so the report still shows which variables were set
+func redactValue(v any) any {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return redacted
+	}
+	for key := range m {
+		m[key] = redacted
+	}
+	return m
+}
+
+// isSecretKey reports whether a JSON key looks like it holds a secret
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, fragment := range secretKeyFragments {
+		if strings.Contains(key, fragment) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDiagnosticBundle tests that the bundle reports the CLI version and
+// command line with secrets redacted
+func TestDiagnosticBundle(t *testing.T) {
+	cliPath := writeFakeCLI(t, `if [ "$1" = "--version" ]; then echo "2.1.0 (Claude Code)"; fi`)
+	t.Setenv("ANTHROPIC_API_KEY", "sk-ant-inherited-secret")
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("GITHUB_TOKEN", "ghp_envsecret"),
+		WithAppendSystemPrompt("Use api_key=hunter2 for the staging API"),
+		WithMCPServer("github", MCPServer{
+			Type:    MCPServerTypeHTTP,
+			URL:     "https://mcp.example.com",
+			Headers: map[string]string{"Authorization": "Bearer ghp_headersecret"},
+		}),
+		WithMCPServer("db", MCPServer{
+			Type:    MCPServerTypeStdio,
+			Command: "db-mcp",
+			Env:     map[string]string{"DB_PASSWORD": "pgsecret"},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data, err := c.DiagnosticBundle(ctx)
+	if err != nil {
+		t.Fatalf("DiagnosticBundle failed: %v", err)
+	}
+
+	for _, secret := range []string{"sk-ant-inherited-secret", "ghp_envsecret", "hunter2", "ghp_headersecret", "pgsecret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("Bundle leaks secret %q:\n%s", secret, data)
+		}
+	}
+
+	var bundle struct {
+		CLIPath    string            `json:"cli_path"`
+		CLIVersion string            `json:"cli_version"`
+		Argv       []string          `json:"argv"`
+		Env        map[string]string `json:"env"`
+		OS         string            `json:"os"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatalf("Failed to decode bundle: %v", err)
+	}
+
+	if bundle.CLIPath != cliPath || bundle.CLIVersion != "2.1.0 (Claude Code)" {
+		t.Errorf("Unexpected CLI path or version: %q %q", bundle.CLIPath, bundle.CLIVersion)
+	}
+	if len(bundle.Argv) == 0 || bundle.Argv[0] != cliPath || !strings.Contains(strings.Join(bundle.Argv, " "), "--input-format stream-json") {
+		t.Errorf("Expected the session command line, got %v", bundle.Argv)
+	}
+	if !strings.Contains(strings.Join(bundle.Argv, " "), "DB_PASSWORD") {
+		t.Errorf("Expected redacted MCP env keys to be kept, got %v", bundle.Argv)
+	}
+	for _, name := range []string{"ANTHROPIC_API_KEY", "GITHUB_TOKEN"} {
+		if bundle.Env[name] != redacted {
+			t.Errorf("Expected %s to be listed and redacted, got %q", name, bundle.Env[name])
+		}
+	}
+	if bundle.OS == "" {
+		t.Error("Expected OS info")
+	}
+}
@@ -0,0 +1,124 @@
+package claudecode
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Equal reports whether two messages are equal. Pointer fields such as
+// ContentBlock.Text and ContentBlock.Tool are compared by the values they
+// point to rather than by address.
+func Equal(a, b Message) bool {
+	return Diff(a, b) == ""
+}
+
+// Diff returns a human-readable report of the differences between two
+// messages, one line per mismatched field, or an empty string if they are
+// equal. It is intended for use in tests.
+func Diff(a, b Message) string {
+	var lines []string
+	diffValues("", reflect.ValueOf(a), reflect.ValueOf(b), &lines)
+	return strings.Join(lines, "\n")
+}
+
+// diffValues recursively compares two values and records mismatches by path
+func diffValues(path string, a, b reflect.Value, lines *[]string) {
+	if !a.IsValid() || !b.IsValid() {
+		if a.IsValid() != b.IsValid() {
+			*lines = append(*lines, fmt.Sprintf("%s: %s != %s", displayPath(path), formatValue(a), formatValue(b)))
+		}
+		return
+	}
+
+	if a.Type() != b.Type() {
+		*lines = append(*lines, fmt.Sprintf("%s: type %s != %s", displayPath(path), a.Type(), b.Type()))
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			if a.IsNil() != b.IsNil() {
+				*lines = append(*lines, fmt.Sprintf("%s: %s != %s", displayPath(path), formatValue(a), formatValue(b)))
+			}
+			return
+		}
+		diffValues(path, a.Elem(), b.Elem(), lines)
+
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fieldPath := field.Name
+			if field.Anonymous {
+				fieldPath = ""
+			}
+			diffValues(joinPath(path, fieldPath), a.Field(i), b.Field(i), lines)
+		}
+
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			*lines = append(*lines, fmt.Sprintf("%s: length %d != %d", displayPath(path), a.Len(), b.Len()))
+		}
+		for i := 0; i < a.Len() && i < b.Len(); i++ {
+			diffValues(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i), lines)
+		}
+
+	case reflect.Map:
+		keys := make(map[string]reflect.Value)
+		for _, k := range a.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		for _, k := range b.MapKeys() {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			k := keys[name]
+			diffValues(fmt.Sprintf("%s[%q]", path, name), a.MapIndex(k), b.MapIndex(k), lines)
+		}
+
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*lines = append(*lines, fmt.Sprintf("%s: %s != %s", displayPath(path), formatValue(a), formatValue(b)))
+		}
+	}
+}
+
+// joinPath appends a field name to a dotted path
+func joinPath(path, field string) string {
+	if path == "" || field == "" {
+		return path + field
+	}
+	return path + "." + field
+}
+
+// displayPath returns a printable path, using "message" for the root
+func displayPath(path string) string {
+	if path == "" {
+		return "message"
+	}
+	return path
+}
+
+// formatValue formats a value for a diff line, dereferencing pointers
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return "<missing>"
+	}
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "nil"
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprintf("%#v", v.Interface())
+}
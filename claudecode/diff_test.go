@@ -0,0 +1,76 @@
+package claudecode
+
+import (
+	"strings"
+	"testing"
+)
+
+func textBlock(text string) ContentBlock {
+	return ContentBlock{Type: "text", Text: &text}
+}
+
+func TestEqualMessages(t *testing.T) {
+	a := &AssistantMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+		Content: []ContentBlock{
+			textBlock("hello"),
+			{Type: "tool_use", Tool: &ToolUse{ID: "tool_1", Name: "Read", Input: map[string]any{"file_path": "main.go"}}},
+		},
+	}
+	b := &AssistantMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+		Content: []ContentBlock{
+			textBlock("hello"),
+			{Type: "tool_use", Tool: &ToolUse{ID: "tool_1", Name: "Read", Input: map[string]any{"file_path": "main.go"}}},
+		},
+	}
+
+	if !Equal(a, b) {
+		t.Errorf("Expected messages to be equal, diff:\n%s", Diff(a, b))
+	}
+	if diff := Diff(a, b); diff != "" {
+		t.Errorf("Expected empty diff, got:\n%s", diff)
+	}
+}
+
+func TestDiffMessages(t *testing.T) {
+	cost := 0.01
+	a := &AssistantMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+		Content: []ContentBlock{
+			textBlock("hello"),
+			{Type: "tool_use", Tool: &ToolUse{ID: "tool_1", Name: "Read", Input: map[string]any{"file_path": "main.go"}}},
+		},
+	}
+	b := &AssistantMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+		Content: []ContentBlock{
+			textBlock("goodbye"),
+			{Type: "tool_use", Tool: &ToolUse{ID: "tool_1", Name: "Read", Input: map[string]any{"file_path": "util.go"}}},
+		},
+	}
+
+	if Equal(a, b) {
+		t.Fatal("Expected messages to differ")
+	}
+
+	diff := Diff(a, b)
+	for _, want := range []string{
+		`Content[0].Text: "hello" != "goodbye"`,
+		`Content[1].Tool.Input["file_path"]: "main.go" != "util.go"`,
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("Expected diff to contain %q, got:\n%s", want, diff)
+		}
+	}
+
+	r1 := &ResultMessage{BaseMessage: BaseMessage{MessageType: MessageTypeResult}, TotalCostUSD: &cost}
+	r2 := &ResultMessage{BaseMessage: BaseMessage{MessageType: MessageTypeResult}}
+	if diff := Diff(r1, r2); !strings.Contains(diff, "TotalCostUSD: 0.01 != nil") {
+		t.Errorf("Expected nil pointer mismatch in diff, got:\n%s", diff)
+	}
+
+	if diff := Diff(a, r1); !strings.Contains(diff, "type") {
+		t.Errorf("Expected type mismatch in diff, got:\n%s", diff)
+	}
+}
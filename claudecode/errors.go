@@ -24,6 +24,23 @@ var (
 	
 	// ErrStreamClosed is returned when trying to use a closed stream
 	ErrStreamClosed = errors.New("claude-code: stream closed")
+
+	// ErrAlreadyReceiving is returned when Receive is called more than once on a transport
+	ErrAlreadyReceiving = errors.New("claude-code: receive already started")
+
+	// ErrToolLimitExceeded is returned when a turn uses more tools than allowed
+	ErrToolLimitExceeded = errors.New("claude-code: tool use limit exceeded")
+
+	// ErrBudgetExceeded is returned when spend exceeds the configured cost budget
+	ErrBudgetExceeded = errors.New("claude-code: cost budget exceeded")
+
+	// ErrToolFailed is returned when a tool fails and WithAbortOnToolError is set
+	ErrToolFailed = errors.New("claude-code: tool failed")
+
+	// ErrProcessExited is returned when the CLI exits with an error before
+	// producing a result. Any messages received before it exited are returned
+	// alongside the error.
+	ErrProcessExited = errors.New("claude-code: process exited")
 )
 
 // ClaudeError provides structured error information
@@ -99,3 +116,25 @@ func (e *JSONDecodeError) Unwrap() error {
 func (e *JSONDecodeError) Is(target error) bool {
 	return errors.Is(target, ErrJSONDecode)
 }
+
+// ToolError contains information about a failed tool execution
+type ToolError struct {
+	ToolUseID string
+	Message   string
+
+	// ToolName is the name of the failed tool, when the tool use was seen
+	ToolName string
+}
+
+// Error implements the error interface
+func (e *ToolError) Error() string {
+	if e.ToolName != "" {
+		return fmt.Sprintf("claude-code: tool %s (%s) failed: %s", e.ToolName, e.ToolUseID, e.Message)
+	}
+	return fmt.Sprintf("claude-code: tool %s failed: %s", e.ToolUseID, e.Message)
+}
+
+// Is implements errors.Is support
+func (e *ToolError) Is(target error) bool {
+	return target == ErrToolFailed
+}
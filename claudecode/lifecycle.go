@@ -0,0 +1,71 @@
+package claudecode
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Lifecycle events of the CLI subprocess, logged at debug level with the
+// message set to the event name. Every event carries the pid; the other
+// attributes are listed with each event.
+const (
+	// LogEventProcessStarted is logged when the CLI starts, with argv_hash,
+	// a short hash of the command line, and mode, "oneshot" or "streaming"
+	LogEventProcessStarted = "process_started"
+
+	// LogEventFirstMessage is logged when the first message is read from
+	// the CLI, with latency_ms, the time since it started
+	LogEventFirstMessage = "first_message_received"
+
+	// LogEventProcessExited is logged when the CLI exits, with exit_code,
+	// -1 when killed by a signal, and duration_ms, the time since it started
+	LogEventProcessExited = "process_exited"
+)
+
+// argvHash returns a short, stable hash of a command line, identifying runs
+// with the same configuration without logging prompts or secrets
+func argvHash(argv []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(argv, "\x00")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// logStarted logs the process_started event
+func (t *SubprocessTransport) logStarted(argv []string) {
+	mode := "oneshot"
+	if t.isStreaming {
+		mode = "streaming"
+	}
+	t.logger.Debug(LogEventProcessStarted,
+		slog.Int("pid", t.cmd.Process.Pid),
+		slog.String("argv_hash", argvHash(argv)),
+		slog.String("mode", mode))
+}
+
+// logFirstMessage logs the first_message_received event the first time it is
+// called. It is called from the single goroutine reading stdout.
+func (t *SubprocessTransport) logFirstMessage() {
+	if t.firstMessageSeen {
+		return
+	}
+	t.firstMessageSeen = true
+	t.logger.Debug(LogEventFirstMessage,
+		slog.Int("pid", t.cmd.Process.Pid),
+		slog.Int64("latency_ms", time.Since(t.startedAt).Milliseconds()))
+}
+
+// wait waits for the process to exit and logs the process_exited event
+func (t *SubprocessTransport) wait() error {
+	err := t.cmd.Wait()
+	exitCode := -1
+	if t.cmd.ProcessState != nil {
+		exitCode = t.cmd.ProcessState.ExitCode()
+	}
+	t.logger.Debug(LogEventProcessExited,
+		slog.Int("pid", t.cmd.Process.Pid),
+		slog.Int("exit_code", exitCode),
+		slog.Int64("duration_ms", time.Since(t.startedAt).Milliseconds()))
+	return err
+}
@@ -0,0 +1,84 @@
+package claudecode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLifecycleLogging tests that a run logs the start, first message, and
+// exit of the CLI with their structured fields
+func TestLifecycleLogging(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	cliPath := writeFakeCLI(t, `echo '{"type":"result","subtype":"success","session_id":"s1"}'
+exit 3
+`)
+	c, err := New(WithCLIPath(cliPath), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msgChan, err := c.QueryStream(ctx, "Hello")
+	if err != nil {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+	for range msgChan {
+		// Just consume
+	}
+
+	records := make(map[string]map[string]any)
+	var order []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to decode log record %q: %v", line, err)
+		}
+		msg, _ := record["msg"].(string)
+		switch msg {
+		case LogEventProcessStarted, LogEventFirstMessage, LogEventProcessExited:
+			records[msg] = record
+			order = append(order, msg)
+		}
+	}
+
+	want := []string{LogEventProcessStarted, LogEventFirstMessage, LogEventProcessExited}
+	if strings.Join(order, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected lifecycle events %v, got %v", want, order)
+	}
+
+	fields := map[string][]string{
+		LogEventProcessStarted: {"pid", "argv_hash", "mode"},
+		LogEventFirstMessage:   {"pid", "latency_ms"},
+		LogEventProcessExited:  {"pid", "exit_code", "duration_ms"},
+	}
+	for event, keys := range fields {
+		for _, key := range keys {
+			if _, ok := records[event][key]; !ok {
+				t.Errorf("%s: missing %s field in %v", event, key, records[event])
+			}
+		}
+	}
+
+	if pid := records[LogEventProcessStarted]["pid"]; records[LogEventProcessExited]["pid"] != pid {
+		t.Errorf("Expected the same pid on all events, got %v and %v", pid, records[LogEventProcessExited]["pid"])
+	}
+	if mode := records[LogEventProcessStarted]["mode"]; mode != "streaming" {
+		t.Errorf("Expected mode streaming, got %v", mode)
+	}
+	if hash, _ := records[LogEventProcessStarted]["argv_hash"].(string); len(hash) != 12 {
+		t.Errorf("Expected a 12 character argv hash, got %q", hash)
+	}
+	if code := records[LogEventProcessExited]["exit_code"]; code != float64(3) {
+		t.Errorf("Expected exit_code 3, got %v", code)
+	}
+}
@@ -1,8 +1,12 @@
 package claudecode
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
+	"sync"
 )
 
 // MessageType represents the type of message
@@ -13,11 +17,16 @@ const (
 	MessageTypeAssistant MessageType = "assistant"
 	MessageTypeSystem    MessageType = "system"
 	MessageTypeResult    MessageType = "result"
+	MessageTypeError     MessageType = "error"
 )
 
 // Message is the interface that all message types implement
 type Message interface {
 	Type() MessageType
+
+	// ToRawMessage converts the message back into the stream-json object
+	// the CLI uses for it, the inverse of ParseMessage
+	ToRawMessage() (map[string]any, error)
 }
 
 // BaseMessage contains common fields for messages
@@ -33,10 +42,66 @@ func (m BaseMessage) Type() MessageType {
 
 // ContentBlock represents different types of content in a message
 type ContentBlock struct {
-	Type   string      `json:"type"`
-	Text   *string     `json:"text,omitempty"`
-	Tool   *ToolUse    `json:"-"`
-	Result *ToolResult `json:"-"`
+	Type   string       `json:"type"`
+	Text   *string      `json:"text,omitempty"`
+	Tool   *ToolUse     `json:"-"`
+	Result *ToolResult  `json:"-"`
+	Image  *ImageSource `json:"-"`
+
+	// Extra holds the decoded value for block types registered with
+	// RegisterContentBlockType
+	Extra any `json:"-"`
+
+	// raw holds the JSON of block types the SDK does not handle natively,
+	// such as thinking blocks, so that they are marshaled back unchanged
+	raw json.RawMessage
+}
+
+// ImageSource is the source of an image content block
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// NewImageBlock creates an image content block from raw image bytes, such as
+// a chart rendered by a local tool, for use as tool_result content
+func NewImageBlock(mediaType string, data []byte) ContentBlock {
+	return ContentBlock{
+		Type: "image",
+		Image: &ImageSource{
+			Type:      "base64",
+			MediaType: mediaType,
+			Data:      base64.StdEncoding.EncodeToString(data),
+		},
+	}
+}
+
+// ContentBlockDecoder decodes the raw JSON of a custom content block type
+type ContentBlockDecoder func(data json.RawMessage) (any, error)
+
+var (
+	contentBlockDecodersMu sync.RWMutex
+	contentBlockDecoders   = make(map[string]ContentBlockDecoder)
+)
+
+// RegisterContentBlockType registers a decoder for a content block type that
+// the SDK does not handle natively. When a block of that type is parsed, the
+// decoder receives the raw block JSON and its result is stored in
+// ContentBlock.Extra. Built-in block types cannot be overridden.
+func RegisterContentBlockType(name string, decode ContentBlockDecoder) {
+	contentBlockDecodersMu.Lock()
+	defer contentBlockDecodersMu.Unlock()
+	contentBlockDecoders[name] = decode
+}
+
+// lookupContentBlockDecoder returns the registered decoder for a block type
+func lookupContentBlockDecoder(name string) (ContentBlockDecoder, bool) {
+	contentBlockDecodersMu.RLock()
+	defer contentBlockDecodersMu.RUnlock()
+	decode, ok := contentBlockDecoders[name]
+	return decode, ok
 }
 
 // ToolUse represents a tool invocation
@@ -46,14 +111,97 @@ type ToolUse struct {
 	Input map[string]any `json:"input"`
 }
 
-// ToolResult represents the result of a tool execution
+// ToolResult represents the result of a tool execution. Content is a string
+// or a list of content blocks; when building a result, use []ContentBlock to
+// include images.
 type ToolResult struct {
 	ToolUseID string `json:"tool_use_id"`
 	Content   any    `json:"content,omitempty"`
 	IsError   *bool  `json:"is_error,omitempty"`
 }
 
-// MarshalJSON implements custom JSON marshaling for ContentBlock
+// TextContent returns the text of the tool result. String content is returned
+// as-is; for an array of content blocks the text blocks are joined with newlines
+// and non-text blocks (such as images) are skipped.
+func (r *ToolResult) TextContent() string {
+	if s, ok := r.Content.(string); ok {
+		return s
+	}
+
+	var parts []string
+	for _, block := range r.Blocks() {
+		if block.Type == "text" && block.Text != nil {
+			parts = append(parts, *block.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Error returns a *ToolError carrying the result text when the tool reported
+// a failure, or nil if it succeeded
+func (r *ToolResult) Error() error {
+	if toolErr := r.toolError(); toolErr != nil {
+		return toolErr
+	}
+	return nil
+}
+
+// toolError returns the *ToolError for a failed tool result, or nil
+func (r *ToolResult) toolError() *ToolError {
+	if r.IsError == nil || !*r.IsError {
+		return nil
+	}
+	return &ToolError{ToolUseID: r.ToolUseID, Message: r.TextContent()}
+}
+
+// Blocks returns the tool result content as content blocks. String content is
+// returned as a single text block. Items that cannot be decoded are skipped.
+func (r *ToolResult) Blocks() []ContentBlock {
+	switch content := r.Content.(type) {
+	case nil:
+		return nil
+	case string:
+		return []ContentBlock{{Type: "text", Text: &content}}
+	case []ContentBlock:
+		return content
+	case []any:
+		return decodeContentBlocks(content)
+	default:
+		return nil
+	}
+}
+
+// decodeContentBlocks decodes raw content items into content blocks, skipping
+// items that cannot be decoded
+func decodeContentBlocks(items []any) []ContentBlock {
+	var blocks []ContentBlock
+	for _, item := range items {
+		blockJSON, err := json.Marshal(item)
+		if err != nil {
+			continue
+		}
+		var block ContentBlock
+		if err := json.Unmarshal(blockJSON, &block); err != nil {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// nestedContent returns the content array of the nested message structure
+// the CLI uses for user and assistant messages
+func nestedContent(data map[string]any) ([]any, bool) {
+	msgData, ok := data["message"].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	content, ok := msgData["content"].([]any)
+	return content, ok
+}
+
+// MarshalJSON implements custom JSON marshaling for ContentBlock. Blocks of
+// types the SDK does not handle natively are written as they were parsed.
 func (c ContentBlock) MarshalJSON() ([]byte, error) {
 	switch c.Type {
 	case "text":
@@ -76,6 +224,14 @@ func (c ContentBlock) MarshalJSON() ([]byte, error) {
 			Name:  c.Tool.Name,
 			Input: c.Tool.Input,
 		})
+	case "image":
+		return json.Marshal(struct {
+			Type   string       `json:"type"`
+			Source *ImageSource `json:"source"`
+		}{
+			Type:   c.Type,
+			Source: c.Image,
+		})
 	case "tool_result":
 		return json.Marshal(struct {
 			Type      string `json:"type"`
@@ -89,6 +245,9 @@ func (c ContentBlock) MarshalJSON() ([]byte, error) {
 			IsError:   c.Result.IsError,
 		})
 	default:
+		if c.raw != nil {
+			return c.raw, nil
+		}
 		return nil, fmt.Errorf("unknown content block type: %s", c.Type)
 	}
 }
@@ -96,14 +255,15 @@ func (c ContentBlock) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON implements custom JSON unmarshaling for ContentBlock
 func (c *ContentBlock) UnmarshalJSON(data []byte) error {
 	var raw struct {
-		Type      string         `json:"type"`
-		Text      *string        `json:"text,omitempty"`
-		ID        string         `json:"id,omitempty"`
-		Name      string         `json:"name,omitempty"`
-		Input     map[string]any `json:"input,omitempty"`
-		ToolUseID string         `json:"tool_use_id,omitempty"`
-		Content   any            `json:"content,omitempty"`
-		IsError   *bool          `json:"is_error,omitempty"`
+		Type      string          `json:"type"`
+		Text      *string         `json:"text,omitempty"`
+		ID        string          `json:"id,omitempty"`
+		Name      string          `json:"name,omitempty"`
+		Input     map[string]any  `json:"input,omitempty"`
+		ToolUseID string          `json:"tool_use_id,omitempty"`
+		Content   any             `json:"content,omitempty"`
+		IsError   *bool           `json:"is_error,omitempty"`
+		Source    json.RawMessage `json:"source,omitempty"`
 	}
 
 	if err := json.Unmarshal(data, &raw); err != nil {
@@ -127,6 +287,22 @@ func (c *ContentBlock) UnmarshalJSON(data []byte) error {
 			Content:   raw.Content,
 			IsError:   raw.IsError,
 		}
+	case "image":
+		if len(raw.Source) > 0 {
+			c.Image = &ImageSource{}
+			if err := json.Unmarshal(raw.Source, c.Image); err != nil {
+				return fmt.Errorf("failed to decode image source: %w", err)
+			}
+		}
+	default:
+		c.raw = append(json.RawMessage(nil), data...)
+		if decode, ok := lookupContentBlockDecoder(raw.Type); ok {
+			extra, err := decode(json.RawMessage(data))
+			if err != nil {
+				return fmt.Errorf("failed to decode %s content block: %w", raw.Type, err)
+			}
+			c.Extra = extra
+		}
 	}
 
 	return nil
@@ -136,6 +312,55 @@ func (c *ContentBlock) UnmarshalJSON(data []byte) error {
 type UserMessage struct {
 	BaseMessage
 	Content string `json:"content"`
+
+	// Blocks holds structured content, such as tool results. When set it is
+	// sent in place of Content.
+	Blocks []ContentBlock `json:"-"`
+}
+
+// UnmarshalJSON implements custom JSON unmarshaling for UserMessage. Text
+// content is read from the top level or from the nested message structure
+// the CLI uses in stream-json.
+func (m *UserMessage) UnmarshalJSON(data []byte) error {
+	type plain UserMessage
+	var raw struct {
+		plain
+		Message *struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*m = UserMessage(raw.plain)
+	if m.Content != "" || raw.Message == nil {
+		return nil
+	}
+
+	// Structured content, such as tool results, is decoded into blocks
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw.Message.Content, &items); err != nil {
+		_ = json.Unmarshal(raw.Message.Content, &m.Content)
+		return nil
+	}
+	for _, item := range items {
+		var block ContentBlock
+		if err := json.Unmarshal(item, &block); err != nil {
+			continue
+		}
+		m.Blocks = append(m.Blocks, block)
+	}
+	return nil
+}
+
+// content returns the message content as sent to the CLI: the blocks when
+// set, otherwise the text
+func (m *UserMessage) content() any {
+	if m.Blocks != nil {
+		return m.Blocks
+	}
+	return m.Content
 }
 
 // NewUserMessage creates a new user message
@@ -146,10 +371,43 @@ func NewUserMessage(content string) *UserMessage {
 	}
 }
 
+// NewToolResultMessage creates a user message carrying the result of a tool
+// use, for returning the output of a tool executed by the caller. content is
+// a string or a []ContentBlock.
+func NewToolResultMessage(toolUseID string, content any, isError bool) *UserMessage {
+	return &UserMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeUser},
+		Blocks: []ContentBlock{{
+			Type: "tool_result",
+			Result: &ToolResult{
+				ToolUseID: toolUseID,
+				Content:   content,
+				IsError:   &isError,
+			},
+		}},
+	}
+}
+
 // AssistantMessage represents a message from Claude
 type AssistantMessage struct {
 	BaseMessage
+
+	// Content holds the blocks in the order Claude produced them, so that
+	// narration stays ahead of the tool uses it introduces. ParseMessage,
+	// ParseMessageJSON, and ToRawMessage preserve this order. The CLI does
+	// not report block indexes on complete messages, so the position in
+	// Content is the block's index.
 	Content []ContentBlock `json:"content"`
+
+	// ID is the API message ID
+	ID string `json:"id,omitempty"`
+
+	// Model is the model that produced the message
+	Model string `json:"model,omitempty"`
+
+	// StopReason is why the model stopped, such as "end_turn" or "tool_use".
+	// It is empty while the message is still being generated.
+	StopReason string `json:"stop_reason,omitempty"`
 }
 
 // SystemMessage represents a system message
@@ -171,6 +429,166 @@ type ResultMessage struct {
 	TotalCostUSD  *float64       `json:"total_cost_usd,omitempty"`
 	Usage         map[string]any `json:"usage,omitempty"`
 	Result        *string        `json:"result,omitempty"`
+
+	// ParentToolUseID is set on results reported by sub-agents, identifying
+	// the Task tool use that started them
+	ParentToolUseID string `json:"parent_tool_use_id,omitempty"`
+
+	// formatter renders the result for String, from WithResultFormatter
+	formatter func(*ResultMessage) string
+}
+
+// UnmarshalJSON implements custom JSON unmarshaling for ResultMessage. The
+// durations are accepted as floats, such as 1234.0, and rounded to whole
+// milliseconds.
+func (m *ResultMessage) UnmarshalJSON(data []byte) error {
+	type plain ResultMessage
+	var raw struct {
+		plain
+		DurationMS    float64 `json:"duration_ms"`
+		DurationAPIMS float64 `json:"duration_api_ms"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*m = ResultMessage(raw.plain)
+	m.DurationMS = int(math.Round(raw.DurationMS))
+	m.DurationAPIMS = int(math.Round(raw.DurationAPIMS))
+	return nil
+}
+
+// IsFinal reports whether m is the top-level result that ends a turn, as
+// opposed to an intermediate result from a sub-agent
+func (m *ResultMessage) IsFinal() bool {
+	return m.ParentToolUseID == ""
+}
+
+// finalResult returns msg as a ResultMessage if it is a final result
+func finalResult(msg Message) (*ResultMessage, bool) {
+	result, ok := msg.(*ResultMessage)
+	if !ok || !result.IsFinal() {
+		return nil, false
+	}
+	return result, true
+}
+
+// ErrorKind classifies why a result failed, to help decide whether to retry,
+// trim context, or abort
+type ErrorKind string
+
+const (
+	// ErrorKindNone means the result did not fail
+	ErrorKindNone ErrorKind = ""
+
+	// ErrorKindRateLimit means the API rate limited or was overloaded; retry later
+	ErrorKindRateLimit ErrorKind = "rate_limit"
+
+	// ErrorKindContextExceeded means the prompt exceeded the context window
+	ErrorKindContextExceeded ErrorKind = "context_exceeded"
+
+	// ErrorKindMaxTurns means the conversation hit the turn limit
+	ErrorKindMaxTurns ErrorKind = "max_turns"
+
+	// ErrorKindToolFailure means the run failed while executing tools
+	ErrorKindToolFailure ErrorKind = "tool_failure"
+
+	// ErrorKindAuth means the credentials are missing, invalid, or out of credit
+	ErrorKindAuth ErrorKind = "auth"
+
+	// ErrorKindUnknown means the failure could not be classified
+	ErrorKindUnknown ErrorKind = "unknown"
+)
+
+// errorKindPatterns maps lowercase result text fragments to error kinds, in
+// priority order
+var errorKindPatterns = []struct {
+	fragment string
+	kind     ErrorKind
+}{
+	{"rate_limit", ErrorKindRateLimit},
+	{"rate limit", ErrorKindRateLimit},
+	{"error: 429", ErrorKindRateLimit},
+	{"overloaded", ErrorKindRateLimit},
+	{"prompt is too long", ErrorKindContextExceeded},
+	{"context window", ErrorKindContextExceeded},
+	{"context length", ErrorKindContextExceeded},
+	{"maximum context", ErrorKindContextExceeded},
+	{"invalid api key", ErrorKindAuth},
+	{"authentication", ErrorKindAuth},
+	{"unauthorized", ErrorKindAuth},
+	{"error: 401", ErrorKindAuth},
+	{"/login", ErrorKindAuth},
+	{"credit balance", ErrorKindAuth},
+}
+
+// ErrorKind classifies a failed result from its subtype and result text. It
+// returns ErrorKindNone for successful results.
+func (m *ResultMessage) ErrorKind() ErrorKind {
+	if !m.IsError && !strings.HasPrefix(m.Subtype, "error") {
+		return ErrorKindNone
+	}
+
+	if m.Subtype == "error_max_turns" {
+		return ErrorKindMaxTurns
+	}
+
+	if m.Result != nil {
+		text := strings.ToLower(*m.Result)
+		for _, p := range errorKindPatterns {
+			if strings.Contains(text, p.fragment) {
+				return p.kind
+			}
+		}
+	}
+
+	if m.Subtype == "error_during_execution" {
+		return ErrorKindToolFailure
+	}
+	return ErrorKindUnknown
+}
+
+// ErrorMessage represents a top-level error reported by the CLI outside of a
+// result, such as an API error that aborted the stream
+type ErrorMessage struct {
+	BaseMessage
+	ErrorType string         `json:"error_type,omitempty"`
+	Message   string         `json:"message"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+// MessageMeta carries the envelope fields of an outbound message
+type MessageMeta struct {
+	SessionID       string
+	ParentToolUseID string
+}
+
+// MessageEncoder converts an outbound message into the JSON object written to
+// the CLI's stdin
+type MessageEncoder func(msg Message, meta MessageMeta) (map[string]any, error)
+
+// EncodeMessage is the default MessageEncoder. It encodes a UserMessage in the
+// CLI's stream-json input format; other message types are rejected.
+func EncodeMessage(msg Message, meta MessageMeta) (map[string]any, error) {
+	userMsg, ok := msg.(*UserMessage)
+	if !ok {
+		return nil, fmt.Errorf("%w: only UserMessage supported for sending", ErrInvalidMessage)
+	}
+
+	var parentToolUseID any
+	if meta.ParentToolUseID != "" {
+		parentToolUseID = meta.ParentToolUseID
+	}
+
+	return map[string]any{
+		"type": "user",
+		"message": map[string]any{
+			"role":    "user",
+			"content": userMsg.content(),
+		},
+		"parent_tool_use_id": parentToolUseID,
+		"session_id":         meta.SessionID,
+	}, nil
 }
 
 // MessageResult wraps a message with a potential error
@@ -179,7 +597,9 @@ type MessageResult struct {
 	Error   error
 }
 
-// ParseMessage parses a raw message from the CLI into a typed Message
+// ParseMessage parses a raw message from the CLI into a typed Message, using
+// the schema of current CLI releases. Use ParseMessageVersion for another
+// protocol version.
 func ParseMessage(data map[string]any) (Message, error) {
 	msgType, ok := data["type"].(string)
 	if !ok {
@@ -202,25 +622,16 @@ func ParseMessage(data map[string]any) (Message, error) {
 
 	case MessageTypeAssistant:
 		// Handle the nested message structure from CLI
-		if msgData, ok := data["message"].(map[string]any); ok {
-			if content, ok := msgData["content"].([]any); ok {
-				var blocks []ContentBlock
-				for _, item := range content {
-					blockJSON, err := json.Marshal(item)
-					if err != nil {
-						continue
-					}
-					var block ContentBlock
-					if err := json.Unmarshal(blockJSON, &block); err != nil {
-						continue
-					}
-					blocks = append(blocks, block)
-				}
-				return &AssistantMessage{
-					BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
-					Content:     blocks,
-				}, nil
+		if content, ok := nestedContent(data); ok {
+			msg := &AssistantMessage{
+				BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+				Content:     decodeContentBlocks(content),
 			}
+			nested := data["message"].(map[string]any)
+			msg.ID, _ = nested["id"].(string)
+			msg.Model, _ = nested["model"].(string)
+			msg.StopReason, _ = nested["stop_reason"].(string)
+			return msg, nil
 		}
 		return nil, fmt.Errorf("%w: invalid assistant message structure", ErrInvalidMessage)
 
@@ -240,7 +651,212 @@ func ParseMessage(data map[string]any) (Message, error) {
 		msg.MessageType = MessageTypeResult
 		return &msg, nil
 
+	case MessageTypeError:
+		return parseErrorMessage(data), nil
+
 	default:
 		return nil, fmt.Errorf("%w: unknown message type: %s", ErrInvalidMessage, msgType)
 	}
 }
+
+// ParseMessageJSON parses the raw JSON of a message from the CLI into a typed
+// Message. It produces the same result as ParseMessage but decodes the bytes
+// directly, avoiding the map decode and re-marshal round trip.
+func ParseMessageJSON(data []byte) (Message, error) {
+	var envelope struct {
+		Type    string          `json:"type"`
+		Message json.RawMessage `json:"message"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if envelope.Type == "" {
+		return nil, fmt.Errorf("%w: missing or invalid type field", ErrInvalidMessage)
+	}
+
+	switch MessageType(envelope.Type) {
+	case MessageTypeUser:
+		var msg UserMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("%w: failed to parse user message: %v", ErrInvalidMessage, err)
+		}
+		msg.MessageType = MessageTypeUser
+		return &msg, nil
+
+	case MessageTypeAssistant:
+		// Handle the nested message structure from CLI
+		var nested struct {
+			Content    []json.RawMessage `json:"content"`
+			ID         string            `json:"id"`
+			Model      string            `json:"model"`
+			StopReason string            `json:"stop_reason"`
+		}
+		if err := json.Unmarshal(envelope.Message, &nested); err != nil || nested.Content == nil {
+			return nil, fmt.Errorf("%w: invalid assistant message structure", ErrInvalidMessage)
+		}
+
+		msg := &AssistantMessage{
+			BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+			ID:          nested.ID,
+			Model:       nested.Model,
+			StopReason:  nested.StopReason,
+		}
+		for _, item := range nested.Content {
+			var block ContentBlock
+			if err := json.Unmarshal(item, &block); err != nil {
+				continue
+			}
+			msg.Content = append(msg.Content, block)
+		}
+		return msg, nil
+
+	case MessageTypeSystem:
+		var msg SystemMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("%w: failed to parse system message: %v", ErrInvalidMessage, err)
+		}
+		msg.MessageType = MessageTypeSystem
+		return &msg, nil
+
+	case MessageTypeResult:
+		var msg ResultMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("%w: failed to parse result message: %v", ErrInvalidMessage, err)
+		}
+		msg.MessageType = MessageTypeResult
+		return &msg, nil
+
+	case MessageTypeError:
+		var fields map[string]any
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, fmt.Errorf("%w: failed to parse error message: %v", ErrInvalidMessage, err)
+		}
+		return parseErrorMessage(fields), nil
+
+	default:
+		return nil, fmt.Errorf("%w: unknown message type: %s", ErrInvalidMessage, envelope.Type)
+	}
+}
+
+// parseErrorMessage builds an ErrorMessage from the fields of an error message
+func parseErrorMessage(data map[string]any) *ErrorMessage {
+	msg := &ErrorMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeError},
+		Data:        data,
+	}
+	msg.SessionID, _ = data["session_id"].(string)
+	msg.Message, _ = data["message"].(string)
+
+	// API errors nest the detail as {"error": {"type": ..., "message": ...}}
+	switch detail := data["error"].(type) {
+	case map[string]any:
+		msg.ErrorType, _ = detail["type"].(string)
+		if text, ok := detail["message"].(string); ok {
+			msg.Message = text
+		}
+	case string:
+		if msg.Message == "" {
+			msg.Message = detail
+		}
+	}
+	return msg
+}
+
+// ToRawMessage converts the message back into a stream-json user message
+func (m *UserMessage) ToRawMessage() (map[string]any, error) {
+	if m.Blocks == nil {
+		return nestedRawMessage(m.BaseMessage, "user", m.Content), nil
+	}
+
+	var content []any
+	if err := remarshal(m.Blocks, &content); err != nil {
+		return nil, fmt.Errorf("%w: failed to encode user content: %v", ErrInvalidMessage, err)
+	}
+	return nestedRawMessage(m.BaseMessage, "user", content), nil
+}
+
+// ToRawMessage converts the message back into a stream-json assistant message
+func (m *AssistantMessage) ToRawMessage() (map[string]any, error) {
+	content := []any{}
+	if len(m.Content) > 0 {
+		if err := remarshal(m.Content, &content); err != nil {
+			return nil, fmt.Errorf("%w: failed to encode assistant content: %v", ErrInvalidMessage, err)
+		}
+	}
+	raw := nestedRawMessage(m.BaseMessage, "assistant", content)
+	nested := raw["message"].(map[string]any)
+	for key, value := range map[string]string{"id": m.ID, "model": m.Model, "stop_reason": m.StopReason} {
+		if value != "" {
+			nested[key] = value
+		}
+	}
+	return raw, nil
+}
+
+// ToRawMessage converts the message back into a stream-json system message
+func (m *SystemMessage) ToRawMessage() (map[string]any, error) {
+	return rawMessage(m)
+}
+
+// ToRawMessage converts the message back into a stream-json result message
+func (m *ResultMessage) ToRawMessage() (map[string]any, error) {
+	return rawMessage(m)
+}
+
+// ToRawMessage returns the fields the error was parsed from, or rebuilds them
+// for an error constructed by hand
+func (m *ErrorMessage) ToRawMessage() (map[string]any, error) {
+	if m.Data != nil {
+		raw := make(map[string]any, len(m.Data))
+		for k, v := range m.Data {
+			raw[k] = v
+		}
+		return raw, nil
+	}
+
+	raw := map[string]any{
+		"type":    string(MessageTypeError),
+		"message": m.Message,
+	}
+	if m.ErrorType != "" {
+		raw["error"] = map[string]any{"type": m.ErrorType, "message": m.Message}
+	}
+	if m.SessionID != "" {
+		raw["session_id"] = m.SessionID
+	}
+	return raw, nil
+}
+
+// nestedRawMessage builds the {"type", "message": {"role", "content"}}
+// structure the CLI uses for user and assistant messages
+func nestedRawMessage(base BaseMessage, role string, content any) map[string]any {
+	raw := map[string]any{
+		"type": role,
+		"message": map[string]any{
+			"role":    role,
+			"content": content,
+		},
+	}
+	if base.SessionID != "" {
+		raw["session_id"] = base.SessionID
+	}
+	return raw
+}
+
+// rawMessage converts a message with flat JSON fields into a map
+func rawMessage(msg Message) (map[string]any, error) {
+	var raw map[string]any
+	if err := remarshal(msg, &raw); err != nil {
+		return nil, fmt.Errorf("%w: failed to encode %s message: %v", ErrInvalidMessage, msg.Type(), err)
+	}
+	return raw, nil
+}
+
+// remarshal converts v into out through its JSON encoding
+func remarshal(v any, out any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
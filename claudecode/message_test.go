@@ -0,0 +1,609 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestToolResultStringContent(t *testing.T) {
+	result := &ToolResult{ToolUseID: "tool_1", Content: "file contents"}
+
+	if got := result.TextContent(); got != "file contents" {
+		t.Errorf("TextContent() = %q, want %q", got, "file contents")
+	}
+
+	blocks := result.Blocks()
+	if len(blocks) != 1 {
+		t.Fatalf("Blocks() returned %d blocks, want 1", len(blocks))
+	}
+	if blocks[0].Type != "text" || blocks[0].Text == nil || *blocks[0].Text != "file contents" {
+		t.Errorf("Blocks()[0] = %+v, want text block with %q", blocks[0], "file contents")
+	}
+}
+
+func TestToolResultArrayContent(t *testing.T) {
+	raw := `{
+		"type": "tool_result",
+		"tool_use_id": "tool_1",
+		"content": [
+			{"type": "text", "text": "first"},
+			{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}},
+			{"type": "text", "text": "second"}
+		]
+	}`
+
+	var block ContentBlock
+	if err := json.Unmarshal([]byte(raw), &block); err != nil {
+		t.Fatalf("Failed to unmarshal tool result: %v", err)
+	}
+	if block.Result == nil {
+		t.Fatal("Expected tool result to be set")
+	}
+
+	if got := block.Result.TextContent(); got != "first\nsecond" {
+		t.Errorf("TextContent() = %q, want %q", got, "first\nsecond")
+	}
+
+	blocks := block.Result.Blocks()
+	if len(blocks) != 3 {
+		t.Fatalf("Blocks() returned %d blocks, want 3", len(blocks))
+	}
+	wantTypes := []string{"text", "image", "text"}
+	for i, want := range wantTypes {
+		if blocks[i].Type != want {
+			t.Errorf("Blocks()[%d].Type = %q, want %q", i, blocks[i].Type, want)
+		}
+	}
+}
+
+func TestToolResultNilContent(t *testing.T) {
+	result := &ToolResult{ToolUseID: "tool_1"}
+
+	if got := result.TextContent(); got != "" {
+		t.Errorf("TextContent() = %q, want empty", got)
+	}
+	if blocks := result.Blocks(); blocks != nil {
+		t.Errorf("Blocks() = %v, want nil", blocks)
+	}
+}
+
+func TestRegisterContentBlockType(t *testing.T) {
+	type citation struct {
+		Source string `json:"source"`
+		Quote  string `json:"quote"`
+	}
+
+	RegisterContentBlockType("citation", func(data json.RawMessage) (any, error) {
+		var c citation
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		return &c, nil
+	})
+	t.Cleanup(func() {
+		contentBlockDecodersMu.Lock()
+		delete(contentBlockDecoders, "citation")
+		contentBlockDecodersMu.Unlock()
+	})
+
+	msg, err := ParseMessage(map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"content": []any{
+				map[string]any{"type": "text", "text": "As documented:"},
+				map[string]any{"type": "citation", "source": "README.md", "quote": "Go SDK for Claude Code"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+
+	assistant := msg.(*AssistantMessage)
+	if len(assistant.Content) != 2 {
+		t.Fatalf("Expected 2 content blocks, got %d", len(assistant.Content))
+	}
+
+	block := assistant.Content[1]
+	if block.Type != "citation" {
+		t.Errorf("Expected citation block, got %q", block.Type)
+	}
+	c, ok := block.Extra.(*citation)
+	if !ok {
+		t.Fatalf("Expected Extra to be *citation, got %T", block.Extra)
+	}
+	if c.Source != "README.md" || c.Quote != "Go SDK for Claude Code" {
+		t.Errorf("Unexpected citation: %+v", c)
+	}
+}
+
+func TestToolResultError(t *testing.T) {
+	var block ContentBlock
+	raw := `{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"permission denied: /etc/shadow"}],"is_error":true}`
+	if err := json.Unmarshal([]byte(raw), &block); err != nil {
+		t.Fatalf("Failed to unmarshal tool result: %v", err)
+	}
+
+	err := block.Result.Error()
+	if err == nil {
+		t.Fatal("Expected Error() to be non-nil for failed tool")
+	}
+
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		t.Fatalf("Expected *ToolError, got %T", err)
+	}
+	if toolErr.Message != "permission denied: /etc/shadow" {
+		t.Errorf("Message = %q, want %q", toolErr.Message, "permission denied: /etc/shadow")
+	}
+	if toolErr.ToolUseID != "toolu_1" {
+		t.Errorf("ToolUseID = %q, want %q", toolErr.ToolUseID, "toolu_1")
+	}
+
+	isError := false
+	ok := &ToolResult{ToolUseID: "toolu_2", Content: "done", IsError: &isError}
+	if err := ok.Error(); err != nil {
+		t.Errorf("Expected nil error for successful tool, got %v", err)
+	}
+}
+
+func TestParseErrorMessage(t *testing.T) {
+	msg, err := ParseMessage(map[string]any{
+		"type":       "error",
+		"session_id": "s1",
+		"error": map[string]any{
+			"type":    "overloaded_error",
+			"message": "Overloaded",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to parse error message: %v", err)
+	}
+
+	errMsg, ok := msg.(*ErrorMessage)
+	if !ok {
+		t.Fatalf("Expected *ErrorMessage, got %T", msg)
+	}
+	if errMsg.Type() != MessageTypeError {
+		t.Errorf("Type() = %q, want %q", errMsg.Type(), MessageTypeError)
+	}
+	if errMsg.ErrorType != "overloaded_error" {
+		t.Errorf("ErrorType = %q, want %q", errMsg.ErrorType, "overloaded_error")
+	}
+	if errMsg.Message != "Overloaded" {
+		t.Errorf("Message = %q, want %q", errMsg.Message, "Overloaded")
+	}
+	if errMsg.SessionID != "s1" {
+		t.Errorf("SessionID = %q, want %q", errMsg.SessionID, "s1")
+	}
+
+	msg, err = ParseMessage(map[string]any{"type": "error", "message": "stream aborted"})
+	if err != nil {
+		t.Fatalf("Failed to parse error message: %v", err)
+	}
+	if got := msg.(*ErrorMessage).Message; got != "stream aborted" {
+		t.Errorf("Message = %q, want %q", got, "stream aborted")
+	}
+}
+
+// parseSamples are representative CLI output lines
+var parseSamples = []string{
+	`{"type":"system","subtype":"init","session_id":"s1","data":{"cwd":"/tmp","tools":["Read","Bash"]}}`,
+	`{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Reading the file."},{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"main.go","limit":200}}]},"session_id":"s1"}`,
+	`{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"package main"}],"is_error":false}]},"session_id":"s1"}`,
+	`{"type":"assistant","message":{"role":"assistant","content":[]}}`,
+	`{"type":"assistant","message":{"id":"msg_01","type":"message","role":"assistant","model":"claude-sonnet-4-5","content":[{"type":"text","text":"Done."}],"stop_reason":"end_turn","stop_sequence":null,"usage":{"input_tokens":12,"output_tokens":3}},"parent_tool_use_id":null,"session_id":"s1"}`,
+	`{"type":"result","subtype":"success","duration_ms":1500,"duration_api_ms":1200,"is_error":false,"num_turns":2,"session_id":"s1","total_cost_usd":0.0123,"usage":{"input_tokens":100,"output_tokens":20},"result":"done"}`,
+	`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+}
+
+func TestParseMessageJSONMatchesParseMessage(t *testing.T) {
+	for _, line := range parseSamples {
+		var data map[string]any
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			t.Fatalf("Failed to decode sample: %v", err)
+		}
+
+		want, err := ParseMessage(data)
+		if err != nil {
+			t.Fatalf("ParseMessage(%s) failed: %v", line, err)
+		}
+		got, err := ParseMessageJSON([]byte(line))
+		if err != nil {
+			t.Fatalf("ParseMessageJSON(%s) failed: %v", line, err)
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Mismatch for %s\ngot:  %#v\nwant: %#v", line, got, want)
+		}
+	}
+
+	invalid := []string{
+		`{"subtype":"init"}`,
+		`{"type":"assistant","message":{"role":"assistant"}}`,
+		`{"type":"unknown_event"}`,
+	}
+	for _, line := range invalid {
+		if _, err := ParseMessageJSON([]byte(line)); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("ParseMessageJSON(%s) error = %v, want ErrInvalidMessage", line, err)
+		}
+	}
+}
+
+func BenchmarkParseMessage(b *testing.B) {
+	lines := make([][]byte, len(parseSamples))
+	for i, line := range parseSamples {
+		lines[i] = []byte(line)
+	}
+
+	b.Run("Map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var data map[string]any
+			if err := json.Unmarshal(lines[i%len(lines)], &data); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := ParseMessage(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("JSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ParseMessageJSON(lines[i%len(lines)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestResultErrorKind(t *testing.T) {
+	tests := []struct {
+		subtype string
+		isError bool
+		result  string
+		want    ErrorKind
+	}{
+		{"success", false, "done", ErrorKindNone},
+		{"error_max_turns", true, "", ErrorKindMaxTurns},
+		{"success", true, "API Error: 429 {\"type\":\"error\",\"error\":{\"type\":\"rate_limit_error\"}}", ErrorKindRateLimit},
+		{"success", true, "API Error: Repeated 529 Overloaded errors", ErrorKindRateLimit},
+		{"success", true, "Prompt is too long", ErrorKindContextExceeded},
+		{"success", true, "Invalid API key · Please run /login", ErrorKindAuth},
+		{"success", true, "Credit balance is too low", ErrorKindAuth},
+		{"error_during_execution", true, "", ErrorKindToolFailure},
+		{"success", true, "something unexpected", ErrorKindUnknown},
+	}
+
+	for _, tt := range tests {
+		m := &ResultMessage{Subtype: tt.subtype, IsError: tt.isError}
+		if tt.result != "" {
+			result := tt.result
+			m.Result = &result
+		}
+		if got := m.ErrorKind(); got != tt.want {
+			t.Errorf("ErrorKind() for %s %q = %q, want %q", tt.subtype, tt.result, got, tt.want)
+		}
+	}
+}
+
+func TestToolResultImageMarshal(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G'}
+	block := ContentBlock{
+		Type: "tool_result",
+		Result: &ToolResult{
+			ToolUseID: "toolu_1",
+			Content: []ContentBlock{
+				textBlock("Rendered chart"),
+				NewImageBlock("image/png", png),
+			},
+		},
+	}
+
+	data, err := json.Marshal(block)
+	if err != nil {
+		t.Fatalf("Failed to marshal tool result: %v", err)
+	}
+
+	want := `{"type":"tool_result","tool_use_id":"toolu_1","content":[` +
+		`{"type":"text","text":"Rendered chart"},` +
+		`{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw=="}}]}`
+	if string(data) != want {
+		t.Errorf("Marshal mismatch\ngot:  %s\nwant: %s", data, want)
+	}
+
+	var decoded ContentBlock
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal tool result: %v", err)
+	}
+	blocks := decoded.Result.Blocks()
+	if len(blocks) != 2 || blocks[1].Image == nil || blocks[1].Image.Data != "iVBORw==" {
+		t.Errorf("Expected image block to round-trip, got %+v", blocks)
+	}
+}
+
+func TestToRawMessageRoundTrip(t *testing.T) {
+	RegisterContentBlockType("citation", func(data json.RawMessage) (any, error) {
+		var c map[string]any
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+	t.Cleanup(func() {
+		contentBlockDecodersMu.Lock()
+		delete(contentBlockDecoders, "citation")
+		contentBlockDecodersMu.Unlock()
+	})
+
+	samples := []string{
+		`{"type":"user","message":{"role":"user","content":"Summarize main.go"},"session_id":"s1"}`,
+		`{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"package main"}],"is_error":false}]},"session_id":"s1"}`,
+		`{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Reading the file."},{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"main.go","limit":200}}]}}`,
+		`{"type":"assistant","message":{"role":"assistant","content":[]}}`,
+		`{"type":"assistant","message":{"role":"assistant","content":[{"type":"thinking","thinking":"The user wants a summary.","signature":"sig_1"},{"type":"text","text":"Summary follows."}]}}`,
+		`{"type":"assistant","message":{"role":"assistant","content":[{"type":"citation","source":"README.md","quote":"Go SDK"},{"type":"redacted_thinking","data":"opaque"}]}}`,
+		`{"type":"assistant","message":{"id":"msg_01","role":"assistant","model":"claude-sonnet-4-5","content":[{"type":"text","text":"Done."}],"stop_reason":"end_turn"}}`,
+		`{"type":"system","subtype":"init","session_id":"s1","data":{"cwd":"/tmp","tools":["Read","Bash"]}}`,
+		`{"type":"result","subtype":"success","duration_ms":1500,"duration_api_ms":1200,"is_error":false,"num_turns":2,"session_id":"s1","total_cost_usd":0.0123,"usage":{"input_tokens":100,"output_tokens":20},"result":"done"}`,
+		`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+	}
+
+	for _, line := range samples {
+		var data map[string]any
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			t.Fatalf("Failed to decode sample: %v", err)
+		}
+
+		msg, err := ParseMessage(data)
+		if err != nil {
+			t.Fatalf("ParseMessage(%s) failed: %v", line, err)
+		}
+		raw, err := msg.ToRawMessage()
+		if err != nil {
+			t.Fatalf("ToRawMessage() for %s failed: %v", line, err)
+		}
+		if !reflect.DeepEqual(raw, data) {
+			t.Errorf("Round trip mismatch for %s\ngot:  %#v\nwant: %#v", line, raw, data)
+		}
+
+		reparsed, err := ParseMessage(raw)
+		if err != nil {
+			t.Fatalf("ParseMessage(ToRawMessage()) for %s failed: %v", line, err)
+		}
+		if !reflect.DeepEqual(reparsed, msg) {
+			t.Errorf("Reparse mismatch for %s\ngot:  %#v\nwant: %#v", line, reparsed, msg)
+		}
+	}
+}
+
+func TestParseAssistantEnvelope(t *testing.T) {
+	line := `{"type":"assistant","message":{"id":"msg_01XFDUDYJgAACzvnptvVoYEL","type":"message","role":"assistant","model":"claude-sonnet-4-5-20250929","content":[{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"go.mod"}}],"stop_reason":"tool_use","stop_sequence":null,"usage":{"input_tokens":4,"output_tokens":61}},"parent_tool_use_id":null,"session_id":"s1"}`
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		t.Fatalf("Failed to decode envelope: %v", err)
+	}
+	fromMap, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	fromJSON, err := ParseMessageJSON([]byte(line))
+	if err != nil {
+		t.Fatalf("ParseMessageJSON failed: %v", err)
+	}
+
+	for _, msg := range []Message{fromMap, fromJSON} {
+		assistant := msg.(*AssistantMessage)
+		if assistant.ID != "msg_01XFDUDYJgAACzvnptvVoYEL" {
+			t.Errorf("ID = %q, want %q", assistant.ID, "msg_01XFDUDYJgAACzvnptvVoYEL")
+		}
+		if assistant.Model != "claude-sonnet-4-5-20250929" {
+			t.Errorf("Model = %q, want %q", assistant.Model, "claude-sonnet-4-5-20250929")
+		}
+		if assistant.StopReason != "tool_use" {
+			t.Errorf("StopReason = %q, want %q", assistant.StopReason, "tool_use")
+		}
+		if len(assistant.Content) != 1 || assistant.Content[0].Tool == nil {
+			t.Errorf("Expected one tool_use block, got %+v", assistant.Content)
+		}
+	}
+}
+
+func TestNewToolResultMessage(t *testing.T) {
+	msg := NewToolResultMessage("toolu_1", "3 files changed", false)
+
+	encoded, err := EncodeMessage(msg, MessageMeta{SessionID: "s1"})
+	if err != nil {
+		t.Fatalf("EncodeMessage failed: %v", err)
+	}
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+
+	want := `{"message":{"content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"3 files changed","is_error":false}],"role":"user"},` +
+		`"parent_tool_use_id":null,"session_id":"s1","type":"user"}`
+	if string(data) != want {
+		t.Errorf("Serialized tool result mismatch\ngot:  %s\nwant: %s", data, want)
+	}
+
+	parsed, err := ParseMessageJSON(data)
+	if err != nil {
+		t.Fatalf("ParseMessageJSON failed: %v", err)
+	}
+	blocks := parsed.(*UserMessage).Blocks
+	if len(blocks) != 1 || blocks[0].Result == nil || blocks[0].Result.TextContent() != "3 files changed" {
+		t.Errorf("Expected tool result block to round-trip, got %+v", blocks)
+	}
+
+	failed := NewToolResultMessage("toolu_2", []ContentBlock{textBlock("exit status 1")}, true)
+	if err := failed.Blocks[0].Result.Error(); err == nil {
+		t.Error("Expected Error() to be non-nil for a failed tool result")
+	}
+}
+
+func TestParseResultFloatDurations(t *testing.T) {
+	line := `{"type":"result","subtype":"success","duration_ms":1234.0,"duration_api_ms":987.6,"is_error":false,"num_turns":2,"session_id":"s1","total_cost_usd":0.01,"result":"done"}`
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		t.Fatalf("Failed to decode envelope: %v", err)
+	}
+	fromMap, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	fromJSON, err := ParseMessageJSON([]byte(line))
+	if err != nil {
+		t.Fatalf("ParseMessageJSON failed: %v", err)
+	}
+
+	for _, msg := range []Message{fromMap, fromJSON} {
+		result := msg.(*ResultMessage)
+		if result.DurationMS != 1234 {
+			t.Errorf("DurationMS = %d, want 1234", result.DurationMS)
+		}
+		if result.DurationAPIMS != 988 {
+			t.Errorf("DurationAPIMS = %d, want 988", result.DurationAPIMS)
+		}
+		if result.NumTurns != 2 || result.SessionID != "s1" || result.Result == nil || *result.Result != "done" {
+			t.Errorf("Unexpected result fields: %+v", result)
+		}
+	}
+}
+
+func TestAssistantBlockOrder(t *testing.T) {
+	line := `{"type":"assistant","message":{"role":"assistant","content":[` +
+		`{"type":"thinking","thinking":"Check the module first.","signature":"sig_1"},` +
+		`{"type":"text","text":"First I'll read the file."},` +
+		`{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"go.mod"}},` +
+		`{"type":"text","text":"Then run the tests."},` +
+		`{"type":"server_event","name":"checkpoint"},` +
+		`{"type":"tool_use","id":"toolu_2","name":"Bash","input":{"command":"go test ./..."}},` +
+		`{"type":"text","text":"Done."}]}}`
+	want := []string{"thinking", "text:First I'll read the file.", "tool_use:toolu_1", "text:Then run the tests.", "server_event", "tool_use:toolu_2", "text:Done."}
+
+	order := func(msg Message) []string {
+		var got []string
+		for _, block := range msg.(*AssistantMessage).Content {
+			switch {
+			case block.Tool != nil:
+				got = append(got, "tool_use:"+block.Tool.ID)
+			case block.Text != nil:
+				got = append(got, "text:"+*block.Text)
+			default:
+				got = append(got, block.Type)
+			}
+		}
+		return got
+	}
+
+	var data map[string]any
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		t.Fatalf("Failed to decode envelope: %v", err)
+	}
+	fromMap, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	fromJSON, err := ParseMessageJSON([]byte(line))
+	if err != nil {
+		t.Fatalf("ParseMessageJSON failed: %v", err)
+	}
+
+	raw, err := fromMap.ToRawMessage()
+	if err != nil {
+		t.Fatalf("ToRawMessage failed: %v", err)
+	}
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		t.Fatalf("Failed to marshal raw message: %v", err)
+	}
+	roundTripped, err := ParseMessageJSON(encoded)
+	if err != nil {
+		t.Fatalf("ParseMessageJSON of re-serialized message failed: %v", err)
+	}
+
+	for name, msg := range map[string]Message{"ParseMessage": fromMap, "ParseMessageJSON": fromJSON, "RoundTrip": roundTripped} {
+		if got := order(msg); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: block order = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// TestParseMessageVersion tests that a result is parsed according to the
+// field names of the selected protocol version
+func TestParseMessageVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version ProtocolVersion
+		raw     string
+	}{
+		{
+			name:    "Current",
+			version: ProtocolCurrent,
+			raw:     `{"type":"result","subtype":"success","session_id":"s1","total_cost_usd":0.25}`,
+		},
+		{
+			name:    "Legacy",
+			version: ProtocolLegacy,
+			raw:     `{"type":"result","subtype":"success","session_id":"s1","total_cost":0.25}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data map[string]any
+			if err := json.Unmarshal([]byte(tt.raw), &data); err != nil {
+				t.Fatalf("Failed to decode message: %v", err)
+			}
+
+			msg, err := ParseMessageVersion(data, tt.version)
+			if err != nil {
+				t.Fatalf("ParseMessageVersion failed: %v", err)
+			}
+			result := msg.(*ResultMessage)
+			if result.TotalCostUSD == nil || *result.TotalCostUSD != 0.25 {
+				t.Errorf("TotalCostUSD = %v, want 0.25", result.TotalCostUSD)
+			}
+		})
+	}
+
+	var legacy map[string]any
+	if err := json.Unmarshal([]byte(tests[1].raw), &legacy); err != nil {
+		t.Fatalf("Failed to decode message: %v", err)
+	}
+	msg, err := ParseMessage(legacy)
+	if err != nil {
+		t.Fatalf("ParseMessage failed: %v", err)
+	}
+	if cost := msg.(*ResultMessage).TotalCostUSD; cost != nil {
+		t.Errorf("Expected the legacy field to be ignored by the current protocol, got %v", *cost)
+	}
+
+	if _, err := ParseMessageVersion(legacy, ProtocolVersion(99)); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage for an unknown version, got %v", err)
+	}
+
+	c, err := New(
+		WithCLIPath(writeFakeCLI(t, "echo '"+tests[1].raw+"'")),
+		WithProtocolVersion(ProtocolLegacy),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+	messages, err := c.Query(context.Background(), "Hello")
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Query failed: messages=%v err=%v", messages, err)
+	}
+	if cost := messages[0].(*ResultMessage).TotalCostUSD; cost == nil || *cost != 0.25 {
+		t.Errorf("Expected the client's protocol version to be used, got %v", cost)
+	}
+}
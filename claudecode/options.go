@@ -1,9 +1,14 @@
 package claudecode
 
 import (
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 )
 
 // PermissionMode controls how tool execution permissions are handled
@@ -17,6 +22,36 @@ const (
 	PermissionModeAcceptEdits PermissionMode = "acceptEdits"
 )
 
+// OutputStyle selects the CLI's output style. Custom styles defined in the
+// user or project settings can be used by name.
+type OutputStyle string
+
+const (
+	// OutputStyleDefault is the standard software engineering style
+	OutputStyleDefault OutputStyle = "default"
+
+	// OutputStyleExplanatory adds educational insights while working
+	OutputStyleExplanatory OutputStyle = "Explanatory"
+
+	// OutputStyleLearning asks the user to contribute code while working
+	OutputStyleLearning OutputStyle = "Learning"
+)
+
+// TransportMode identifies how the CLI receives its prompt
+type TransportMode string
+
+const (
+	// TransportModeStreaming reads stream-json messages from stdin
+	TransportModeStreaming TransportMode = "streaming"
+
+	// TransportModeOneShot passes a single prompt on the command line
+	TransportModeOneShot TransportMode = "oneshot"
+)
+
+// CommandBuilder builds the full argv, including the executable, used to start
+// the CLI. The prompt is empty in streaming mode.
+type CommandBuilder func(opts *Options, mode TransportMode, prompt string) ([]string, error)
+
 // MCPServerType represents the type of MCP server
 type MCPServerType string
 
@@ -26,7 +61,11 @@ const (
 	MCPServerTypeHTTP  MCPServerType = "http"
 )
 
-// MCPServer represents an MCP server configuration
+// MCPServer represents an MCP server configuration. The CLI connects to SSE
+// and HTTP servers itself, and its MCP config has no per-server proxy or TLS
+// settings; those connections use the CLI's process-wide configuration, such
+// as HTTPS_PROXY, NODE_EXTRA_CA_CERTS, and CLAUDE_CODE_CLIENT_CERT, which can
+// be set with WithEnv.
 type MCPServer struct {
 	Type    MCPServerType     `json:"type"`
 	Command string            `json:"command,omitempty"`
@@ -44,9 +83,17 @@ type Options struct {
 	// AppendSystemPrompt appends to the existing system prompt
 	AppendSystemPrompt string
 
+	// ResponseLanguage is the language Claude is instructed to respond in,
+	// appended to the system prompt after AppendSystemPrompt
+	ResponseLanguage string
+
 	// Model specifies which Claude model to use
 	Model string
 
+	// ModelRouter picks the model for queries tagged with a task hint,
+	// overriding Model
+	ModelRouter func(taskHint string) string
+
 	// MaxTurns limits the number of conversation turns
 	MaxTurns int
 
@@ -62,9 +109,26 @@ type Options struct {
 	// AllowedTools lists tools that can be used
 	AllowedTools []string
 
+	// ToolPreset adds a common set of tools to AllowedTools
+	ToolPreset ToolPreset
+
+	// AllowedToolsFunc computes the allowed tools for each query's prompt,
+	// overriding AllowedTools
+	AllowedToolsFunc func(prompt string) []string
+
 	// DisallowedTools lists tools that cannot be used
 	DisallowedTools []string
 
+	// ProtocolVersion selects the message schema of the installed CLI
+	ProtocolVersion ProtocolVersion
+
+	// StrictParsing ends the stream on messages that fail to parse instead
+	// of skipping them
+	StrictParsing bool
+
+	// DenyByDefault limits the CLI's built-in tools to those in AllowedTools
+	DenyByDefault bool
+
 	// MCPTools lists MCP tools that can be used
 	MCPTools []string
 
@@ -74,23 +138,189 @@ type Options struct {
 	// MCPServers configures Model Context Protocol servers
 	MCPServers map[string]MCPServer
 
+	// MCPConfigFile is the path to an MCP config file. Servers in MCPServers
+	// override servers of the same name in the file.
+	MCPConfigFile string
+
+	// StrictMCPConfig makes the CLI ignore MCP servers from other sources,
+	// such as the user and project configs
+	StrictMCPConfig bool
+
+	// RequiredMCPServers lists MCP servers that must report a connected
+	// status in the CLI's init message for Connect to succeed
+	RequiredMCPServers []string
+
+	// InitTimeout is how long Connect waits for the init message when
+	// RequiredMCPServers is set. Zero uses the default of 60 seconds.
+	InitTimeout time.Duration
+
 	// Continue continues a previous conversation
 	Continue bool
 
 	// Resume resumes from a specific conversation ID
 	Resume string
 
+	// ContinueOrNew continues the most recent conversation in the working
+	// directory if there is one, and starts a new one otherwise
+	ContinueOrNew bool
+
 	// Settings path to a settings file
 	Settings string
 
+	// OutputStyle selects the output style through the generated settings JSON
+	OutputStyle OutputStyle
+
+	// ModelOptions holds provider-specific model parameters, passed through
+	// the generated settings JSON under "modelOptions"
+	ModelOptions map[string]any
+
+	// SettingsDisabledTools lists tools denied through the generated settings
+	// JSON rather than the --disallowedTools flag
+	SettingsDisabledTools []string
+
 	// AddDirs adds directories to the context
 	AddDirs []string
 
+	// AutoAddWorkingDir adds the working directory to AddDirs when the
+	// command is built, unless it is already listed
+	AutoAddWorkingDir bool
+
+	// AddDirGlobs are glob patterns whose matching directories are added to
+	// AddDirs when the options are validated
+	AddDirGlobs []string
+
 	// Logger for structured logging
 	Logger *slog.Logger
 
+	// MaxToolUsesPerTurn limits the number of tool uses in a single turn
+	MaxToolUsesPerTurn int
+
+	// AbortOnToolError stops a run as soon as any tool reports an error
+	AbortOnToolError bool
+
+	// CostBudgetUSD is the spend in USD after which queries and sessions abort
+	CostBudgetUSD float64
+
+	// InterruptOnContextCancel interrupts the CLI and closes it gracefully when
+	// the context is cancelled instead of killing the process
+	InterruptOnContextCancel bool
+
+	// CancelGracePeriod is how long the CLI may take to stop after a context
+	// cancellation interrupts it. Zero uses the default of 2 seconds.
+	CancelGracePeriod time.Duration
+
+	// MessageEncoder overrides how outbound messages are serialized
+	MessageEncoder MessageEncoder
+
+	// SessionIDGenerator assigns session IDs to queries and sessions that
+	// are not given one
+	SessionIDGenerator func() string
+
+	// RequireGitRepo requires the working directory to be inside a git
+	// repository
+	RequireGitRepo bool
+
+	// CommandBuilder replaces the built-in CLI command construction
+	CommandBuilder CommandBuilder
+
+	// CommandObserver is called with the argv and environment of each CLI
+	// process just before it starts
+	CommandObserver func(argv []string, env []string)
+
+	// SummaryWriter receives a run summary for each result message
+	SummaryWriter io.Writer
+
+	// ResultFormatter renders result messages for the summary writer and
+	// ResultMessage.String
+	ResultFormatter func(*ResultMessage) string
+
+	// ProgressWriter receives a live status line derived from the messages
+	// of each run
+	ProgressWriter io.Writer
+
+	// AggregateDeltas requests partial messages from the CLI and coalesces
+	// their deltas into whole assistant messages
+	AggregateDeltas bool
+
+	// StdoutTee receives a copy of the raw CLI stdout
+	StdoutTee io.Writer
+
+	// MaxStderrLines is how many trailing lines of CLI stderr are kept for
+	// error reporting. Zero uses the default of 100.
+	MaxStderrLines int
+
+	// MaxMessageSizeLog is the message size in bytes above which received
+	// messages are logged for diagnosis
+	MaxMessageSizeLog int
+
+	// MaxMessageSize is the largest message in bytes read from the CLI;
+	// larger messages are skipped. Zero uses the default of 64 MB.
+	MaxMessageSize int
+
+	// PersistentProcess routes Query calls through one long-lived CLI process
+	PersistentProcess bool
+
+	// TimeFormat is the layout used when the SDK renders timestamps
+	TimeFormat string
+
+	// TimeZone is the location used when the SDK renders timestamps
+	TimeZone *time.Location
+
+	// HeartbeatInterval is how often a ping is sent to an idle streaming session
+	HeartbeatInterval time.Duration
+
+	// OnToolUse is called for each tool_use block as it is received
+	OnToolUse func(*ToolUse)
+
+	// OnToolResult is called for each tool_result block as it is received
+	OnToolResult func(*ToolResult)
+
+	// OnUsage is called with the token usage of each message that reports it
+	OnUsage func(Usage)
+
+	// OnControlResponse is called with each control response from the CLI
+	OnControlResponse func(ControlResponse)
+
+	// OnTurn is called with the current turn number as a run progresses
+	OnTurn func(turn int)
+
+	// ToolProviders are tools fulfilled by the SDK, by name
+	ToolProviders map[string]ToolProvider
+
+	// PermissionHandler decides whether the CLI may use a tool
+	PermissionHandler PermissionHandler
+
+	// CloseTimeout is how long Close waits for the CLI process to exit
+	// before killing it. Zero uses the default of 5 seconds.
+	CloseTimeout time.Duration
+
+	// EditFilter vetoes file edits the CLI asks permission for
+	EditFilter func(op EditOp) bool
+
+	// PermissionTimeout is how long the permission handler may take before
+	// the tool use is denied. Zero waits indefinitely.
+	PermissionTimeout time.Duration
+
+	// RetryPolicy decides whether a failed Query is retried
+	RetryPolicy RetryPolicy
+
 	// CLIPath overrides the default Claude CLI path
 	CLIPath string
+
+	// Env sets additional environment variables for the CLI process
+	Env map[string]string
+
+	// DisableTelemetry sets the environment variables that stop the CLI
+	// from sending telemetry and error reports
+	DisableTelemetry bool
+
+	// PrettyStdin indents JSON written to the CLI's stdin. For debugging only:
+	// the CLI expects one JSON object per line.
+	PrettyStdin bool
+
+	// EnvPassthrough restricts the inherited environment to the named variables.
+	// When nil, the full environment of the current process is inherited.
+	EnvPassthrough []string
 }
 
 // DefaultOptions returns Options with sensible defaults
@@ -99,6 +329,8 @@ func DefaultOptions() *Options {
 		MaxThinkingTokens: 8000,
 		PermissionMode:    PermissionModeDefault,
 		Logger:            slog.Default(),
+		TimeFormat:        time.RFC3339,
+		TimeZone:          time.UTC,
 	}
 }
 
@@ -112,6 +344,340 @@ func WithLogger(logger *slog.Logger) Option {
 	}
 }
 
+// WithMaxToolUsesPerTurn caps the number of tool_use blocks in a single turn,
+// where a turn ends with a ResultMessage. When the cap is exceeded, Query stops
+// the CLI and returns ErrToolLimitExceeded. QueryStream stops the CLI and ends
+// with an ErrorMessage of ErrorType "tool_limit_exceeded", and Stream yields
+// ErrToolLimitExceeded. Sessions interrupt the CLI, and Session.ReceiveOne
+// returns ErrToolLimitExceeded with the messages of the interrupted turn.
+func WithMaxToolUsesPerTurn(limit int) Option {
+	return func(o *Options) {
+		o.MaxToolUsesPerTurn = limit
+	}
+}
+
+// WithAbortOnToolError stops a run as soon as a tool_result reports an
+// error, rather than letting Claude carry on. Query stops the CLI and returns
+// a *ToolError, which matches ErrToolFailed, with the messages received so
+// far. QueryStream stops the CLI and ends with an ErrorMessage of ErrorType
+// "tool_failed", and Stream yields the *ToolError. Sessions interrupt the CLI,
+// and Session.ReceiveOne returns the *ToolError with the messages of the
+// interrupted turn.
+func WithAbortOnToolError(abort bool) Option {
+	return func(o *Options) {
+		o.AbortOnToolError = abort
+	}
+}
+
+// WithCostBudget aborts once spend exceeds usd, as reported by the
+// TotalCostUSD of results. Query returns ErrBudgetExceeded with its messages
+// when its result crosses the budget, and QueryStream follows the result with
+// a "budget_exceeded" ErrorMessage. Sessions track the cost across the
+// session, interrupt the CLI when it crosses the budget, and then return
+// ErrBudgetExceeded from ReceiveOne, ReceiveUntil, and Send.
+func WithCostBudget(usd float64) Option {
+	return func(o *Options) {
+		o.CostBudgetUSD = usd
+	}
+}
+
+// WithInterruptOnContextCancel changes what happens when the context passed to
+// Connect is cancelled. By default the CLI process is killed immediately. When
+// enabled, the SDK sends an interrupt, gives the CLI a short grace period to
+// stop, and then closes the transport.
+func WithInterruptOnContextCancel(enabled bool) Option {
+	return func(o *Options) {
+		o.InterruptOnContextCancel = enabled
+	}
+}
+
+// WithMessageEncoder overrides how outbound messages are serialized before
+// being written to the CLI's stdin. The default is EncodeMessage.
+func WithMessageEncoder(encoder MessageEncoder) Option {
+	return func(o *Options) {
+		o.MessageEncoder = encoder
+	}
+}
+
+// WithSessionIDGenerator assigns queries and sessions without an explicit
+// session ID one from generate, such as a UUID, instead of "default". This
+// keeps concurrent queries on a shared client from colliding. Streamed
+// queries and sessions send the ID with each message; one-shot queries pass
+// it to the CLI as --session-id when it is a UUID, which the CLI requires.
+func WithSessionIDGenerator(generate func() string) Option {
+	return func(o *Options) {
+		o.SessionIDGenerator = generate
+	}
+}
+
+// WithRequireGitRepo makes New, and queries with their own working
+// directory, fail with a NOT_GIT_REPO ClaudeError unless the working
+// directory is inside a git repository. It catches a common setup mistake
+// early for workflows whose tools assume a repository.
+func WithRequireGitRepo(require bool) Option {
+	return func(o *Options) {
+		o.RequireGitRepo = require
+	}
+}
+
+// WithCommandBuilder replaces the built-in command construction entirely.
+// The builder's argv is executed as-is, so it must include the executable and
+// every flag the wrapper needs, including the stream-json output format.
+func WithCommandBuilder(builder CommandBuilder) Option {
+	return func(o *Options) {
+		o.CommandBuilder = builder
+	}
+}
+
+// WithCommandObserver sets a callback invoked with the exact argv and
+// environment of each CLI process just before it starts, including any
+// per-query overrides. The values are passed unredacted; redacting secrets
+// before logging them is up to the observer.
+func WithCommandObserver(fn func(argv []string, env []string)) Option {
+	return func(o *Options) {
+		o.CommandObserver = fn
+	}
+}
+
+// WithSummaryWriter writes a summary of each run to w when its result message
+// arrives, covering the subtype, duration, turns, cost, and token usage.
+func WithSummaryWriter(w io.Writer) Option {
+	return func(o *Options) {
+		o.SummaryWriter = w
+	}
+}
+
+// WithResultFormatter sets how results are rendered, such as one JSON object
+// per line for a log pipeline. The formatter replaces the plain text summary
+// written by WithSummaryWriter and is used by ResultMessage.String for the
+// final results of queries and sessions.
+func WithResultFormatter(format func(*ResultMessage) string) Option {
+	return func(o *Options) {
+		o.ResultFormatter = format
+	}
+}
+
+// WithProgressWriter renders a single status line to w, such as "Reading
+// file…" or "Running command…", that is rewritten as messages arrive and
+// cleared when the run's result arrives. The line is redrawn with a carriage
+// return, so w should be a terminal.
+func WithProgressWriter(w io.Writer) Option {
+	return func(o *Options) {
+		o.ProgressWriter = w
+	}
+}
+
+// WithAggregateDeltas, when true, streams the response as partial messages
+// and coalesces their text and tool input deltas into a single assistant
+// message per API message, delivered when the message stops. Deltas are
+// never delivered, and the CLI's own copies of aggregated messages are
+// dropped.
+func WithAggregateDeltas(aggregate bool) Option {
+	return func(o *Options) {
+		o.AggregateDeltas = aggregate
+	}
+}
+
+// WithStdoutTee copies the CLI's stdout to w byte for byte, before the SDK
+// decodes it, for capturing the exact output in bug reports. Parsing is not
+// affected, but a slow writer delays message delivery.
+func WithStdoutTee(w io.Writer) Option {
+	return func(o *Options) {
+		o.StdoutTee = w
+	}
+}
+
+// WithMaxStderrLines sets how many trailing lines of CLI stderr are kept in
+// a ProcessError, such as to capture a full Node.js stack trace
+func WithMaxStderrLines(n int) Option {
+	return func(o *Options) {
+		o.MaxStderrLines = n
+	}
+}
+
+// WithMaxMessageSize sets the largest message in bytes read from the CLI.
+// A larger message is skipped with a warning rather than buffered without
+// bound.
+func WithMaxMessageSize(limit int) Option {
+	return func(o *Options) {
+		o.MaxMessageSize = limit
+	}
+}
+
+// WithMaxMessageSizeLog logs a warning with the type and leading bytes of any
+// message from the CLI larger than limit bytes. Messages are still delivered;
+// the log identifies unexpectedly large output such as huge tool results.
+func WithMaxMessageSizeLog(limit int) Option {
+	return func(o *Options) {
+		o.MaxMessageSizeLog = limit
+	}
+}
+
+// WithPersistentProcess keeps one streaming CLI process warm and runs Query
+// calls through it sequentially, avoiding a process start per query. The
+// conversation is cleared with the /clear command before each query after
+// the first, so queries do not see each other's context. The process is
+// restarted after a query fails or is cancelled, and is closed by
+// Client.Close. It has no effect when WithAllowedToolsFunc is set or for
+// queries using WithQueryWorkingDir, since those need their own process.
+func WithPersistentProcess(enabled bool) Option {
+	return func(o *Options) {
+		o.PersistentProcess = enabled
+	}
+}
+
+// WithTimeFormat sets the layout, as accepted by time.Format, used when the
+// SDK renders timestamps such as the completion time in run summaries. The
+// default is time.RFC3339.
+func WithTimeFormat(layout string) Option {
+	return func(o *Options) {
+		o.TimeFormat = layout
+	}
+}
+
+// WithTimeZone sets the location used when the SDK renders timestamps. The
+// default is UTC.
+func WithTimeZone(loc *time.Location) Option {
+	return func(o *Options) {
+		o.TimeZone = loc
+	}
+}
+
+// WithHeartbeat sends a ping control request every interval while a
+// streaming session is idle between turns. The request exists only to keep
+// long-lived connections warm: the CLI answers it with an error, which is
+// not passed to the control response callback. Pings are not sent while a
+// turn is in progress. Zero disables it.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(o *Options) {
+		o.HeartbeatInterval = interval
+	}
+}
+
+// WithOnToolUse sets a callback invoked for each tool_use block as messages
+// are received
+func WithOnToolUse(fn func(*ToolUse)) Option {
+	return func(o *Options) {
+		o.OnToolUse = fn
+	}
+}
+
+// WithTurnCallback calls fn with the current turn number each time a system
+// or result message reports a turn beyond the last, so a UI can show
+// progress such as "turn 3 of 10". Numbering starts over with each run.
+func WithTurnCallback(fn func(turn int)) Option {
+	return func(o *Options) {
+		o.OnTurn = fn
+	}
+}
+
+// WithToolProvider registers a tool that the SDK fulfills itself. The tool
+// is served to the CLI by an in-process MCP server, so Claude sees it as
+// mcp__sdk__<name>, and it is allowed without a permission prompt. When
+// Claude uses it, the SDK calls the provider and returns its output as the
+// tool result. Like WithPermissionHandler it only applies to sessions, which
+// keep stdin open for the exchange.
+func WithToolProvider(name string, provider ToolProvider) Option {
+	return func(o *Options) {
+		if o.ToolProviders == nil {
+			o.ToolProviders = make(map[string]ToolProvider)
+		}
+		o.ToolProviders[name] = provider
+	}
+}
+
+// WithPermissionHandler routes the CLI's tool permission prompts to handler,
+// which allows or denies each tool use. Permission prompts are answered over
+// stdin, so the handler only applies to sessions.
+func WithPermissionHandler(handler PermissionHandler) Option {
+	return func(o *Options) {
+		o.PermissionHandler = handler
+	}
+}
+
+// WithCancelGracePeriod sets how long the CLI may take to stop after
+// WithInterruptOnContextCancel interrupts it, before it is killed. It applies
+// only to cancellation, independently of WithCloseTimeout, since cancelling
+// usually means the caller wants the work to stop promptly.
+func WithCancelGracePeriod(grace time.Duration) Option {
+	return func(o *Options) {
+		o.CancelGracePeriod = grace
+	}
+}
+
+// WithCloseTimeout sets how long Close waits for the CLI process to finish
+// before killing it. Longer timeouts let a slow run flush its final output;
+// shorter ones keep Close responsive.
+func WithCloseTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.CloseTimeout = timeout
+	}
+}
+
+// WithEditFilter denies file edits for which filter returns false, such as
+// edits to protected paths, by answering the CLI's permission prompts. Edits
+// that pass the filter go on to the permission handler, if any, and are
+// otherwise allowed. Tools that do not edit files are left to the permission
+// handler and denied without one. Like WithPermissionHandler it only applies
+// to sessions.
+//
+// In PermissionModeAcceptEdits the CLI applies edits without asking, so the
+// filter cannot block them; rejected edits are logged as warnings instead.
+func WithEditFilter(filter func(op EditOp) bool) Option {
+	return func(o *Options) {
+		o.EditFilter = filter
+	}
+}
+
+// WithPermissionTimeout denies a tool use when the permission handler has not
+// answered within timeout, so that a stalled approval cannot leave the CLI
+// waiting forever. The handler's context is cancelled at the deadline.
+func WithPermissionTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.PermissionTimeout = timeout
+	}
+}
+
+// RetryPolicy decides whether to retry after err, the failure of the given
+// attempt (starting at 1), and how long to wait before the next attempt
+type RetryPolicy func(err error, attempt int) (retry bool, backoff time.Duration)
+
+// WithRetryPolicy retries a failed Query for as long as policy asks to, such
+// as when the CLI exits on an overloaded API. Without a policy, errors are
+// returned immediately. Streamed queries and sessions are not retried, since
+// their messages have already been delivered when an error occurs.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *Options) {
+		o.RetryPolicy = policy
+	}
+}
+
+// WithUsageCallback sets a callback invoked with the token usage of each
+// message that reports it, such as for a live token meter. Assistant messages
+// carry the usage of the API call that produced them, and the result carries
+// the totals for the run.
+func WithUsageCallback(fn func(Usage)) Option {
+	return func(o *Options) {
+		o.OnUsage = fn
+	}
+}
+
+// WithControlResponseCallback sets a callback invoked with each control
+// response from the CLI, such as the acknowledgment of an interrupt
+func WithControlResponseCallback(fn func(ControlResponse)) Option {
+	return func(o *Options) {
+		o.OnControlResponse = fn
+	}
+}
+
+// WithOnToolResult sets a callback invoked for each tool_result block as
+// messages are received
+func WithOnToolResult(fn func(*ToolResult)) Option {
+	return func(o *Options) {
+		o.OnToolResult = fn
+	}
+}
+
 // WithSystemPrompt sets the system prompt
 func WithSystemPrompt(prompt string) Option {
 	return func(o *Options) {
@@ -126,6 +692,15 @@ func WithModel(model string) Option {
 	}
 }
 
+// WithModelRouter picks the model for each query tagged with WithTaskHint,
+// such as "code", "chat", or "summarize". Returning "" keeps the client's
+// model. Untagged queries use the client's model.
+func WithModelRouter(router func(taskHint string) string) Option {
+	return func(o *Options) {
+		o.ModelRouter = router
+	}
+}
+
 // WithMaxTurns sets the maximum number of turns
 func WithMaxTurns(turns int) Option {
 	return func(o *Options) {
@@ -154,6 +729,26 @@ func WithAllowedTools(tools ...string) Option {
 	}
 }
 
+// WithToolPreset allows the tools of a preset such as PresetReadOnly, in
+// addition to any tools set with WithAllowedTools, so that common policies
+// are one option:
+//
+//	WithToolPreset(PresetReadOnly), WithAllowedTools("Bash(git log *)")
+func WithToolPreset(preset ToolPreset) Option {
+	return func(o *Options) {
+		o.ToolPreset = preset
+	}
+}
+
+// WithAllowedToolsFunc computes the allowed tools from the prompt of each
+// Query or QueryStream call. The result overrides the static allowed tools for
+// that query only.
+func WithAllowedToolsFunc(fn func(prompt string) []string) Option {
+	return func(o *Options) {
+		o.AllowedToolsFunc = fn
+	}
+}
+
 // WithDisallowedTools sets the disallowed tools
 func WithDisallowedTools(tools ...string) Option {
 	return func(o *Options) {
@@ -161,6 +756,40 @@ func WithDisallowedTools(tools ...string) Option {
 	}
 }
 
+// WithDenyByDefault, when true, makes only the built-in tools named in the
+// allowed tools available to Claude; with no allowed tools, all built-in
+// tools are disabled. Rules such as "Bash(git *)" make their tool available
+// and still restrict it as usual.
+//
+// MCP tools are discovered at runtime and cannot be enumerated up front, so
+// they are not covered: limit them with WithMCPTools or WithStrictMCPConfig.
+func WithDenyByDefault(deny bool) Option {
+	return func(o *Options) {
+		o.DenyByDefault = deny
+	}
+}
+
+// WithProtocolVersion parses the CLI's messages using the schema of the
+// given protocol version, for pinning the SDK to an installed CLI whose
+// output predates or follows the SDK's default. The zero value,
+// ProtocolCurrent, matches current CLI releases.
+func WithProtocolVersion(version ProtocolVersion) Option {
+	return func(o *Options) {
+		o.ProtocolVersion = version
+	}
+}
+
+// WithStrictParsing, when true, treats a message that fails to parse, such
+// as one of an unknown type, as fatal rather than logging and skipping it.
+// Query returns the parse error; streams deliver an ErrorMessage with
+// ErrorType "parse_error" carrying the raw message in Data, then close. This
+// catches schema drift in the CLI's output early, for example in CI.
+func WithStrictParsing(strict bool) Option {
+	return func(o *Options) {
+		o.StrictParsing = strict
+	}
+}
+
 // WithCLIPath sets a custom CLI path
 func WithCLIPath(path string) Option {
 	return func(o *Options) {
@@ -178,6 +807,42 @@ func WithMCPServer(name string, server MCPServer) Option {
 	}
 }
 
+// WithMCPConfigFile loads MCP servers from a config file. When combined with
+// WithMCPServer, the file and inline servers are merged into a single
+// --mcp-config and inline servers override file servers of the same name.
+func WithMCPConfigFile(path string) Option {
+	return func(o *Options) {
+		o.MCPConfigFile = path
+	}
+}
+
+// WithStrictMCPConfig limits the CLI to the MCP servers configured through
+// WithMCPServer and WithMCPConfigFile
+func WithStrictMCPConfig() Option {
+	return func(o *Options) {
+		o.StrictMCPConfig = true
+	}
+}
+
+// WithRequiredMCPServers makes Connect wait for the CLI's init message and fail
+// if any of the named MCP servers did not start. The CLI only emits the init
+// message once it has a prompt, so interactive sessions should be combined
+// with WithInitialPrompt.
+func WithRequiredMCPServers(names ...string) Option {
+	return func(o *Options) {
+		o.RequiredMCPServers = append(o.RequiredMCPServers, names...)
+	}
+}
+
+// WithInitTimeout sets how long Connect waits for the CLI's init message when
+// required MCP servers are set, independently of the caller's context. The
+// process is killed and Connect fails once it expires.
+func WithInitTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.InitTimeout = timeout
+	}
+}
+
 // WithAddDirs adds directories to the context
 func WithAddDirs(dirs ...string) Option {
 	return func(o *Options) {
@@ -185,10 +850,46 @@ func WithAddDirs(dirs ...string) Option {
 	}
 }
 
-// WithAppendSystemPrompt appends to the system prompt
+// WithAutoAddWorkingDir adds the working directory, or the current directory
+// if none is set, to the context directories passed to the CLI. A directory
+// already listed with WithAddDirs is not added twice.
+func WithAutoAddWorkingDir(auto bool) Option {
+	return func(o *Options) {
+		o.AutoAddWorkingDir = auto
+	}
+}
+
+// WithAddDirGlob adds every directory matching pattern to the context, such as
+// "packages/*" in a monorepo. The pattern uses filepath.Match syntax and is
+// expanded when the client is created; files are ignored, and a pattern that
+// matches no directories is logged as a warning.
+func WithAddDirGlob(pattern string) Option {
+	return func(o *Options) {
+		o.AddDirGlobs = append(o.AddDirGlobs, pattern)
+	}
+}
+
+// WithAppendSystemPrompt appends to the system prompt. Repeated calls add
+// layers in order, separated by a blank line.
 func WithAppendSystemPrompt(prompt string) Option {
 	return func(o *Options) {
-		o.AppendSystemPrompt = prompt
+		if prompt == "" {
+			return
+		}
+		if o.AppendSystemPrompt != "" {
+			o.AppendSystemPrompt += "\n\n"
+		}
+		o.AppendSystemPrompt += prompt
+	}
+}
+
+// WithResponseLanguage instructs Claude to respond in language, such as
+// "Japanese" or "German", regardless of the prompt's language. The
+// instruction is appended to the system prompt after any layers added with
+// WithAppendSystemPrompt.
+func WithResponseLanguage(language string) Option {
+	return func(o *Options) {
+		o.ResponseLanguage = language
 	}
 }
 
@@ -227,6 +928,15 @@ func WithResume(conversationID string) Option {
 	}
 }
 
+// WithContinueOrNew continues the most recent conversation in the working
+// directory, or starts a fresh one if the directory has none. It cannot be
+// combined with WithResume.
+func WithContinueOrNew(continueOrNew bool) Option {
+	return func(o *Options) {
+		o.ContinueOrNew = continueOrNew
+	}
+}
+
 // WithSettings sets the path to a settings file
 func WithSettings(path string) Option {
 	return func(o *Options) {
@@ -234,25 +944,182 @@ func WithSettings(path string) Option {
 	}
 }
 
+// WithEnv sets an additional environment variable for the CLI process
+func WithEnv(key, value string) Option {
+	return func(o *Options) {
+		if o.Env == nil {
+			o.Env = make(map[string]string)
+		}
+		o.Env[key] = value
+	}
+}
+
+// WithDisableTelemetry stops the CLI from sending usage telemetry and error
+// reports by setting DISABLE_TELEMETRY and DISABLE_ERROR_REPORTING on the CLI
+// process. These take precedence over the same variables set with WithEnv.
+func WithDisableTelemetry(disable bool) Option {
+	return func(o *Options) {
+		o.DisableTelemetry = disable
+	}
+}
+
+// WithEnvPassthrough inherits only the named variables from the current
+// environment instead of the full environment. Variables set with WithEnv
+// are always passed to the CLI process.
+func WithEnvPassthrough(names ...string) Option {
+	return func(o *Options) {
+		if o.EnvPassthrough == nil {
+			o.EnvPassthrough = []string{}
+		}
+		o.EnvPassthrough = append(o.EnvPassthrough, names...)
+	}
+}
+
+// WithPrettyStdin indents the JSON written to the CLI's stdin so that process
+// traces are easier to read. This is intended for debugging only; the CLI
+// expects newline-delimited JSON and may reject indented input.
+func WithPrettyStdin(pretty bool) Option {
+	return func(o *Options) {
+		o.PrettyStdin = pretty
+	}
+}
+
+// WithOutputStyle sets the CLI's output style. The CLI has no flag for output
+// styles, so the style is written to the settings JSON passed to the CLI.
+// Names other than the built-in styles are passed through for custom styles.
+func WithOutputStyle(style OutputStyle) Option {
+	return func(o *Options) {
+		o.OutputStyle = style
+	}
+}
+
+// WithModelOption sets a provider-specific model parameter. Options
+// accumulate across calls and are written to the settings JSON passed to the
+// CLI under "modelOptions", so parameters the SDK does not model can still
+// reach a provider or wrapper that reads them.
+func WithModelOption(key string, value any) Option {
+	return func(o *Options) {
+		if o.ModelOptions == nil {
+			o.ModelOptions = make(map[string]any)
+		}
+		o.ModelOptions[key] = value
+	}
+}
+
+// WithSettingsDisabledTools denies tools through the settings JSON passed to
+// the CLI instead of the --disallowedTools flag. Settings-level rules also
+// apply to sub-agents, while the flag only applies to the main session. The
+// tools are merged into the permissions.deny list of any file given with
+// WithSettings.
+func WithSettingsDisabledTools(tools ...string) Option {
+	return func(o *Options) {
+		o.SettingsDisabledTools = append(o.SettingsDisabledTools, tools...)
+	}
+}
+
 // QueryOption modifies a query
 type QueryOption func(*queryOptions)
 
 type queryOptions struct {
-	sessionID string
+	sessionID  string
+	requestID  string
+	resultOnly bool
+	onResult   func(*ResultMessage)
+	workingDir string
+	taskHint   string
+	stream     *StreamResult
+
+	// promptOnStdin writes a one-shot query's prompt to stdin instead of
+	// passing it on the command line
+	promptOnStdin bool
+
+	// generatedID reports that sessionID came from the SessionIDGenerator
+	generatedID bool
 }
 
-// WithSessionID sets the session ID for a query
+// withPromptOnStdin writes the prompt of a one-shot query to the CLI's stdin
+func withPromptOnStdin() QueryOption {
+	return func(o *queryOptions) {
+		o.promptOnStdin = true
+	}
+}
+
+// WithSessionID sets the session ID for a query, taking precedence over the
+// client's session ID generator. It is sent with each message of streamed
+// queries; one-shot queries do not pass it to the CLI.
 func WithSessionID(id string) QueryOption {
 	return func(o *queryOptions) {
 		o.sessionID = id
 	}
 }
 
+// WithQueryWorkingDir runs the query's CLI process in dir instead of the
+// client's working directory. The directory must exist.
+func WithQueryWorkingDir(dir string) QueryOption {
+	return func(o *queryOptions) {
+		o.workingDir = dir
+	}
+}
+
+// WithTaskHint tags the query with the kind of task it performs, which the
+// client's model router uses to pick the model
+func WithTaskHint(hint string) QueryOption {
+	return func(o *queryOptions) {
+		o.taskHint = hint
+	}
+}
+
+// WithRequestID tags every log record produced for the query with the given
+// request ID under the "request_id" key, for tracing a single query across
+// logs and telemetry
+func WithRequestID(id string) QueryOption {
+	return func(o *queryOptions) {
+		o.requestID = id
+	}
+}
+
+// ResultOnly makes Query return only the ResultMessage. Intermediate messages
+// are skipped, and are not parsed unless WithMaxToolUsesPerTurn or
+// WithAbortOnToolError must inspect them, which reduces overhead for batch
+// workloads that only need the final answer.
+func ResultOnly() QueryOption {
+	return func(o *queryOptions) {
+		o.resultOnly = true
+	}
+}
+
+// WithGracefulResultWait guarantees that the ResultMessage, which carries cost
+// and usage, is passed to onResult. If the QueryStream consumer cancels its
+// context before the result arrives, the stream is drained internally until
+// the result is received; the CLI process is not killed by that cancellation.
+// The result also reaches onResult if the consumer stops receiving without
+// cancelling; the messages it did not receive are held until ctx is done.
+func WithGracefulResultWait(onResult func(*ResultMessage)) QueryOption {
+	return func(o *queryOptions) {
+		o.onResult = onResult
+	}
+}
+
+// WithStreamResult records the output of a QueryStream or Stream query in r
+// as messages are received from the CLI, including a message still awaiting
+// delivery when the consumer stops, so that the text produced before a
+// cancellation can be read with r.PartialText once the stream has closed
+func WithStreamResult(r *StreamResult) QueryOption {
+	return func(o *queryOptions) {
+		o.stream = r
+	}
+}
+
 // SessionOption modifies a session
 type SessionOption func(*sessionOptions)
 
 type sessionOptions struct {
-	initialPrompt string
+	initialPrompt   string
+	transcript      bool
+	allowedTools    []string
+	restoreState    *SessionState
+	resume          string
+	contextMessages []string
 }
 
 // WithInitialPrompt sets an initial prompt for the session
@@ -262,8 +1129,156 @@ func WithInitialPrompt(prompt string) SessionOption {
 	}
 }
 
-// validate checks if the options are valid
-func (o *Options) validate() error {
+// WithResumeContext resumes the conversation with the given session ID and
+// sends the context messages, in order, before the initial prompt or any
+// message sent on the session. Use it to supply fresh context, such as
+// updated file contents, to a resumed conversation.
+func WithResumeContext(sessionID string, messages ...string) SessionOption {
+	return func(o *sessionOptions) {
+		o.resume = sessionID
+		o.contextMessages = append(o.contextMessages, messages...)
+	}
+}
+
+// WithSessionAllowedTools overrides the client's allowed tools for this
+// session only
+func WithSessionAllowedTools(tools ...string) SessionOption {
+	return func(o *sessionOptions) {
+		o.allowedTools = append([]string{}, tools...)
+	}
+}
+
+// withRestoreState resumes the session described by state
+func withRestoreState(state *SessionState) SessionOption {
+	return func(o *sessionOptions) {
+		o.restoreState = state
+	}
+}
+
+// WithTranscript records the session's messages as a markdown transcript,
+// available from Session.Transcript
+func WithTranscript() SessionOption {
+	return func(o *sessionOptions) {
+		o.transcript = true
+	}
+}
+
+// encodeMessage serializes an outbound message with the configured encoder
+func (o *Options) encodeMessage(msg Message, meta MessageMeta) (map[string]any, error) {
+	if o.MessageEncoder != nil {
+		return o.MessageEncoder(msg, meta)
+	}
+	return EncodeMessage(msg, meta)
+}
+
+// defaultSessionID is the session ID of queries and sessions that were not
+// given one when no SessionIDGenerator is set
+const defaultSessionID = "default"
+
+// newSessionID returns the session ID for a query or session that was not
+// given one
+func (o *Options) newSessionID() string {
+	if o.SessionIDGenerator != nil {
+		return o.SessionIDGenerator()
+	}
+	return defaultSessionID
+}
+
+// isUUID reports whether s is a UUID in its canonical hyphenated form
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// appendedSystemPrompt returns the text appended to the system prompt,
+// including the response language instruction
+func (o *Options) appendedSystemPrompt() string {
+	if o.ResponseLanguage == "" {
+		return o.AppendSystemPrompt
+	}
+
+	instruction := fmt.Sprintf("Always respond in %s, regardless of the language of the user's messages.", o.ResponseLanguage)
+	if o.AppendSystemPrompt == "" {
+		return instruction
+	}
+	return o.AppendSystemPrompt + "\n\n" + instruction
+}
+
+// formatTime renders t using the configured time format and zone
+func (o *Options) formatTime(t time.Time) string {
+	layout := o.TimeFormat
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	loc := o.TimeZone
+	if loc == nil {
+		loc = time.UTC
+	}
+	return t.In(loc).Format(layout)
+}
+
+// clone returns a copy of the options that can be modified without affecting
+// the original
+func (o *Options) clone() *Options {
+	c := *o
+	c.AllowedTools = append([]string(nil), o.AllowedTools...)
+	c.DisallowedTools = append([]string(nil), o.DisallowedTools...)
+	c.MCPTools = append([]string(nil), o.MCPTools...)
+	c.RequiredMCPServers = append([]string(nil), o.RequiredMCPServers...)
+	c.AddDirs = append([]string(nil), o.AddDirs...)
+	c.AddDirGlobs = append([]string(nil), o.AddDirGlobs...)
+	c.SettingsDisabledTools = append([]string(nil), o.SettingsDisabledTools...)
+	if o.EnvPassthrough != nil {
+		c.EnvPassthrough = append([]string{}, o.EnvPassthrough...)
+	}
+
+	if o.MCPServers != nil {
+		c.MCPServers = make(map[string]MCPServer, len(o.MCPServers))
+		for name, server := range o.MCPServers {
+			c.MCPServers[name] = server
+		}
+	}
+	if o.ToolProviders != nil {
+		c.ToolProviders = make(map[string]ToolProvider, len(o.ToolProviders))
+		for name, provider := range o.ToolProviders {
+			c.ToolProviders[name] = provider
+		}
+	}
+	if o.Env != nil {
+		c.Env = make(map[string]string, len(o.Env))
+		for key, value := range o.Env {
+			c.Env[key] = value
+		}
+	}
+	if o.ModelOptions != nil {
+		c.ModelOptions = make(map[string]any, len(o.ModelOptions))
+		for key, value := range o.ModelOptions {
+			c.ModelOptions[key] = value
+		}
+	}
+
+	return &c
+}
+
+// Validate checks if the options are valid, returning a ClaudeError with code
+// INVALID_OPTIONS if not. New calls it, so it only needs to be called directly
+// to check Options before creating a client. Validate also expands AddDirGlobs
+// into AddDirs.
+func (o *Options) Validate() error {
 	if o.WorkingDirectory != "" {
 		if _, err := os.Stat(o.WorkingDirectory); err != nil {
 			return &ClaudeError{
@@ -274,8 +1289,39 @@ func (o *Options) validate() error {
 		}
 	}
 
+	if o.Resume != "" && (o.Continue || o.ContinueOrNew) {
+		return &ClaudeError{
+			Code:    "INVALID_OPTIONS",
+			Message: "resume cannot be combined with continue",
+		}
+	}
+
+	if _, ok := protocolRenames[o.ProtocolVersion]; !ok {
+		return &ClaudeError{
+			Code:    "INVALID_OPTIONS",
+			Message: fmt.Sprintf("unknown protocol version: %d", o.ProtocolVersion),
+		}
+	}
+
+	if o.RequireGitRepo {
+		if err := requireGitRepo(o.WorkingDirectory); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := presetTools[o.ToolPreset]; o.ToolPreset != "" && !ok {
+		return &ClaudeError{
+			Code:    "INVALID_OPTIONS",
+			Message: "unknown tool preset: " + string(o.ToolPreset),
+		}
+	}
+
+	if err := o.expandAddDirGlobs(); err != nil {
+		return err
+	}
+
 	for _, dir := range o.AddDirs {
-		absPath, err := filepath.Abs(dir)
+		absPath, err := filepath.Abs(o.resolveDir(dir))
 		if err != nil {
 			return &ClaudeError{
 				Code:    "INVALID_OPTIONS",
@@ -294,3 +1340,126 @@ func (o *Options) validate() error {
 
 	return nil
 }
+
+// requireGitRepo returns a NOT_GIT_REPO error unless dir, or the current
+// directory if dir is empty, is inside a git repository
+func requireGitRepo(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return &ClaudeError{
+			Code:    "INVALID_OPTIONS",
+			Message: "invalid working directory path",
+			Err:     err,
+		}
+	}
+
+	// A worktree or submodule has a .git file rather than a directory
+	for d := absDir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return nil
+		}
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	return &ClaudeError{
+		Code:    "NOT_GIT_REPO",
+		Message: "working directory is not inside a git repository: " + absDir,
+	}
+}
+
+// builtinTools returns the names of the built-in tools referenced by the
+// allowed tools, without permission rule patterns or MCP tools
+func (o *Options) builtinTools() []string {
+	var tools []string
+	seen := make(map[string]bool)
+	for _, tool := range o.allowedTools() {
+		name, _, _ := strings.Cut(tool, "(")
+		name = strings.TrimSpace(name)
+		if name == "" || strings.HasPrefix(name, "mcp__") || seen[name] {
+			continue
+		}
+		seen[name] = true
+		tools = append(tools, name)
+	}
+	return tools
+}
+
+// addDirs returns the directories passed to the CLI with --add-dir,
+// including the working directory when AutoAddWorkingDir is set
+func (o *Options) addDirs() []string {
+	if !o.AutoAddWorkingDir {
+		return o.AddDirs
+	}
+
+	workingDir, err := filepath.Abs(o.WorkingDirectory)
+	if err != nil {
+		return o.AddDirs
+	}
+	for _, dir := range o.AddDirs {
+		if absDir, err := filepath.Abs(o.resolveDir(dir)); err == nil && absDir == workingDir {
+			return o.AddDirs
+		}
+	}
+	return append(slices.Clip(o.AddDirs), workingDir)
+}
+
+// resolveDir returns dir joined to the working directory when it is relative,
+// since the CLI resolves relative directories against its working directory
+func (o *Options) resolveDir(dir string) string {
+	if filepath.IsAbs(dir) || o.WorkingDirectory == "" {
+		return dir
+	}
+	return filepath.Join(o.WorkingDirectory, dir)
+}
+
+// expandAddDirGlobs appends the directories matching AddDirGlobs to AddDirs,
+// skipping directories that are already present
+func (o *Options) expandAddDirGlobs() error {
+	seen := make(map[string]bool, len(o.AddDirs))
+	for _, dir := range o.AddDirs {
+		seen[dir] = true
+	}
+
+	for _, pattern := range o.AddDirGlobs {
+		// Relative patterns name directories under the CLI's working
+		// directory, not the caller's
+		if !filepath.IsAbs(pattern) && o.WorkingDirectory != "" {
+			pattern = filepath.Join(o.WorkingDirectory, pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return &ClaudeError{
+				Code:    "INVALID_OPTIONS",
+				Message: "invalid add directory pattern: " + pattern,
+				Err:     err,
+			}
+		}
+
+		found := 0
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || !info.IsDir() {
+				continue
+			}
+			found++
+			if !seen[match] {
+				seen[match] = true
+				o.AddDirs = append(o.AddDirs, match)
+			}
+		}
+
+		if found == 0 {
+			logger := o.Logger
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.Warn("add directory pattern matched no directories", "pattern", pattern)
+		}
+	}
+
+	return nil
+}
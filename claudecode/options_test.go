@@ -1,8 +1,14 @@
 package claudecode
 
 import (
+	"bytes"
+	"errors"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -58,3 +64,364 @@ func TestOptionsComplete(t *testing.T) {
 		t.Errorf("Resume not set correctly")
 	}
 }
+
+func TestAppendSystemPromptLayers(t *testing.T) {
+	opts := DefaultOptions()
+	WithAppendSystemPrompt("You are a Go reviewer.")(opts)
+	WithAppendSystemPrompt("Focus on error handling.")(opts)
+
+	want := "You are a Go reviewer.\n\nFocus on error handling."
+	if opts.AppendSystemPrompt != want {
+		t.Errorf("AppendSystemPrompt = %q, want %q", opts.AppendSystemPrompt, want)
+	}
+
+	transport := NewOneShotTransport(opts, "test")
+	WithCLIPath(writeFakeCLI(t, ""))(opts)
+	args, err := transport.buildCommand()
+	if err != nil {
+		t.Fatalf("buildCommand failed: %v", err)
+	}
+	for i, arg := range args {
+		if arg == "--append-system-prompt" {
+			if i+1 >= len(args) || args[i+1] != want {
+				t.Errorf("Expected --append-system-prompt %q, got %v", want, args)
+			}
+			return
+		}
+	}
+	t.Error("Expected --append-system-prompt flag")
+}
+
+func TestResponseLanguage(t *testing.T) {
+	instruction := "Always respond in Japanese, regardless of the language of the user's messages."
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "Alone",
+			opts: []Option{WithResponseLanguage("Japanese")},
+			want: instruction,
+		},
+		{
+			name: "WithAppend",
+			opts: []Option{
+				WithResponseLanguage("Japanese"),
+				WithAppendSystemPrompt("You are a Go reviewer."),
+			},
+			want: "You are a Go reviewer.\n\n" + instruction,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			WithCLIPath(writeFakeCLI(t, ""))(opts)
+			for _, opt := range tt.opts {
+				opt(opts)
+			}
+
+			args, err := NewOneShotTransport(opts, "test").buildCommand()
+			if err != nil {
+				t.Fatalf("buildCommand failed: %v", err)
+			}
+			for i, arg := range args {
+				if arg == "--append-system-prompt" {
+					if i+1 >= len(args) || args[i+1] != tt.want {
+						t.Errorf("Expected --append-system-prompt %q, got %v", tt.want, args)
+					}
+					return
+				}
+			}
+			t.Error("Expected --append-system-prompt flag")
+		})
+	}
+}
+
+func TestAddDirGlob(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"packages/api", "packages/web", "tools/lint"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("Failed to create %s: %v", dir, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "packages", "README.md"), nil, 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	var logs bytes.Buffer
+	c, err := New(
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithAddDirs(filepath.Join(root, "packages", "web")),
+		WithAddDirGlob(filepath.Join(root, "packages", "*")),
+		WithAddDirGlob(filepath.Join(root, "services", "*")),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	want := []string{
+		filepath.Join(root, "packages", "web"),
+		filepath.Join(root, "packages", "api"),
+	}
+	if got := c.(*client).options.AddDirs; !reflect.DeepEqual(got, want) {
+		t.Errorf("AddDirs = %v, want %v", got, want)
+	}
+	if !strings.Contains(logs.String(), "matched no directories") || !strings.Contains(logs.String(), "services") {
+		t.Errorf("Expected a warning for the unmatched pattern, got:\n%s", logs.String())
+	}
+
+	_, err = New(WithAddDirGlob(filepath.Join(root, "[")))
+	var claudeErr *ClaudeError
+	if !errors.As(err, &claudeErr) || claudeErr.Code != "INVALID_OPTIONS" {
+		t.Errorf("Expected INVALID_OPTIONS error for a malformed pattern, got %v", err)
+	}
+}
+
+// TestAddDirGlobWorkingDirectory tests that relative add directory patterns
+// are matched under the working directory
+func TestAddDirGlobWorkingDirectory(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "packages", "api"), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	c, err := New(WithWorkingDirectory(root), WithAddDirGlob(filepath.Join("packages", "*")))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	want := []string{filepath.Join(root, "packages", "api")}
+	if got := c.(*client).options.AddDirs; !reflect.DeepEqual(got, want) {
+		t.Errorf("AddDirs = %v, want %v", got, want)
+	}
+}
+
+// TestOptionsValidate tests that Validate reports invalid options built
+// without New
+func TestOptionsValidate(t *testing.T) {
+	opts := DefaultOptions()
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Expected default options to be valid, got %v", err)
+	}
+
+	opts.WorkingDirectory = filepath.Join(t.TempDir(), "missing")
+	err := opts.Validate()
+	var claudeErr *ClaudeError
+	if !errors.As(err, &claudeErr) || claudeErr.Code != "INVALID_OPTIONS" {
+		t.Fatalf("Expected INVALID_OPTIONS error, got %v", err)
+	}
+	if claudeErr.Message != "working directory does not exist" {
+		t.Errorf("Unexpected error message: %q", claudeErr.Message)
+	}
+}
+
+// TestDenyByDefault tests that only the allowed built-in tools are made
+// available
+func TestDenyByDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "Allowed",
+			opts: []Option{WithAllowedTools("Read", "Bash(git *)", "Bash(go test *)", "mcp__db__query")},
+			want: "Read,Bash",
+		},
+		{
+			name: "NoneAllowed",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			WithCLIPath(writeFakeCLI(t, ""))(opts)
+			WithDenyByDefault(true)(opts)
+			for _, opt := range tt.opts {
+				opt(opts)
+			}
+
+			args, err := NewOneShotTransport(opts, "test").buildCommand()
+			if err != nil {
+				t.Fatalf("buildCommand failed: %v", err)
+			}
+			for i, arg := range args {
+				if arg == "--tools" {
+					if i+1 >= len(args) || args[i+1] != tt.want {
+						t.Errorf("Expected --tools %q, got %v", tt.want, args)
+					}
+					return
+				}
+			}
+			t.Error("Expected --tools flag")
+		})
+	}
+
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, ""))(opts)
+	args, err := NewOneShotTransport(opts, "test").buildCommand()
+	if err != nil {
+		t.Fatalf("buildCommand failed: %v", err)
+	}
+	for _, arg := range args {
+		if arg == "--tools" {
+			t.Errorf("Expected no --tools flag by default, got %v", args)
+		}
+	}
+}
+
+// TestRequireGitRepo tests that a working directory outside a git repository
+// is rejected when a repository is required
+func TestRequireGitRepo(t *testing.T) {
+	root := t.TempDir()
+	repo := filepath.Join(root, "repo")
+	nested := filepath.Join(repo, "internal", "api")
+	if err := os.MkdirAll(nested, 0o755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(repo, ".git"), 0o755); err != nil {
+		t.Fatalf("Failed to create .git: %v", err)
+	}
+
+	for _, dir := range []string{repo, nested} {
+		c, err := New(WithWorkingDirectory(dir), WithRequireGitRepo(true))
+		if err != nil {
+			t.Errorf("Expected %s to be accepted, got %v", dir, err)
+			continue
+		}
+		c.Close()
+	}
+
+	_, err := New(WithWorkingDirectory(root), WithRequireGitRepo(true))
+	var claudeErr *ClaudeError
+	if !errors.As(err, &claudeErr) || claudeErr.Code != "NOT_GIT_REPO" {
+		t.Fatalf("Expected NOT_GIT_REPO error, got %v", err)
+	}
+	if !strings.Contains(claudeErr.Message, root) {
+		t.Errorf("Expected the directory in the error message, got %q", claudeErr.Message)
+	}
+
+	c, err := New(WithWorkingDirectory(root))
+	if err != nil {
+		t.Fatalf("Expected a non-repository to be accepted by default, got %v", err)
+	}
+	c.Close()
+}
+
+// TestContinueOrNew tests that --continue is passed only when the working
+// directory has a recorded conversation, and that resume and continue
+// conflict
+func TestContinueOrNew(t *testing.T) {
+	configDir := t.TempDir()
+	workDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to resolve working directory: %v", err)
+	}
+
+	hasContinue := func() bool {
+		t.Helper()
+		opts := DefaultOptions()
+		WithCLIPath(writeFakeCLI(t, ""))(opts)
+		WithWorkingDirectory(workDir)(opts)
+		WithEnv("CLAUDE_CONFIG_DIR", configDir)(opts)
+		WithContinueOrNew(true)(opts)
+		args, err := NewOneShotTransport(opts, "test").buildCommand()
+		if err != nil {
+			t.Fatalf("buildCommand failed: %v", err)
+		}
+		return slices.Contains(args, "--continue")
+	}
+
+	if hasContinue() {
+		t.Error("Expected no --continue without a previous conversation")
+	}
+
+	projectDir := filepath.Join(configDir, "projects", projectDirPattern.ReplaceAllString(workDir, "-"))
+	if err := os.MkdirAll(projectDir, 0o755); err != nil {
+		t.Fatalf("Failed to create project directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(projectDir, "0b5c.jsonl"), []byte("{}\n"), 0o644); err != nil {
+		t.Fatalf("Failed to write conversation: %v", err)
+	}
+	if !hasContinue() {
+		t.Error("Expected --continue with a previous conversation")
+	}
+
+	for _, opt := range []Option{WithContinue(true), WithContinueOrNew(true)} {
+		_, err := New(opt, WithResume("conversation-id-123"))
+		var claudeErr *ClaudeError
+		if !errors.As(err, &claudeErr) || claudeErr.Code != "INVALID_OPTIONS" {
+			t.Errorf("Expected INVALID_OPTIONS error for resume with continue, got %v", err)
+		}
+	}
+}
+
+// TestAutoAddWorkingDir tests that the working directory is passed with
+// --add-dir when enabled, without duplicating an explicit entry
+func TestAutoAddWorkingDir(t *testing.T) {
+	workDir := t.TempDir()
+	other := t.TempDir()
+
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "Enabled",
+			opts: []Option{WithAddDirs(other), WithAutoAddWorkingDir(true)},
+			want: []string{other, workDir},
+		},
+		{
+			name: "AlreadyListed",
+			opts: []Option{WithAddDirs(workDir+string(filepath.Separator), other), WithAutoAddWorkingDir(true)},
+			want: []string{workDir + string(filepath.Separator), other},
+		},
+		{
+			name: "RelativeListed",
+			opts: []Option{WithAddDirs("."), WithAutoAddWorkingDir(true)},
+			want: []string{"."},
+		},
+		{
+			name: "Disabled",
+			opts: []Option{WithAddDirs(other)},
+			want: []string{other},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			WithCLIPath(writeFakeCLI(t, ""))(opts)
+			WithWorkingDirectory(workDir)(opts)
+			for _, opt := range tt.opts {
+				opt(opts)
+			}
+
+			before := slices.Clone(opts.AddDirs)
+			args, err := NewOneShotTransport(opts, "test").buildCommand()
+			if err != nil {
+				t.Fatalf("buildCommand failed: %v", err)
+			}
+			var got []string
+			for i, arg := range args {
+				if arg == "--add-dir" && i+1 < len(args) {
+					got = append(got, args[i+1])
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("--add-dir values = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(opts.AddDirs, before) {
+				t.Errorf("Expected AddDirs to be unchanged, got %v", opts.AddDirs)
+			}
+		})
+	}
+}
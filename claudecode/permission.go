@@ -0,0 +1,190 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// PermissionRequest describes a tool use the CLI asks permission for
+type PermissionRequest struct {
+	// ToolName is the name of the tool, such as "Bash" or "Edit"
+	ToolName string
+
+	// Input is the input Claude provided to the tool
+	Input map[string]any
+
+	// Suggestions are the permission updates the CLI suggests, such as
+	// rules that would allow the tool without asking again
+	Suggestions []map[string]any
+}
+
+// PermissionDecision is the answer to a PermissionRequest
+type PermissionDecision struct {
+	// Allow lets the tool use proceed
+	Allow bool
+
+	// UpdatedInput replaces the tool input when the tool use is allowed. A
+	// nil value keeps the original input.
+	UpdatedInput map[string]any
+
+	// Message tells Claude why the tool use was denied
+	Message string
+}
+
+// EditOp describes a file edit Claude is about to make
+type EditOp struct {
+	// Tool is the editing tool, such as "Edit", "MultiEdit", or "Write"
+	Tool string
+
+	// FilePath is the path of the file being edited
+	FilePath string
+
+	// Input is the full tool input
+	Input map[string]any
+}
+
+// editTools maps the tools that modify files to the input field holding the
+// path they edit
+var editTools = map[string]string{
+	"Edit":         "file_path",
+	"MultiEdit":    "file_path",
+	"Write":        "file_path",
+	"NotebookEdit": "notebook_path",
+}
+
+// editOp returns the EditOp for a tool use, reporting false for tools that do
+// not edit files
+func editOp(toolName string, input map[string]any) (EditOp, bool) {
+	field, ok := editTools[toolName]
+	if !ok {
+		return EditOp{}, false
+	}
+	path, _ := input[field].(string)
+	return EditOp{Tool: toolName, FilePath: path, Input: input}, true
+}
+
+// PermissionHandler decides whether a tool use may proceed. Returning an
+// error fails the permission prompt.
+type PermissionHandler func(ctx context.Context, req PermissionRequest) (PermissionDecision, error)
+
+// controlRequest is a request from the CLI that expects a control response
+type controlRequest struct {
+	RequestID string `json:"request_id"`
+	Request   struct {
+		Subtype     string           `json:"subtype"`
+		ToolName    string           `json:"tool_name"`
+		Input       map[string]any   `json:"input"`
+		Suggestions []map[string]any `json:"permission_suggestions"`
+		ServerName  string           `json:"server_name"`
+		Message     json.RawMessage  `json:"message"`
+	} `json:"request"`
+}
+
+// handleControlRequest answers a control request from the CLI. Unsupported
+// requests, including permission prompts without a handler, receive an error
+// response so the CLI never waits on them.
+func (t *SubprocessTransport) handleControlRequest(ctx context.Context, raw json.RawMessage) {
+	var req controlRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		t.logger.Debug("failed to decode control request", slog.Any("error", err))
+		return
+	}
+
+	response, err := t.answerControlRequest(ctx, &req)
+	if err != nil {
+		response = map[string]any{
+			"subtype":    "error",
+			"request_id": req.RequestID,
+			"error":      err.Error(),
+		}
+	}
+
+	msg := map[string]any{"type": "control_response", "response": response}
+	if err := t.writeStdin(msg); err != nil {
+		t.logger.Debug("failed to write control response", slog.Any("error", err))
+	}
+}
+
+// answerControlRequest returns the successful response to req
+func (t *SubprocessTransport) answerControlRequest(ctx context.Context, req *controlRequest) (map[string]any, error) {
+	if req.Request.Subtype == "mcp_message" && req.Request.ServerName == sdkMCPServerName && len(t.options.ToolProviders) > 0 {
+		return t.answerMCPMessage(ctx, req)
+	}
+
+	if req.Request.Subtype != "can_use_tool" || (t.options.PermissionHandler == nil && t.options.EditFilter == nil) {
+		return nil, fmt.Errorf("unsupported control request: %s", req.Request.Subtype)
+	}
+
+	var decision PermissionDecision
+	op, isEdit := editOp(req.Request.ToolName, req.Request.Input)
+	if isEdit && t.options.EditFilter != nil && !t.options.EditFilter(op) {
+		decision.Message = fmt.Sprintf("edit to %s was rejected by the edit filter", op.FilePath)
+	} else if t.options.PermissionHandler != nil {
+		var err error
+		decision, err = t.decidePermission(ctx, PermissionRequest{
+			ToolName:    req.Request.ToolName,
+			Input:       req.Request.Input,
+			Suggestions: req.Request.Suggestions,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if isEdit {
+		// The edit filter only decides edits; other tools are denied as
+		// they would be without any handler
+		decision.Allow = true
+	} else {
+		decision.Message = fmt.Sprintf("no permission handler is configured for %s", req.Request.ToolName)
+	}
+
+	result := map[string]any{"behavior": "deny", "message": decision.Message}
+	if decision.Allow {
+		input := decision.UpdatedInput
+		if input == nil {
+			input = req.Request.Input
+		}
+		result = map[string]any{"behavior": "allow", "updatedInput": input}
+	}
+
+	return map[string]any{
+		"subtype":    "success",
+		"request_id": req.RequestID,
+		"response":   result,
+	}, nil
+}
+
+// decidePermission calls the permission handler, denying the tool use if the
+// handler does not answer within the permission timeout
+func (t *SubprocessTransport) decidePermission(ctx context.Context, req PermissionRequest) (PermissionDecision, error) {
+	timeout := t.options.PermissionTimeout
+	if timeout <= 0 {
+		return t.options.PermissionHandler(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type answer struct {
+		decision PermissionDecision
+		err      error
+	}
+	answered := make(chan answer, 1)
+	go func() {
+		decision, err := t.options.PermissionHandler(ctx, req)
+		answered <- answer{decision, err}
+	}()
+
+	select {
+	case a := <-answered:
+		return a.decision, a.err
+	case <-ctx.Done():
+		t.logger.Warn("permission request not answered, denying",
+			slog.String("tool", req.ToolName),
+			slog.Duration("timeout", timeout))
+		return PermissionDecision{
+			Message: fmt.Sprintf("permission request was not answered within %s", timeout),
+		}, nil
+	}
+}
@@ -0,0 +1,275 @@
+package claudecode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPermissionHandler(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args.txt")
+	responsePath := filepath.Join(dir, "response.json")
+
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+read -r prompt
+echo '{"type":"control_request","request_id":"req_1","request":{"subtype":"can_use_tool","tool_name":"Bash","input":{"command":"rm -rf build"},"permission_suggestions":[{"type":"addRules","behavior":"allow","destination":"session"}]}}'
+read -r response
+printf '%s\n' "$response" > "$RESPONSE_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1}'
+cat > /dev/null`)
+
+	var got PermissionRequest
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithEnv("RESPONSE_CAPTURE", responsePath),
+		WithPermissionHandler(func(ctx context.Context, req PermissionRequest) (PermissionDecision, error) {
+			got = req
+			return PermissionDecision{
+				Allow:        true,
+				UpdatedInput: map[string]any{"command": "rm -rf build/tmp"},
+			}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	if err := sess.Send(ctx, "Clean the build directory"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := sess.ReceiveOne(ctx); err != nil {
+		t.Fatalf("ReceiveOne failed: %v", err)
+	}
+
+	want := PermissionRequest{
+		ToolName:    "Bash",
+		Input:       map[string]any{"command": "rm -rf build"},
+		Suggestions: []map[string]any{{"type": "addRules", "behavior": "allow", "destination": "session"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("PermissionRequest = %+v, want %+v", got, want)
+	}
+
+	data, err := os.ReadFile(responsePath)
+	if err != nil {
+		t.Fatalf("Failed to read captured response: %v", err)
+	}
+	var response map[string]any
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Failed to decode captured response: %v", err)
+	}
+	wantResponse := map[string]any{
+		"type": "control_response",
+		"response": map[string]any{
+			"subtype":    "success",
+			"request_id": "req_1",
+			"response": map[string]any{
+				"behavior":     "allow",
+				"updatedInput": map[string]any{"command": "rm -rf build/tmp"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(response, wantResponse) {
+		t.Errorf("Control response = %v, want %v", response, wantResponse)
+	}
+
+	args, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	if !strings.Contains(string(args), "--permission-prompt-tool\nstdio\n") {
+		t.Errorf("Expected --permission-prompt-tool stdio in args, got:\n%s", args)
+	}
+}
+
+// bashPermissionRequest is a permission prompt for running a shell command
+const bashPermissionRequest = `{"subtype":"can_use_tool","tool_name":"Bash","input":{"command":"make deploy"}}`
+
+// capturePermissionResponse runs a session whose CLI sends the given
+// permission request and returns the control response the SDK wrote back
+func capturePermissionResponse(t *testing.T, request string, opts ...Option) map[string]any {
+	t.Helper()
+	responsePath := filepath.Join(t.TempDir(), "response.json")
+
+	cliPath := writeFakeCLI(t, `read -r prompt
+echo '{"type":"control_request","request_id":"req_1","request":`+request+`}'
+read -r response
+printf '%s\n' "$response" > "$RESPONSE_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1}'
+cat > /dev/null`)
+
+	opts = append([]Option{WithCLIPath(cliPath), WithEnv("RESPONSE_CAPTURE", responsePath)}, opts...)
+	c, err := New(opts...)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	if err := sess.Send(ctx, "Deploy"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := sess.ReceiveOne(ctx); err != nil {
+		t.Fatalf("ReceiveOne failed: %v", err)
+	}
+
+	data, err := os.ReadFile(responsePath)
+	if err != nil {
+		t.Fatalf("Failed to read captured response: %v", err)
+	}
+	var response map[string]any
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Failed to decode captured response: %v", err)
+	}
+	return response
+}
+
+func TestPermissionUnanswered(t *testing.T) {
+	t.Run("Timeout", func(t *testing.T) {
+		response := capturePermissionResponse(t, bashPermissionRequest,
+			WithPermissionTimeout(50*time.Millisecond),
+			WithPermissionHandler(func(ctx context.Context, req PermissionRequest) (PermissionDecision, error) {
+				<-ctx.Done()
+				return PermissionDecision{}, ctx.Err()
+			}),
+		)
+
+		want := map[string]any{
+			"type": "control_response",
+			"response": map[string]any{
+				"subtype":    "success",
+				"request_id": "req_1",
+				"response": map[string]any{
+					"behavior": "deny",
+					"message":  "permission request was not answered within 50ms",
+				},
+			},
+		}
+		if !reflect.DeepEqual(response, want) {
+			t.Errorf("Control response = %v, want %v", response, want)
+		}
+	})
+
+	t.Run("NoHandler", func(t *testing.T) {
+		response := capturePermissionResponse(t, bashPermissionRequest)
+
+		want := map[string]any{
+			"type": "control_response",
+			"response": map[string]any{
+				"subtype":    "error",
+				"request_id": "req_1",
+				"error":      "unsupported control request: can_use_tool",
+			},
+		}
+		if !reflect.DeepEqual(response, want) {
+			t.Errorf("Control response = %v, want %v", response, want)
+		}
+	})
+}
+
+func TestEditFilter(t *testing.T) {
+	var handled []string
+	opts := []Option{
+		WithEditFilter(func(op EditOp) bool {
+			return !strings.HasPrefix(op.FilePath, "secrets/")
+		}),
+		WithPermissionHandler(func(ctx context.Context, req PermissionRequest) (PermissionDecision, error) {
+			handled = append(handled, req.ToolName)
+			return PermissionDecision{Allow: true}, nil
+		}),
+	}
+
+	response := capturePermissionResponse(t,
+		`{"subtype":"can_use_tool","tool_name":"Edit","input":{"file_path":"secrets/key.pem","old_string":"a","new_string":"b"}}`,
+		opts...)
+	want := map[string]any{
+		"behavior": "deny",
+		"message":  "edit to secrets/key.pem was rejected by the edit filter",
+	}
+	if got := response["response"].(map[string]any)["response"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Response for protected edit = %v, want %v", got, want)
+	}
+	if len(handled) != 0 {
+		t.Errorf("Expected the permission handler to be skipped for a rejected edit, got %v", handled)
+	}
+
+	response = capturePermissionResponse(t,
+		`{"subtype":"can_use_tool","tool_name":"Write","input":{"file_path":"docs/notes.md","content":"hi"}}`,
+		opts...)
+	if got := response["response"].(map[string]any)["response"].(map[string]any)["behavior"]; got != "allow" {
+		t.Errorf("Expected allowed edit outside protected path, got %v", got)
+	}
+	if len(handled) != 1 || handled[0] != "Write" {
+		t.Errorf("Expected the permission handler to decide the allowed edit, got %v", handled)
+	}
+}
+
+func TestEditFilterWithoutHandler(t *testing.T) {
+	filter := WithEditFilter(func(op EditOp) bool { return true })
+
+	response := capturePermissionResponse(t,
+		`{"subtype":"can_use_tool","tool_name":"Edit","input":{"file_path":"main.go","old_string":"a","new_string":"b"}}`,
+		filter)
+	if got := response["response"].(map[string]any)["response"].(map[string]any)["behavior"]; got != "allow" {
+		t.Errorf("Expected the filtered edit to be allowed, got %v", got)
+	}
+
+	response = capturePermissionResponse(t,
+		`{"subtype":"can_use_tool","tool_name":"Bash","input":{"command":"rm -rf /"}}`,
+		filter)
+	if got := response["response"].(map[string]any)["response"].(map[string]any)["behavior"]; got != "deny" {
+		t.Errorf("Expected Bash to be denied without a permission handler, got %v", got)
+	}
+}
+
+func TestEditFilterAcceptEditsAudit(t *testing.T) {
+	var logs bytes.Buffer
+	opts := DefaultOptions()
+	WithLogger(slog.New(slog.NewTextHandler(&logs, nil)))(opts)
+	WithPermissionMode(PermissionModeAcceptEdits)(opts)
+	WithEditFilter(func(op EditOp) bool { return op.FilePath != "go.sum" })(opts)
+
+	dispatchToolCallbacks(opts, map[string]any{
+		"type": "assistant",
+		"message": map[string]any{
+			"content": []any{
+				map[string]any{"type": "tool_use", "id": "toolu_1", "name": "Edit", "input": map[string]any{"file_path": "main.go"}},
+				map[string]any{"type": "tool_use", "id": "toolu_2", "name": "Write", "input": map[string]any{"file_path": "go.sum"}},
+			},
+		},
+	})
+
+	if !strings.Contains(logs.String(), "file_path=go.sum") {
+		t.Errorf("Expected a warning for the rejected edit, got:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "main.go") {
+		t.Errorf("Expected no warning for the allowed edit, got:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,163 @@
+package claudecode
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// persistentProcess is a warm streaming CLI process shared by sequential
+// Query calls when WithPersistentProcess is enabled
+type persistentProcess struct {
+	transport *SubprocessTransport
+	rawChan   <-chan receivedMessage
+}
+
+// clear starts a new conversation in the process and waits for the CLI to
+// finish handling the command, discarding its output
+func (p *persistentProcess) clear(ctx context.Context, options *Options, meta MessageMeta) error {
+	msg, err := options.encodeMessage(NewUserMessage(clearCommand), meta)
+	if err != nil {
+		return err
+	}
+	if err := p.transport.Send(ctx, []map[string]any{msg}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case received, ok := <-p.rawChan:
+			if !ok {
+				if err := p.transport.ExitError(); err != nil {
+					return err
+				}
+				return fmt.Errorf("%w: persistent process exited while clearing the conversation", ErrProcessExited)
+			}
+			if received.envelope.Type == string(MessageTypeResult) {
+				return nil
+			}
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// clearCommand is the slash command that starts a new, empty conversation in
+// a running CLI process
+const clearCommand = "/clear"
+
+// queryPersistent runs a query on the client's persistent process, starting
+// it if necessary. Queries are serialized, and the conversation is cleared
+// before each query after the first, so a query does not see the context of
+// the ones before it. The process is discarded if a query does not complete
+// cleanly, so a stray turn cannot leak into the next query. c.mu is only held
+// while the process is looked up or replaced, so that Close can stop a query
+// in progress.
+func (c *client) queryPersistent(ctx context.Context, prompt string, qOpts *queryOptions, options *Options, logger *slog.Logger) ([]Message, error) {
+	c.persistentMu.Lock()
+	defer c.persistentMu.Unlock()
+
+	c.mu.Lock()
+	p := c.persistent
+	c.mu.Unlock()
+
+	meta := MessageMeta{SessionID: qOpts.sessionID}
+	msg, err := options.encodeMessage(NewUserMessage(prompt), meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if p == nil {
+		// The first prompt is written before Connect waits for the init
+		// message, which the CLI only emits once it has input
+		c.mu.Lock()
+		p, err = c.startPersistent(msg)
+		c.persistent = p
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err := p.clear(ctx, options, meta); err != nil {
+			c.discardPersistent(p)
+			return nil, err
+		}
+		if err := p.transport.Send(ctx, []map[string]any{msg}); err != nil {
+			c.discardPersistent(p)
+			return nil, err
+		}
+	}
+
+	collector := newQueryCollector(options, logger, qOpts)
+	for {
+		select {
+		case received, ok := <-p.rawChan:
+			if !ok {
+				c.discardPersistent(p)
+				if err := p.transport.ExitError(); err != nil {
+					return collector.messages, err
+				}
+				return collector.messages, fmt.Errorf("%w: persistent process exited during query", ErrProcessExited)
+			}
+
+			done, err := collector.add(received)
+			if err != nil {
+				c.discardPersistent(p)
+				return collector.messages, err
+			}
+			if done {
+				return collector.messages, nil
+			}
+
+		case <-ctx.Done():
+			c.discardPersistent(p)
+			return collector.messages, ctx.Err()
+		}
+	}
+}
+
+// startPersistent starts a streaming CLI process that outlives individual
+// queries, with first as its first message
+func (c *client) startPersistent(first map[string]any) (*persistentProcess, error) {
+	promptChan := make(chan map[string]any, 1)
+	promptChan <- first
+	transport := NewStreamingTransport(c.options, promptChan, false)
+
+	// The process is owned by the client, not by the query that started it
+	ctx := context.Background()
+	if err := transport.Connect(ctx); err != nil {
+		return nil, err
+	}
+
+	rawChan, err := transport.receiveMessages(ctx)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	return &persistentProcess{transport: transport, rawChan: rawChan}, nil
+}
+
+// discardPersistent closes p if it is still the client's persistent process;
+// otherwise Close has already closed it
+func (c *client) discardPersistent(p *persistentProcess) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.persistent == p {
+		c.closePersistent()
+	}
+}
+
+// closePersistent closes the persistent process, if any. The caller must hold
+// c.mu.
+func (c *client) closePersistent() {
+	if c.persistent == nil {
+		return
+	}
+	if err := c.persistent.transport.Close(); err != nil {
+		c.logger.Debug("failed to close persistent process", "error", err)
+	}
+	c.persistent = nil
+}
@@ -0,0 +1,46 @@
+package claudecode
+
+// ToolPreset names a common set of allowed tools
+type ToolPreset string
+
+const (
+	// PresetReadOnly allows the tools that search and read files: Read,
+	// Grep, and Glob
+	PresetReadOnly ToolPreset = "read-only"
+
+	// PresetFullAccess allows every built-in tool: Bash, Edit, Glob, Grep,
+	// LS, MultiEdit, NotebookEdit, Read, Task, TodoWrite, WebFetch,
+	// WebSearch, and Write
+	PresetFullAccess ToolPreset = "full-access"
+)
+
+// presetTools lists the tools each preset allows
+var presetTools = map[ToolPreset][]string{
+	PresetReadOnly: {"Read", "Grep", "Glob"},
+	PresetFullAccess: {
+		"Bash", "Edit", "Glob", "Grep", "LS", "MultiEdit", "NotebookEdit",
+		"Read", "Task", "TodoWrite", "WebFetch", "WebSearch", "Write",
+	},
+}
+
+// allowedTools returns the tools of the tool preset followed by AllowedTools
+// and the provided tools, without duplicates
+func (o *Options) allowedTools() []string {
+	preset := presetTools[o.ToolPreset]
+	if len(preset) == 0 && len(o.ToolProviders) == 0 {
+		return o.AllowedTools
+	}
+
+	provided := o.providedToolNames()
+	tools := make([]string, 0, len(preset)+len(o.AllowedTools)+len(provided))
+	seen := make(map[string]bool, cap(tools))
+	for _, list := range [][]string{preset, o.AllowedTools, provided} {
+		for _, tool := range list {
+			if !seen[tool] {
+				seen[tool] = true
+				tools = append(tools, tool)
+			}
+		}
+	}
+	return tools
+}
@@ -0,0 +1,62 @@
+package claudecode
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestToolPreset tests that each preset expands to its documented tools,
+// followed by explicitly allowed tools
+func TestToolPreset(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{
+			name: "ReadOnly",
+			opts: []Option{WithToolPreset(PresetReadOnly)},
+			want: "Read,Grep,Glob",
+		},
+		{
+			name: "FullAccess",
+			opts: []Option{WithToolPreset(PresetFullAccess)},
+			want: "Bash,Edit,Glob,Grep,LS,MultiEdit,NotebookEdit,Read,Task,TodoWrite,WebFetch,WebSearch,Write",
+		},
+		{
+			name: "WithAdditions",
+			opts: []Option{WithAllowedTools("Bash(git log *)", "Read"), WithToolPreset(PresetReadOnly)},
+			want: "Read,Grep,Glob,Bash(git log *)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			WithCLIPath(writeFakeCLI(t, ""))(opts)
+			for _, opt := range tt.opts {
+				opt(opts)
+			}
+
+			args, err := NewOneShotTransport(opts, "test").buildCommand()
+			if err != nil {
+				t.Fatalf("buildCommand failed: %v", err)
+			}
+			for i, arg := range args {
+				if arg == "--allowedTools" {
+					if i+1 >= len(args) || args[i+1] != tt.want {
+						t.Errorf("Expected --allowedTools %q, got %v", tt.want, args)
+					}
+					return
+				}
+			}
+			t.Error("Expected --allowedTools flag")
+		})
+	}
+
+	_, err := New(WithToolPreset("everything"))
+	var claudeErr *ClaudeError
+	if !errors.As(err, &claudeErr) || claudeErr.Code != "INVALID_OPTIONS" {
+		t.Errorf("Expected INVALID_OPTIONS error for an unknown preset, got %v", err)
+	}
+}
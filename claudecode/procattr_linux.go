@@ -0,0 +1,14 @@
+//go:build linux
+
+package claudecode
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessAttributes makes the CLI process receive SIGKILL when the parent
+// process dies, so that it is not orphaned if the program crashes
+func setProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
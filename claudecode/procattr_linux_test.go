@@ -0,0 +1,89 @@
+//go:build linux
+
+package claudecode
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestParentDeathHelper is run in a child process by TestSubprocessDiesWithParent
+func TestParentDeathHelper(t *testing.T) {
+	cliPath := os.Getenv("CLAUDE_SDK_HELPER_CLI")
+	if cliPath == "" {
+		t.Skip("helper process only")
+	}
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// Block until killed by the parent test
+	time.Sleep(time.Minute)
+}
+
+// TestSubprocessDiesWithParent tests that the CLI process exits when the process that started it is killed
+func TestSubprocessDiesWithParent(t *testing.T) {
+	pidPath := filepath.Join(t.TempDir(), "cli.pid")
+	cliPath := writeFakeCLI(t, `echo $$ > "`+pidPath+`"
+exec sleep 60
+`)
+
+	helper := exec.Command(os.Args[0], "-test.run=^TestParentDeathHelper$")
+	helper.Env = append(os.Environ(), "CLAUDE_SDK_HELPER_CLI="+cliPath)
+	helper.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := helper.Start(); err != nil {
+		t.Fatalf("Failed to start helper: %v", err)
+	}
+
+	var pid int
+	deadline := time.Now().Add(10 * time.Second)
+	for pid == 0 && time.Now().Before(deadline) {
+		if data, err := os.ReadFile(pidPath); err == nil && strings.HasSuffix(string(data), "\n") {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pid == 0 {
+		_ = syscall.Kill(-helper.Process.Pid, syscall.SIGKILL)
+		t.Fatal("Timeout waiting for CLI process to start")
+	}
+
+	// Signal the helper's process group leader; the CLI is in the same group
+	// but only the leader is killed so the parent death signal is exercised
+	if err := syscall.Kill(helper.Process.Pid, syscall.SIGKILL); err != nil {
+		t.Fatalf("Failed to kill helper: %v", err)
+	}
+	_ = helper.Wait()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("CLI process %d survived its parent", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// processAlive reports whether pid refers to a running, non-zombie process
+func processAlive(pid int) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesized command name
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package claudecode
+
+import "os/exec"
+
+// setProcessAttributes is a no-op on platforms without a parent death signal
+func setProcessAttributes(cmd *exec.Cmd) {}
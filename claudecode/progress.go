@@ -0,0 +1,90 @@
+package claudecode
+
+import "io"
+
+// progressClearLine returns the cursor to the start of the line and erases it
+const progressClearLine = "\r\x1b[K"
+
+// toolProgress maps built-in tool names to the status shown while they run
+var toolProgress = map[string]string{
+	"Read":         "Reading file…",
+	"Write":        "Writing file…",
+	"Edit":         "Editing file…",
+	"MultiEdit":    "Editing file…",
+	"NotebookEdit": "Editing notebook…",
+	"Bash":         "Running command…",
+	"Grep":         "Searching…",
+	"Glob":         "Searching…",
+	"LS":           "Listing files…",
+	"WebFetch":     "Fetching page…",
+	"WebSearch":    "Searching the web…",
+	"Task":         "Running sub-agent…",
+	"TodoWrite":    "Updating todos…",
+}
+
+// progressLine renders the status line of a single run to the configured
+// progress writer. A nil progressLine renders nothing.
+type progressLine struct {
+	w      io.Writer
+	status string
+}
+
+// newProgressLine returns a progress line for opts, or nil if no progress
+// writer is configured
+func newProgressLine(opts *Options) *progressLine {
+	if opts.ProgressWriter == nil {
+		return nil
+	}
+	return &progressLine{w: opts.ProgressWriter}
+}
+
+// update redraws the status line for msg, clearing it on a final result
+func (p *progressLine) update(msg Message) {
+	if p == nil {
+		return
+	}
+
+	if _, ok := finalResult(msg); ok {
+		if p.status != "" {
+			p.status = ""
+			_, _ = io.WriteString(p.w, progressClearLine)
+		}
+		return
+	}
+
+	status := progressStatus(msg)
+	if status == "" || status == p.status {
+		return
+	}
+	p.status = status
+	_, _ = io.WriteString(p.w, progressClearLine+status)
+}
+
+// progressStatus returns the status text for msg, or "" to keep the current
+// status
+func progressStatus(msg Message) string {
+	switch m := msg.(type) {
+	case *SystemMessage:
+		if m.Subtype == "init" {
+			return "Starting…"
+		}
+	case *AssistantMessage:
+		status := ""
+		for _, block := range m.Content {
+			switch {
+			case block.Type == "tool_use" && block.Tool != nil:
+				if s, ok := toolProgress[block.Tool.Name]; ok {
+					status = s
+				} else {
+					status = "Running " + block.Tool.Name + "…"
+				}
+			case block.Type == "text" && status == "":
+				status = "Writing response…"
+			}
+		}
+		return status
+	case *UserMessage:
+		return "Thinking…"
+	}
+	return ""
+}
@@ -0,0 +1,51 @@
+package claudecode
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressWriter(t *testing.T) {
+	cliPath := writeFakeCLI(t, `
+echo '{"type":"system","subtype":"init","session_id":"s1","data":{}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Let me look."},{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"main.go"}}]}}'
+echo '{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"package main"}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_2","name":"Bash","input":{"command":"go test"}}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_3","name":"Bash","input":{"command":"go vet"}}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_4","name":"mcp__db__query","input":{}}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"All good."}]}}'
+echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":4}'
+`)
+
+	var buf bytes.Buffer
+	c, err := New(WithCLIPath(cliPath), WithProgressWriter(&buf))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Query(ctx, "Check the build"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	got := strings.Split(buf.String(), progressClearLine)
+	want := []string{
+		"",
+		"Starting…",
+		"Reading file…",
+		"Thinking…",
+		"Running command…",
+		"Running mcp__db__query…",
+		"Writing response…",
+		"",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Status transitions = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+package claudecode
+
+import "fmt"
+
+// ProtocolVersion selects how messages from the CLI are parsed, so that the
+// SDK can be pinned to the stream-json schema of the installed CLI
+type ProtocolVersion int
+
+const (
+	// ProtocolCurrent parses the schema of current CLI releases
+	ProtocolCurrent ProtocolVersion = iota
+
+	// ProtocolLegacy parses the schema of CLI releases before 1.0, whose
+	// results report the total cost as "total_cost" rather than
+	// "total_cost_usd"
+	ProtocolLegacy
+)
+
+// protocolRenames maps, for each protocol version, the fields of each
+// message type that are renamed to their current names before parsing
+var protocolRenames = map[ProtocolVersion]map[MessageType]map[string]string{
+	ProtocolCurrent: {},
+	ProtocolLegacy: {
+		MessageTypeResult: {"total_cost": "total_cost_usd"},
+	},
+}
+
+// ParseMessageVersion parses a raw message from the CLI into a typed Message
+// using the schema of the given protocol version. ParseMessage parses with
+// ProtocolCurrent.
+func ParseMessageVersion(data map[string]any, version ProtocolVersion) (Message, error) {
+	renames, ok := protocolRenames[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown protocol version %d", ErrInvalidMessage, version)
+	}
+
+	msgType, _ := data["type"].(string)
+	if fields := renames[MessageType(msgType)]; len(fields) > 0 {
+		renamed := make(map[string]any, len(data))
+		for key, value := range data {
+			if name, ok := fields[key]; ok && data[name] == nil {
+				key = name
+			}
+			renamed[key] = value
+		}
+		data = renamed
+	}
+	return ParseMessage(data)
+}
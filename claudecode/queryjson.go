@@ -0,0 +1,68 @@
+package claudecode
+
+import (
+	"context"
+	"fmt"
+)
+
+// QueryJSON sends a one-shot query and returns only its result. The CLI is
+// run with --output-format json, printing a single JSON object once the run
+// finishes, so no messages are streamed or parsed along the way. Use it for
+// batch work where only the final result matters.
+func (c *client) QueryJSON(ctx context.Context, prompt string, opts ...QueryOption) (*ResultMessage, error) {
+	qOpts := &queryOptions{}
+	for _, opt := range opts {
+		opt(qOpts)
+	}
+
+	options, logger, err := c.queryScope(prompt, qOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *ResultMessage
+	err = retryQuery(ctx, options, logger, func() error {
+		var err error
+		result, err = queryJSONOnce(ctx, prompt, options)
+		return err
+	})
+	return result, err
+}
+
+// queryJSONOnce runs a single attempt of QueryJSON
+func queryJSONOnce(ctx context.Context, prompt string, options *Options) (*ResultMessage, error) {
+	transport := NewOneShotTransport(options, prompt)
+	transport.jsonOutput = true
+
+	if err := transport.Connect(ctx); err != nil {
+		return nil, err
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.receiveMessages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for received := range msgChan {
+		msg, err := received.parse(options.ProtocolVersion)
+		if err != nil {
+			return nil, &JSONDecodeError{Data: received.raw, Err: err}
+		}
+		result, ok := msg.(*ResultMessage)
+		if !ok {
+			return nil, &JSONDecodeError{Data: received.raw, Err: fmt.Errorf("expected a result, got %s message", msg.Type())}
+		}
+
+		writeSummary(options, result)
+		return result, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := transport.ExitError(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: no result in CLI output", ErrProcessExited)
+}
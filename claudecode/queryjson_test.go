@@ -0,0 +1,120 @@
+package claudecode
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQueryJSON tests that QueryJSON runs the CLI with JSON output and
+// parses the single result object
+func TestQueryJSON(t *testing.T) {
+	argsPath := filepath.Join(t.TempDir(), "args.txt")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+echo '{"type":"result","subtype":"success","is_error":false,"duration_ms":1200,"duration_api_ms":900,"num_turns":1,"result":"7","session_id":"s1","total_cost_usd":0.003}'
+`)
+
+	c, err := New(WithCLIPath(cliPath), WithEnv("ARGS_CAPTURE", argsPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := c.QueryJSON(ctx, "Score this essay")
+	if err != nil {
+		t.Fatalf("QueryJSON failed: %v", err)
+	}
+	if result.Result == nil || *result.Result != "7" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if result.SessionID != "s1" || result.NumTurns != 1 {
+		t.Errorf("Unexpected result metadata: %+v", result)
+	}
+
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	args := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(args) < 2 || args[0] != "--output-format" || args[1] != "json" {
+		t.Errorf("Expected --output-format json, got %v", args)
+	}
+	for _, arg := range args {
+		if arg == "--verbose" || arg == "stream-json" {
+			t.Errorf("Expected no streaming flags, got %v", args)
+		}
+	}
+	if args[len(args)-2] != "--print" || args[len(args)-1] != "Score this essay" {
+		t.Errorf("Expected the prompt to be printed, got %v", args)
+	}
+}
+
+// TestQueryJSONProcessError tests that a failing CLI is reported as a
+// ProcessError
+func TestQueryJSONProcessError(t *testing.T) {
+	cliPath := writeFakeCLI(t, "echo 'invalid API key' >&2\nexit 1\n")
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	_, err = c.QueryJSON(context.Background(), "Hello")
+	var procErr *ProcessError
+	if !errors.As(err, &procErr) || !errors.Is(err, ErrProcessExited) {
+		t.Fatalf("Expected a ProcessError wrapping ErrProcessExited, got %v", err)
+	}
+	if procErr.Stderr != "invalid API key" {
+		t.Errorf("Stderr = %q, want %q", procErr.Stderr, "invalid API key")
+	}
+}
+
+// TestQueryJSONTransport tests that QueryJSON runs through the subprocess
+// transport, so that the stdout tee and retry policy apply
+func TestQueryJSONTransport(t *testing.T) {
+	countPath := filepath.Join(t.TempDir(), "count.txt")
+	cliPath := writeFakeCLI(t, `echo run >> "$COUNT_CAPTURE"
+if [ "$(wc -l < "$COUNT_CAPTURE")" -lt 2 ]; then
+  echo 'overloaded' >&2
+  exit 1
+fi
+echo '{"type":"result","subtype":"success","result":"ok","session_id":"s1"}'
+`)
+
+	var tee bytes.Buffer
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("COUNT_CAPTURE", countPath),
+		WithStdoutTee(&tee),
+		WithRetryPolicy(func(err error, attempt int) (bool, time.Duration) {
+			return attempt < 3, 0
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := c.QueryJSON(ctx, "Hello")
+	if err != nil {
+		t.Fatalf("QueryJSON failed: %v", err)
+	}
+	if result.Result == nil || *result.Result != "ok" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if !strings.Contains(tee.String(), `"result":"ok"`) {
+		t.Errorf("Expected the output to be teed, got %q", tee.String())
+	}
+}
@@ -0,0 +1,43 @@
+package claudecode
+
+import "sync"
+
+// liveTransports tracks connected transports so that their processes can be
+// cleaned up if the program exits without closing them
+var (
+	liveTransportsMu sync.Mutex
+	liveTransports   = make(map[*SubprocessTransport]struct{})
+)
+
+// registerTransport records a connected transport
+func registerTransport(t *SubprocessTransport) {
+	liveTransportsMu.Lock()
+	defer liveTransportsMu.Unlock()
+	liveTransports[t] = struct{}{}
+}
+
+// unregisterTransport removes a transport from the registry
+func unregisterTransport(t *SubprocessTransport) {
+	liveTransportsMu.Lock()
+	defer liveTransportsMu.Unlock()
+	delete(liveTransports, t)
+}
+
+// CleanupAll kills the CLI processes of all transports that are still
+// connected and closes them. Call it from shutdown or signal handlers to avoid
+// leaving orphaned processes behind when clients and sessions were not closed.
+func CleanupAll() {
+	liveTransportsMu.Lock()
+	transports := make([]*SubprocessTransport, 0, len(liveTransports))
+	for t := range liveTransports {
+		transports = append(transports, t)
+	}
+	liveTransportsMu.Unlock()
+
+	for _, t := range transports {
+		if t.cmd != nil && t.cmd.Process != nil {
+			_ = t.cmd.Process.Kill()
+		}
+		_ = t.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package claudecode
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCleanupAll(t *testing.T) {
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, "exec sleep 60"))(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	liveTransportsMu.Lock()
+	_, registered := liveTransports[transport]
+	liveTransportsMu.Unlock()
+	if !registered {
+		t.Fatal("Expected connected transport to be registered")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		CleanupAll()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for CleanupAll")
+	}
+
+	if transport.IsConnected() {
+		t.Error("Expected transport to be closed")
+	}
+
+	liveTransportsMu.Lock()
+	_, registered = liveTransports[transport]
+	liveTransportsMu.Unlock()
+	if registered {
+		t.Error("Expected closed transport to be unregistered")
+	}
+}
@@ -0,0 +1,68 @@
+package claudecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// SessionState is the minimal state needed to resume a session
+type SessionState struct {
+	SessionID    string  `json:"session_id"`
+	TotalCostUSD float64 `json:"total_cost_usd"`
+	NumTurns     int     `json:"num_turns"`
+}
+
+// LoadSessionState reads a session state file written by Session.SaveState
+func LoadSessionState(path string) (*SessionState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session state: %w", err)
+	}
+
+	var state SessionState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, &JSONDecodeError{Data: data, Err: err}
+	}
+	if state.SessionID == "" {
+		return nil, &ClaudeError{
+			Code:    "INVALID_SESSION_STATE",
+			Message: "session state has no session ID: " + path,
+		}
+	}
+
+	return &state, nil
+}
+
+// State returns a snapshot of the session's resumable state
+func (s *session) State() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SessionState{
+		SessionID:    s.sessionID,
+		TotalCostUSD: s.totalCostUSD,
+		NumTurns:     s.numTurns,
+	}
+}
+
+// SaveState writes the session ID and cumulative cost and turn count to path.
+// The session ID is only known once a ResultMessage has been received.
+func (s *session) SaveState(path string) error {
+	state := s.State()
+	if state.SessionID == "" {
+		return &ClaudeError{
+			Code:    "INVALID_SESSION_STATE",
+			Message: "session ID not yet known; receive a result before saving state",
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session state: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write session state: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package claudecode
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionStateRoundTrip(t *testing.T) {
+	cliPath := writeFakeCLI(t, `while read -r line; do
+  echo '{"type":"result","subtype":"success","session_id":"sess-42","num_turns":3,"total_cost_usd":0.5}'
+done
+`)
+	statePath := filepath.Join(t.TempDir(), "state.json")
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := first.Send(ctx, "Hello"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := first.ReceiveOne(ctx); err != nil {
+		t.Fatalf("Failed to receive: %v", err)
+	}
+	if err := first.SaveState(statePath); err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	first.Close()
+
+	restored, err := c.RestoreSession(ctx, statePath)
+	if err != nil {
+		t.Fatalf("Failed to restore session: %v", err)
+	}
+	defer restored.Close()
+
+	want := SessionState{SessionID: "sess-42", TotalCostUSD: 0.5, NumTurns: 3}
+	if got := restored.State(); got != want {
+		t.Errorf("Restored state = %+v, want %+v", got, want)
+	}
+
+	transport := restored.(*session).transport
+	args, err := transport.buildCommand()
+	if err != nil {
+		t.Fatalf("buildCommand failed: %v", err)
+	}
+	resume := ""
+	for i, arg := range args {
+		if arg == "--resume" && i+1 < len(args) {
+			resume = args[i+1]
+		}
+	}
+	if resume != "sess-42" {
+		t.Errorf("Expected --resume sess-42, got %v", args)
+	}
+
+	// The resumed process reports its own running total, which is added to
+	// the restored cost
+	if err := restored.Send(ctx, "Hello again"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := restored.ReceiveOne(ctx); err != nil {
+		t.Fatalf("Failed to receive: %v", err)
+	}
+	if got := restored.State().TotalCostUSD; got != 1.0 {
+		t.Errorf("Total cost after resuming = %v, want 1.0", got)
+	}
+}
+
+func TestSaveStateWithoutSessionID(t *testing.T) {
+	s := &session{}
+	if err := s.SaveState(filepath.Join(t.TempDir(), "state.json")); err == nil {
+		t.Error("Expected error saving state without a session ID")
+	}
+}
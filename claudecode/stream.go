@@ -0,0 +1,54 @@
+package claudecode
+
+import (
+	"context"
+	"iter"
+)
+
+// Stream sends a query and returns an iterator over the response messages,
+// for use with range:
+//
+//	for msg, err := range client.Stream(ctx, "Tell me a story") {
+//		if err != nil {
+//			return err
+//		}
+//		// Process msg
+//	}
+//
+// An error is yielded once, as the last value, when the query cannot start,
+// the CLI exits with an error, the query is stopped by WithMaxToolUsesPerTurn,
+// WithAbortOnToolError, or WithCostBudget, or ctx is done before the result
+// arrives.
+// Breaking out of the loop stops the CLI and waits for it to exit.
+func (c *client) Stream(ctx context.Context, prompt string, opts ...QueryOption) iter.Seq2[Message, error] {
+	return func(yield func(Message, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		msgChan, streamErr, err := c.queryStream(ctx, prompt, opts...)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		sawResult := false
+		for msg := range msgChan {
+			if !yield(msg, nil) {
+				// The transport is closed before msgChan, so draining it
+				// waits for the CLI to be stopped
+				cancel()
+				for range msgChan {
+				}
+				return
+			}
+			if _, ok := finalResult(msg); ok {
+				sawResult = true
+			}
+		}
+		if err := streamErr(); err != nil {
+			yield(nil, err)
+		} else if err := ctx.Err(); err != nil && !sawResult {
+			yield(nil, err)
+		}
+	}
+}
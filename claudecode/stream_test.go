@@ -0,0 +1,148 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestStreamBreakStopsCLI tests that breaking out of a Stream loop stops the
+// CLI before the loop returns
+func TestStreamBreakStopsCLI(t *testing.T) {
+	pidPath := filepath.Join(t.TempDir(), "pid")
+	cliPath := writeFakeCLI(t, `echo $$ > "$PID_CAPTURE"
+read line
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Once upon a time"}]}}'
+exec sleep 30
+`)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("PID_CAPTURE", pidPath),
+		WithCloseTimeout(200*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	count := 0
+	for msg, err := range c.Stream(ctx, "Tell me a story") {
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if _, ok := msg.(*AssistantMessage); !ok {
+			t.Errorf("Expected *AssistantMessage, got %T", msg)
+		}
+		count++
+		break
+	}
+	if count != 1 {
+		t.Fatalf("Expected 1 message before breaking, got %d", count)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Stream took %v to stop the CLI after break", elapsed)
+	}
+
+	data, err := os.ReadFile(pidPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured pid: %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("Invalid pid %q: %v", data, err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatalf("Failed to find process: %v", err)
+	}
+	if err := proc.Signal(syscall.Signal(0)); err == nil {
+		t.Error("Expected the CLI process to have exited")
+	}
+}
+
+// TestStreamYieldsExitError tests that a CLI exiting with an error before its
+// result yields the error after the messages received
+func TestStreamYieldsExitError(t *testing.T) {
+	cliPath := writeFakeCLI(t, `read line
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Step one"}]}}'
+echo 'fatal: out of memory' >&2
+exit 1
+`)
+
+	c, err := New(WithCLIPath(cliPath))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var messages []Message
+	var errs []error
+	for msg, err := range c.Stream(ctx, "Hello") {
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+
+	if len(messages) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(messages))
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], ErrProcessExited) {
+		t.Errorf("Expected a single ErrProcessExited, got %v", errs)
+	}
+}
+
+// TestStreamResultPartialText tests that the text received before a
+// cancellation is kept in the StreamResult
+func TestStreamResultPartialText(t *testing.T) {
+	cliPath := writeFakeCLI(t, `read line
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Once upon a time"}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"there was a gopher"}]}}'
+exec sleep 30
+`)
+
+	c, err := New(WithCLIPath(cliPath), WithCloseTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var result StreamResult
+	msgChan, err := c.QueryStream(ctx, "Tell me a story", WithStreamResult(&result))
+	if err != nil {
+		t.Fatalf("QueryStream failed: %v", err)
+	}
+
+	received := 0
+	for range msgChan {
+		received++
+		if received == 2 {
+			cancel()
+		}
+	}
+
+	if got, want := result.PartialText(), "Once upon a time\nthere was a gopher"; got != want {
+		t.Errorf("PartialText() = %q, want %q", got, want)
+	}
+	if result.Result() != nil {
+		t.Errorf("Expected no result after cancelling, got %+v", result.Result())
+	}
+}
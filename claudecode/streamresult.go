@@ -0,0 +1,51 @@
+package claudecode
+
+import (
+	"strings"
+	"sync"
+)
+
+// StreamResult accumulates the output of a streaming query as it is
+// received, so that a consumer that stops early, such as a "stop generating"
+// button, keeps the text produced so far. Attach it with WithStreamResult.
+type StreamResult struct {
+	mu     sync.Mutex
+	texts  []string
+	result *ResultMessage
+}
+
+// PartialText returns the text of the assistant messages received so far,
+// joined with newlines. After a cancelled stream it holds the text produced
+// before the stop.
+func (r *StreamResult) PartialText() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return strings.Join(r.texts, "\n")
+}
+
+// Result returns the final ResultMessage, or nil if the stream stopped
+// before it arrived
+func (r *StreamResult) Result() *ResultMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.result
+}
+
+// observe records the text or result carried by msg
+func (r *StreamResult) observe(msg Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch m := msg.(type) {
+	case *AssistantMessage:
+		for _, block := range m.Content {
+			if block.Text != nil {
+				r.texts = append(r.texts, *block.Text)
+			}
+		}
+	case *ResultMessage:
+		if m.IsFinal() {
+			r.result = m
+		}
+	}
+}
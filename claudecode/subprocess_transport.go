@@ -2,7 +2,6 @@ package claudecode
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -12,6 +11,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,8 +20,13 @@ import (
 )
 
 const (
-	maxBufferSize = 1024 * 1024 // 1MB buffer limit
-	stderrLines   = 100         // Keep last N stderr lines
+	defaultStderrLines   = 100             // Default trailing stderr lines kept
+	interruptGracePeriod = 2 * time.Second // Default time allowed after an interrupt before killing
+	oversizedHeadBytes   = 512             // Leading bytes logged for oversized messages
+	defaultCloseTimeout  = 5 * time.Second // Time Close waits for the process before killing it
+	defaultInitTimeout   = time.Minute     // Time Connect waits for the init message
+	defaultMaxMessage    = 64 << 20        // Largest message read from stdout, in bytes
+	maxStdinBatch        = 64              // Queued prompts coalesced into one stdin write
 )
 
 // SubprocessTransport implements Transport using subprocess
@@ -33,16 +39,43 @@ type SubprocessTransport struct {
 	connected  atomic.Bool
 	logger     *slog.Logger
 
+	// Output decoding
+	decoder *json.Decoder
+	source  io.Reader           // unread stdout after the decoder's buffer
+	limit   *messageLimitReader // bounds the bytes the decoder reads per message
+	pending []json.RawMessage
+
 	// Streaming support
 	isStreaming           bool
 	prompt                string
 	promptChan            <-chan map[string]any
 	closeStdinAfterPrompt bool
+	jsonOutput            bool   // print the result as a single JSON object
+	sessionID             string // names a new conversation with --session-id
 
 	// Synchronization
 	mu          sync.Mutex
 	receiveDone chan struct{}
+	closeCh     chan struct{}
+	ready       chan struct{}
+	readyOnce   sync.Once
+	stdinMu     sync.Mutex
 	stdinClosed atomic.Bool
+	stdinBuf    *bufio.Writer // guarded by stdinMu
+	stdinEnc    *json.Encoder // encodes into stdinBuf
+	turnActive  atomic.Bool
+	receiving   atomic.Bool
+	exitErr     atomic.Pointer[ProcessError]
+
+	// Control requests awaiting a response, by request ID. IDs are
+	// numbered by controlSeq so that requests built at once stay distinct.
+	controlMu      sync.Mutex
+	controlWaiters map[string]chan ControlResponse
+	controlSeq     atomic.Uint64
+
+	// Lifecycle logging
+	startedAt        time.Time
+	firstMessageSeen bool
 }
 
 // NewSubprocessTransport creates a new subprocess transport
@@ -56,6 +89,8 @@ func NewSubprocessTransport(opts *Options) *SubprocessTransport {
 		options:     opts,
 		logger:      logger.With("component", "subprocess-transport"),
 		receiveDone: make(chan struct{}),
+		closeCh:     make(chan struct{}),
+		ready:       make(chan struct{}),
 	}
 }
 
@@ -97,15 +132,7 @@ func (t *SubprocessTransport) findCLI() (string, error) {
 	}
 
 	// Check common locations
-	locations := []string{
-		filepath.Join(os.Getenv("HOME"), ".npm-global/bin/claude"),
-		"/usr/local/bin/claude",
-		filepath.Join(os.Getenv("HOME"), ".local/bin/claude"),
-		filepath.Join(os.Getenv("HOME"), "node_modules/.bin/claude"),
-		filepath.Join(os.Getenv("HOME"), ".yarn/bin/claude"),
-	}
-
-	for _, loc := range locations {
+	for _, loc := range cliSearchPaths() {
 		if _, err := os.Stat(loc); err == nil {
 			return loc, nil
 		}
@@ -127,6 +154,60 @@ func (t *SubprocessTransport) findCLI() (string, error) {
 		"  New(WithCLIPath(\"/path/to/claude\"))")
 }
 
+// cliSearchPaths returns the common installation locations of the Claude CLI.
+// Locations relative to the home directory are skipped when it is unknown, so
+// that paths such as "/.npm-global/bin/claude" are never probed.
+func cliSearchPaths() []string {
+	if runtime.GOOS == "windows" {
+		var locations []string
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			locations = append(locations, filepath.Join(appData, "npm", "claude.cmd"))
+		}
+		if home := os.Getenv("USERPROFILE"); home != "" {
+			locations = append(locations,
+				filepath.Join(home, ".npm-global", "claude.cmd"),
+				filepath.Join(home, "node_modules", ".bin", "claude.cmd"),
+				filepath.Join(home, ".yarn", "bin", "claude.cmd"),
+			)
+		}
+		return locations
+	}
+
+	home := os.Getenv("HOME")
+	if home == "" {
+		return []string{"/usr/local/bin/claude"}
+	}
+
+	return []string{
+		filepath.Join(home, ".npm-global/bin/claude"),
+		"/usr/local/bin/claude",
+		filepath.Join(home, ".local/bin/claude"),
+		filepath.Join(home, "node_modules/.bin/claude"),
+		filepath.Join(home, ".yarn/bin/claude"),
+	}
+}
+
+// commandArgs returns the argv used to start the CLI, using the configured
+// CommandBuilder if one is set
+func (t *SubprocessTransport) commandArgs() ([]string, error) {
+	if t.options.CommandBuilder == nil {
+		return t.buildCommand()
+	}
+
+	mode := TransportModeOneShot
+	if t.isStreaming {
+		mode = TransportModeStreaming
+	}
+	args, err := t.options.CommandBuilder(t.options, mode, t.prompt)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%w: command builder returned an empty command", ErrConnectionFailed)
+	}
+	return args, nil
+}
+
 // buildCommand constructs the CLI command with arguments
 func (t *SubprocessTransport) buildCommand() ([]string, error) {
 	cliPath, err := t.findCLI()
@@ -135,17 +216,25 @@ func (t *SubprocessTransport) buildCommand() ([]string, error) {
 	}
 
 	args := []string{cliPath, "--output-format", "stream-json", "--verbose"}
+	if t.jsonOutput {
+		// With --verbose the CLI would print every message, not just the result
+		args = []string{cliPath, "--output-format", "json"}
+	}
 
 	if t.options.SystemPrompt != "" {
 		args = append(args, "--system-prompt", t.options.SystemPrompt)
 	}
 
-	if t.options.AppendSystemPrompt != "" {
-		args = append(args, "--append-system-prompt", t.options.AppendSystemPrompt)
+	if appended := t.options.appendedSystemPrompt(); appended != "" {
+		args = append(args, "--append-system-prompt", appended)
+	}
+
+	if allowed := t.options.allowedTools(); len(allowed) > 0 {
+		args = append(args, "--allowedTools", strings.Join(allowed, ","))
 	}
 
-	if len(t.options.AllowedTools) > 0 {
-		args = append(args, "--allowedTools", strings.Join(t.options.AllowedTools, ","))
+	if t.options.DenyByDefault {
+		args = append(args, "--tools", strings.Join(t.options.builtinTools(), ","))
 	}
 
 	if t.options.MaxTurns > 0 {
@@ -176,29 +265,48 @@ func (t *SubprocessTransport) buildCommand() ([]string, error) {
 		args = append(args, "--permission-prompt-tool-name", t.options.PermissionPromptToolName)
 	}
 
-	if t.options.Continue {
+	// Permission prompts are answered on stdin, which must stay open
+	if (t.options.PermissionHandler != nil || t.options.EditFilter != nil) && t.isStreaming && !t.closeStdinAfterPrompt {
+		args = append(args, "--permission-prompt-tool", "stdio")
+	}
+
+	if t.options.AggregateDeltas {
+		args = append(args, "--include-partial-messages")
+	}
+
+	continuing := t.options.Continue || (t.options.ContinueOrNew && t.hasConversation())
+	if continuing {
 		args = append(args, "--continue")
 	}
 
 	if t.options.Resume != "" {
 		args = append(args, "--resume", t.options.Resume)
+	} else if t.sessionID != "" && !continuing {
+		args = append(args, "--session-id", t.sessionID)
 	}
 
-	if t.options.Settings != "" {
-		args = append(args, "--settings", t.options.Settings)
+	settings, err := t.buildSettings()
+	if err != nil {
+		return nil, err
+	}
+	if settings != "" {
+		args = append(args, "--settings", settings)
 	}
 
-	for _, dir := range t.options.AddDirs {
+	for _, dir := range t.options.addDirs() {
 		args = append(args, "--add-dir", dir)
 	}
 
-	if len(t.options.MCPServers) > 0 {
-		mcpConfig := map[string]any{"mcpServers": t.options.MCPServers}
-		configJSON, err := json.Marshal(mcpConfig)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal MCP config: %w", err)
-		}
-		args = append(args, "--mcp-config", string(configJSON))
+	mcpConfig, err := t.buildMCPConfig()
+	if err != nil {
+		return nil, err
+	}
+	if mcpConfig != "" {
+		args = append(args, "--mcp-config", mcpConfig)
+	}
+
+	if t.options.StrictMCPConfig {
+		args = append(args, "--strict-mcp-config")
 	}
 
 	// Add prompt handling based on mode
@@ -211,6 +319,152 @@ func (t *SubprocessTransport) buildCommand() ([]string, error) {
 	return args, nil
 }
 
+// buildMCPConfig returns the value for the --mcp-config flag. Without inline
+// servers this is the configured file path; otherwise the file's servers are
+// merged with the inline servers into inline JSON, with inline servers
+// overriding file servers of the same name. Registered tool providers add the
+// in-process SDK server.
+func (t *SubprocessTransport) buildMCPConfig() (string, error) {
+	// The in-process server is reached over stdin, which must stay open
+	sdkServer := len(t.options.ToolProviders) > 0 && t.isStreaming && !t.closeStdinAfterPrompt
+	if len(t.options.MCPServers) == 0 && !sdkServer {
+		return t.options.MCPConfigFile, nil
+	}
+
+	servers := make(map[string]any)
+	if t.options.MCPConfigFile != "" {
+		data, err := os.ReadFile(t.options.MCPConfigFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read MCP config file: %w", err)
+		}
+		var fileConfig struct {
+			MCPServers map[string]json.RawMessage `json:"mcpServers"`
+		}
+		if err := json.Unmarshal(data, &fileConfig); err != nil {
+			return "", &JSONDecodeError{Data: data, Err: err}
+		}
+		for name, server := range fileConfig.MCPServers {
+			servers[name] = server
+		}
+	}
+
+	for name, server := range t.options.MCPServers {
+		servers[name] = server
+	}
+	if sdkServer {
+		servers[sdkMCPServerName] = map[string]any{"type": "sdk", "name": sdkMCPServerName}
+	}
+
+	configJSON, err := json.Marshal(map[string]any{"mcpServers": servers})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal MCP config: %w", err)
+	}
+	return string(configJSON), nil
+}
+
+// buildSettings returns the value for the --settings flag. Without
+// SDK-generated settings this is the configured settings path; otherwise the
+// settings file is merged with the generated settings into inline JSON.
+func (t *SubprocessTransport) buildSettings() (string, error) {
+	if len(t.options.SettingsDisabledTools) == 0 && t.options.OutputStyle == "" && len(t.options.ModelOptions) == 0 {
+		return t.options.Settings, nil
+	}
+
+	settings := make(map[string]any)
+	if t.options.Settings != "" {
+		data, err := os.ReadFile(t.options.Settings)
+		if err != nil {
+			return "", fmt.Errorf("failed to read settings file: %w", err)
+		}
+		if err := json.Unmarshal(data, &settings); err != nil {
+			return "", &JSONDecodeError{Data: data, Err: err}
+		}
+	}
+
+	if t.options.OutputStyle != "" {
+		settings["outputStyle"] = t.options.OutputStyle
+	}
+
+	if len(t.options.SettingsDisabledTools) > 0 {
+		mergeDeniedTools(settings, t.options.SettingsDisabledTools)
+	}
+
+	if len(t.options.ModelOptions) > 0 {
+		modelOptions, _ := settings["modelOptions"].(map[string]any)
+		if modelOptions == nil {
+			modelOptions = make(map[string]any, len(t.options.ModelOptions))
+		}
+		for key, value := range t.options.ModelOptions {
+			modelOptions[key] = value
+		}
+		settings["modelOptions"] = modelOptions
+	}
+
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal settings: %w", err)
+	}
+	return string(settingsJSON), nil
+}
+
+// mergeDeniedTools appends tools to the permissions.deny list of settings,
+// skipping tools that are already denied
+func mergeDeniedTools(settings map[string]any, tools []string) {
+	permissions, _ := settings["permissions"].(map[string]any)
+	if permissions == nil {
+		permissions = make(map[string]any)
+	}
+
+	deny, _ := permissions["deny"].([]any)
+	seen := make(map[string]bool)
+	for _, tool := range deny {
+		if name, ok := tool.(string); ok {
+			seen[name] = true
+		}
+	}
+	for _, tool := range tools {
+		if !seen[tool] {
+			deny = append(deny, tool)
+			seen[tool] = true
+		}
+	}
+
+	permissions["deny"] = deny
+	settings["permissions"] = permissions
+}
+
+// telemetryDisabledEnv are the environment variables that stop the CLI from
+// sending telemetry and error reports
+var telemetryDisabledEnv = []string{
+	"DISABLE_TELEMETRY=1",
+	"DISABLE_ERROR_REPORTING=1",
+}
+
+// buildEnv constructs the environment for the CLI process
+func (t *SubprocessTransport) buildEnv() []string {
+	var env []string
+	if t.options.EnvPassthrough == nil {
+		env = os.Environ()
+	} else {
+		for _, name := range t.options.EnvPassthrough {
+			if value, ok := os.LookupEnv(name); ok {
+				env = append(env, name+"="+value)
+			}
+		}
+	}
+
+	for key, value := range t.options.Env {
+		env = append(env, key+"="+value)
+	}
+
+	// Later entries win, so these override the inherited and added values
+	if t.options.DisableTelemetry {
+		env = append(env, telemetryDisabledEnv...)
+	}
+
+	return append(env, "CLAUDE_CODE_ENTRYPOINT=sdk-go")
+}
+
 // Connect establishes the subprocess connection
 func (t *SubprocessTransport) Connect(ctx context.Context) error {
 	t.mu.Lock()
@@ -220,7 +474,7 @@ func (t *SubprocessTransport) Connect(ctx context.Context) error {
 		return nil
 	}
 
-	cmdArgs, err := t.buildCommand()
+	cmdArgs, err := t.commandArgs()
 	if err != nil {
 		return err
 	}
@@ -231,9 +485,17 @@ func (t *SubprocessTransport) Connect(ctx context.Context) error {
 		return fmt.Errorf("%w: failed to create stderr file: %v", ErrConnectionFailed, err)
 	}
 
+	// With interrupt-on-cancel the process must outlive the context so it can
+	// be interrupted and closed gracefully instead of killed
+	procCtx := ctx
+	if t.options.InterruptOnContextCancel {
+		procCtx = context.WithoutCancel(ctx)
+	}
+
 	// Build command
-	t.cmd = exec.CommandContext(ctx, cmdArgs[0], cmdArgs[1:]...)
-	t.cmd.Env = append(os.Environ(), "CLAUDE_CODE_ENTRYPOINT=sdk-go")
+	t.cmd = exec.CommandContext(procCtx, cmdArgs[0], cmdArgs[1:]...)
+	t.cmd.Env = t.buildEnv()
+	setProcessAttributes(t.cmd)
 
 	if t.options.WorkingDirectory != "" {
 		t.cmd.Dir = t.options.WorkingDirectory
@@ -253,6 +515,17 @@ func (t *SubprocessTransport) Connect(ctx context.Context) error {
 
 	t.cmd.Stderr = t.stderrFile
 
+	var stdout io.Reader = t.stdout
+	if t.options.StdoutTee != nil {
+		stdout = io.TeeReader(t.stdout, t.options.StdoutTee)
+	}
+	t.source = bufio.NewReader(stdout)
+	t.resetDecoder()
+
+	if t.options.CommandObserver != nil {
+		t.options.CommandObserver(slices.Clone(cmdArgs), slices.Clone(t.cmd.Env))
+	}
+
 	if err := t.cmd.Start(); err != nil {
 		t.cleanup()
 		if t.options.WorkingDirectory != "" {
@@ -263,35 +536,240 @@ func (t *SubprocessTransport) Connect(ctx context.Context) error {
 		return fmt.Errorf("%w: %v", ErrConnectionFailed, err)
 	}
 
+	t.startedAt = time.Now()
 	t.connected.Store(true)
-	t.logger.Debug("subprocess started", slog.Int("pid", t.cmd.Process.Pid))
+	registerTransport(t)
+	t.logStarted(cmdArgs)
 
 	if t.isStreaming && t.promptChan != nil {
-		go t.streamToStdin(ctx)
+		if !t.flushBufferedPrompts() {
+			go t.streamToStdin(procCtx)
+		}
 	} else if !t.isStreaming {
 		// Close stdin immediately for one-shot mode
 		t.stdin.Close()
 		t.stdinClosed.Store(true)
 	}
 
+	if len(t.options.RequiredMCPServers) > 0 {
+		if err := t.awaitInit(ctx); err != nil {
+			t.abortConnect()
+			return err
+		}
+	}
+
+	if t.options.InterruptOnContextCancel {
+		go t.interruptOnCancel(ctx)
+	}
+
+	if t.isStreaming && t.options.HeartbeatInterval > 0 {
+		go t.heartbeat(procCtx, t.options.HeartbeatInterval)
+	}
+
 	return nil
 }
 
-// streamToStdin handles streaming prompts to stdin
-func (t *SubprocessTransport) streamToStdin(ctx context.Context) {
-	defer func() {
-		if !t.stdinClosed.Load() {
-			t.stdin.Close()
-			t.stdinClosed.Store(true)
+// abortConnect stops a process that started but failed to become ready. It
+// tears the transport down as Close does, so that the goroutines Connect
+// started exit. The caller must hold t.mu.
+func (t *SubprocessTransport) abortConnect() {
+	t.connected.Store(false)
+	close(t.closeCh)
+	unregisterTransport(t)
+
+	_ = t.cmd.Process.Kill()
+	if t.receiving.CompareAndSwap(false, true) {
+		_ = t.wait()
+		close(t.receiveDone)
+	}
+	t.cleanup()
+}
+
+// heartbeat sends a ping control request every interval while no turn is in
+// progress, until ctx is done or the process exits
+func (t *SubprocessTransport) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.closeCh:
+			return
+		case <-t.receiveDone:
+			return
+		case <-ticker.C:
 		}
-	}()
 
-	encoder := json.NewEncoder(t.stdin)
+		if t.stdinClosed.Load() {
+			return
+		}
+		if err := t.ping(); err != nil {
+			t.logger.Debug("failed to send heartbeat", slog.Any("error", err))
+			return
+		}
+	}
+}
+
+// heartbeatRequestPrefix begins the IDs of heartbeat control requests, so
+// that their responses can be told apart from those of other requests
+const heartbeatRequestPrefix = "heartbeat_"
+
+// ping writes a heartbeat control request unless a turn is in progress. The
+// CLI has no no-op control request and answers it with an error; the request
+// only keeps the connection warm, so the response is discarded.
+func (t *SubprocessTransport) ping() error {
+	t.stdinMu.Lock()
+	defer t.stdinMu.Unlock()
+
+	if t.turnActive.Load() {
+		return nil
+	}
+	req := t.newControlRequest("ping")
+	req["request_id"] = heartbeatRequestPrefix + controlRequestID(req)
+	if err := t.encodeStdinLocked(req); err != nil {
+		return err
+	}
+	return t.stdinBuf.Flush()
+}
+
+// interruptOnCancel waits for ctx to be cancelled, then interrupts the CLI and
+// gives it the cancel grace period to finish before killing it and closing
+// the transport
+func (t *SubprocessTransport) interruptOnCancel(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-t.closeCh:
+		return
+	}
+
+	if err := t.Interrupt(context.Background()); err != nil {
+		// One-shot mode has no stdin for control requests; signal instead
+		if sigErr := t.cmd.Process.Signal(os.Interrupt); sigErr != nil {
+			t.logger.Debug("failed to interrupt subprocess", slog.Any("error", err))
+		}
+	}
+
+	grace := t.options.CancelGracePeriod
+	if grace <= 0 {
+		grace = interruptGracePeriod
+	}
+
+	select {
+	case <-t.receiveDone:
+	case <-time.After(grace):
+		// Cancellation means stop now, so do not wait out the close timeout
+		t.logger.Debug("subprocess still running after cancel grace period, killing", slog.Duration("grace", grace))
+		_ = t.cmd.Process.Kill()
+	}
+
+	if err := t.Close(); err != nil {
+		t.logger.Debug("failed to close subprocess after interrupt", slog.Any("error", err))
+	}
+}
+
+// encodeStdinLocked encodes msg into the stdin buffer without flushing it.
+// The buffer and its encoder are created on first use. Encoding a user
+// message starts a turn, which lasts until the CLI reports a result. The
+// caller must hold t.stdinMu.
+func (t *SubprocessTransport) encodeStdinLocked(msg map[string]any) error {
+	if t.stdinEnc == nil {
+		t.stdinBuf = bufio.NewWriter(t.stdin)
+		t.stdinEnc = json.NewEncoder(t.stdinBuf)
+		if t.options.PrettyStdin {
+			t.stdinEnc.SetIndent("", "  ")
+		}
+	}
+
+	if msg["type"] == "user" {
+		t.turnActive.Store(true)
+	}
+	return t.stdinEnc.Encode(msg)
+}
+
+// writeStdin encodes msg to the process stdin. Writes are serialized so that
+// concurrent senders cannot interleave lines.
+func (t *SubprocessTransport) writeStdin(msg map[string]any) error {
+	return t.writeStdinBatch([]map[string]any{msg})
+}
+
+// writeStdinBatch encodes msgs to the process stdin in order and flushes them
+// together, so that a burst of messages costs as few writes as possible
+func (t *SubprocessTransport) writeStdinBatch(msgs []map[string]any) error {
+	t.stdinMu.Lock()
+	defer t.stdinMu.Unlock()
+
+	for _, msg := range msgs {
+		if err := t.encodeStdinLocked(msg); err != nil {
+			return err
+		}
+	}
+	return t.stdinBuf.Flush()
+}
+
+// newControlRequest builds a control request with the given subtype and the
+// transport's next request ID
+func (t *SubprocessTransport) newControlRequest(subtype string) map[string]any {
+	return map[string]any{
+		"type":       "control_request",
+		"request_id": fmt.Sprintf("req_%d", t.controlSeq.Add(1)),
+		"request": map[string]string{
+			"subtype": subtype,
+		},
+	}
+}
+
+// flushBufferedPrompts writes the prompts already buffered in promptChan
+// before Connect returns, so that a single queued prompt cannot race the
+// closing of stdin and a session's initial messages reach the CLI before
+// Connect waits for the init message. It reports whether stdin has been
+// closed, which happens once a write fails or, when stdin closes after the
+// prompt, promptChan is found closed.
+func (t *SubprocessTransport) flushBufferedPrompts() bool {
+	for {
+		batch, open := t.drainPrompts(nil)
+		if len(batch) > 0 {
+			if err := t.writeStdinBatch(batch); err != nil {
+				t.logger.Debug("error writing to stdin", slog.Any("error", err))
+				t.closeStdin()
+				return true
+			}
+		}
+		if !open {
+			if !t.closeStdinAfterPrompt {
+				return false
+			}
+			t.closeStdin()
+			return true
+		}
+		if len(batch) < maxStdinBatch {
+			return false
+		}
+	}
+}
+
+// closeStdin closes the process stdin once, after any write in progress has
+// completed so that the CLI never sees a truncated message before EOF
+func (t *SubprocessTransport) closeStdin() {
+	t.stdinMu.Lock()
+	defer t.stdinMu.Unlock()
+
+	if t.stdinClosed.CompareAndSwap(false, true) {
+		t.stdin.Close()
+	}
+}
+
+// streamToStdin handles streaming prompts to stdin
+func (t *SubprocessTransport) streamToStdin(ctx context.Context) {
+	defer t.closeStdin()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-t.closeCh:
+			return
 		case msg, ok := <-t.promptChan:
 			if !ok {
 				if t.closeStdinAfterPrompt {
@@ -306,16 +784,39 @@ func (t *SubprocessTransport) streamToStdin(ctx context.Context) {
 				}
 			}
 
-			if err := encoder.Encode(msg); err != nil {
+			// Coalesce prompts that are already queued into one write
+			batch, open := t.drainPrompts([]map[string]any{msg})
+			if err := t.writeStdinBatch(batch); err != nil {
 				if t.logger != nil {
 					t.logger.Debug("error writing to stdin", slog.Any("error", err))
 				}
 				return
 			}
+			if !open && t.closeStdinAfterPrompt {
+				return
+			}
 		}
 	}
 }
 
+// drainPrompts appends the prompts that can be received from promptChan
+// without blocking to batch, up to maxStdinBatch. It reports false if
+// promptChan was found closed.
+func (t *SubprocessTransport) drainPrompts(batch []map[string]any) ([]map[string]any, bool) {
+	for len(batch) < maxStdinBatch {
+		select {
+		case msg, ok := <-t.promptChan:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, msg)
+		default:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
 // Send sends messages to Claude
 func (t *SubprocessTransport) Send(ctx context.Context, messages []map[string]any) error {
 	if !t.isStreaming {
@@ -330,11 +831,8 @@ func (t *SubprocessTransport) Send(ctx context.Context, messages []map[string]an
 		return errors.New("stdin closed - stream may have ended")
 	}
 
-	encoder := json.NewEncoder(t.stdin)
-	for _, msg := range messages {
-		if err := encoder.Encode(msg); err != nil {
-			return fmt.Errorf("failed to encode message: %w", err)
-		}
+	if err := t.writeStdinBatch(messages); err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
 	}
 
 	return nil
@@ -346,128 +844,477 @@ func (t *SubprocessTransport) Receive(ctx context.Context) (<-chan map[string]an
 		return nil, ErrNotConnected
 	}
 
+	// Only one reader may consume stdout, and receiveDone is closed once
+	if !t.receiving.CompareAndSwap(false, true) {
+		return nil, ErrAlreadyReceiving
+	}
+
 	msgChan := make(chan map[string]any)
 
-	go func() {
-		defer close(msgChan)
-		defer close(t.receiveDone)
+	go t.receive(ctx, func() { close(msgChan) }, func(raw json.RawMessage, _ rawEnvelope) bool {
+		var data map[string]any
+		if err := json.Unmarshal(raw, &data); err != nil {
+			t.logger.Debug("failed to decode message", slog.Any("error", err))
+			return true
+		}
+		return deliver(ctx, t.closeCh, msgChan, data)
+	})
+
+	return msgChan, nil
+}
+
+// receivedMessage is a message read from the CLI, kept as its original JSON
+// so that it can be parsed without first being decoded as a map. The map is
+// only built, by decode, for the callbacks that inspect it and for protocol
+// versions that rename fields.
+type receivedMessage struct {
+	raw      json.RawMessage
+	envelope rawEnvelope
+	data     map[string]any
+}
+
+// decode returns the message decoded as a map, decoding it on first use
+func (m *receivedMessage) decode() map[string]any {
+	if m.data == nil {
+		_ = json.Unmarshal(m.raw, &m.data)
+	}
+	return m.data
+}
+
+// parse parses the message into a typed Message, directly from its JSON
+// unless the protocol version renames fields
+func (m *receivedMessage) parse(version ProtocolVersion) (Message, error) {
+	if version == ProtocolCurrent {
+		return ParseMessageJSON(m.raw)
+	}
+	return ParseMessageVersion(m.decode(), version)
+}
+
+// receiveMessages is like Receive but delivers each message with its original
+// JSON, for the client's receive loops
+func (t *SubprocessTransport) receiveMessages(ctx context.Context) (<-chan receivedMessage, error) {
+	if !t.connected.Load() {
+		return nil, ErrNotConnected
+	}
+
+	// Only one reader may consume stdout, and receiveDone is closed once
+	if !t.receiving.CompareAndSwap(false, true) {
+		return nil, ErrAlreadyReceiving
+	}
+
+	msgChan := make(chan receivedMessage)
+
+	go t.receive(ctx, func() { close(msgChan) }, func(raw json.RawMessage, envelope rawEnvelope) bool {
+		return deliver(ctx, t.closeCh, msgChan, receivedMessage{raw: raw, envelope: envelope})
+	})
+
+	return msgChan, nil
+}
+
+// ReceiveRaw is like Receive but delivers the undecoded JSON of each message,
+// avoiding the map decoding. Use ParseMessageJSON to decode the messages.
+func (t *SubprocessTransport) ReceiveRaw(ctx context.Context) (<-chan json.RawMessage, error) {
+	if !t.connected.Load() {
+		return nil, ErrNotConnected
+	}
+
+	// Only one reader may consume stdout, and receiveDone is closed once
+	if !t.receiving.CompareAndSwap(false, true) {
+		return nil, ErrAlreadyReceiving
+	}
+
+	msgChan := make(chan json.RawMessage)
+
+	go t.receive(ctx, func() { close(msgChan) }, func(raw json.RawMessage, _ rawEnvelope) bool {
+		return deliver(ctx, t.closeCh, msgChan, raw)
+	})
+
+	return msgChan, nil
+}
+
+// receive reads messages from stdout and passes them to emit, with their
+// envelope fields, until stdout is exhausted or emit returns false, then waits
+// for the process to exit and calls done
+func (t *SubprocessTransport) receive(ctx context.Context, done func(), emit func(json.RawMessage, rawEnvelope) bool) {
+	defer done()
+	defer close(t.receiveDone)
+
+	// Replay messages read ahead of Receive during Connect
+	pending := t.pending
+	t.pending = nil
+
+	var deltas *deltaAggregator
+	if t.options.AggregateDeltas {
+		deltas = newDeltaAggregator()
+	}
+
+	for {
+		var raw json.RawMessage
+		if len(pending) > 0 {
+			raw, pending = pending[0], pending[1:]
+			if !emit(raw, peekEnvelope(raw)) {
+				break
+			}
+			continue
+		}
+
+		raw, err := t.readMessage()
+		if err != nil {
+			if err != io.EOF && t.logger != nil {
+				t.logger.Debug("stdout read error", slog.Any("error", err))
+			}
+			break
+		}
+
+		envelope := peekEnvelope(raw)
+
+		if limit := t.options.MaxMessageSizeLog; limit > 0 && len(raw) > limit {
+			t.logger.Warn("oversized message from CLI",
+				slog.Int("size", len(raw)),
+				slog.String("type", envelope.Type),
+				slog.String("head", string(raw[:min(len(raw), oversizedHeadBytes)])))
+		}
+
+		if envelope.Type == "control_response" {
+			t.handleControlResponse(raw)
+			continue
+		}
+
+		if envelope.Type == "control_request" {
+			go t.handleControlRequest(ctx, raw)
+			continue
+		}
 
-		scanner := bufio.NewScanner(t.stdout)
-		scanner.Buffer(make([]byte, 0, maxBufferSize), maxBufferSize)
+		// Sub-agent results do not end the turn
+		if envelope.Type == "result" && envelope.ParentToolUseID == "" {
+			t.turnActive.Store(false)
+		}
 
-		jsonBuffer := &bytes.Buffer{}
+		if envelope.Type == "system" && envelope.Subtype == "init" {
+			t.markReady()
+		}
 
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
+		if deltas != nil {
+			var ok bool
+			if raw, ok = deltas.filter(raw, envelope.Type); !ok {
 				continue
 			}
+			// Stream events are replaced by the consolidated message
+			if envelope.Type == "stream_event" {
+				envelope = peekEnvelope(raw)
+			}
+		}
 
-			// Handle multiple JSON objects on one line
-			lines := strings.Split(line, "\n")
-			for _, jsonLine := range lines {
-				jsonLine = strings.TrimSpace(jsonLine)
-				if jsonLine == "" {
-					continue
-				}
+		if !emit(raw, envelope) {
+			break
+		}
+	}
 
-				jsonBuffer.WriteString(jsonLine)
+	defer func() {
+		if r := recover(); r != nil {
+			// If we panic here, just silently ignore it
+			// The process is exiting anyway
+			fmt.Fprintf(os.Stderr, "recovered from panic during subprocess exit: %v\n", r)
+		}
+	}()
 
-				// Check buffer size
-				if jsonBuffer.Len() > maxBufferSize {
-					if t.logger != nil {
-						t.logger.Error("JSON buffer exceeded maximum size",
-							slog.Int("size", jsonBuffer.Len()))
-					}
-					jsonBuffer.Reset()
-					continue
-				}
+	// Wait for process to exit
+	err := t.wait()
+	if err != nil {
+		// Only log actual errors, not normal exits
+		// Check if this is a real error or just normal termination
+		if !t.connected.Load() || ctx.Err() != nil {
+			// We're disconnecting or were cancelled, this is expected
+			return
+		}
 
-				// Try to parse JSON
-				var data map[string]any
-				if err := json.Unmarshal(jsonBuffer.Bytes(), &data); err == nil {
-					jsonBuffer.Reset()
-
-					// Skip control responses
-					if data["type"] == "control_response" {
-						continue
-					}
-
-					select {
-					case msgChan <- data:
-					case <-ctx.Done():
-						return
-					}
+		// Check if it's an exit error with a non-zero code
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if t.connected.Load() {
+				stderr := t.readStderr()
+				t.exitErr.Store(&ProcessError{
+					ExitCode: exitErr.ExitCode(),
+					Stderr:   stderr,
+					Err:      fmt.Errorf("%w: %v", ErrProcessExited, err),
+				})
+				if stderr != "" {
+					fmt.Fprintf(os.Stderr, "Claude Code failed with exit status %d\n", exitErr.ExitCode())
+					fmt.Fprintf(os.Stderr, "Error details:\n%s\n", stderr)
+				} else {
+					fmt.Fprintf(os.Stderr, "subprocess exited with error: %v\n", err)
 				}
-				// If parse fails, continue accumulating
 			}
+		} else {
+			// This might be important, so log it to stderr
+			fmt.Fprintf(os.Stderr, "subprocess wait error: %v\n", err)
 		}
+	}
+}
 
-		if err := scanner.Err(); err != nil {
-			if t.logger != nil {
-				t.logger.Debug("scanner error", slog.Any("error", err))
+// deliver sends v to msgChan. It returns false if ctx is cancelled or closeCh
+// is closed before the message could be delivered, in which case the caller
+// stops reading and waits for the process to exit.
+func deliver[T any](ctx context.Context, closeCh <-chan struct{}, msgChan chan<- T, v T) bool {
+	select {
+	case msgChan <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-closeCh:
+		return false
+	}
+}
+
+// rawEnvelope holds the fields the transport inspects on each message
+type rawEnvelope struct {
+	Type            string `json:"type"`
+	Subtype         string `json:"subtype"`
+	ParentToolUseID string `json:"parent_tool_use_id"`
+}
+
+// peekEnvelope decodes the envelope fields of a raw message
+func peekEnvelope(raw json.RawMessage) rawEnvelope {
+	var envelope rawEnvelope
+	_ = json.Unmarshal(raw, &envelope)
+	return envelope
+}
+
+// readMessage decodes the next JSON object from stdout. Objects are read with
+// a streaming decoder, so they may be of any size and span multiple lines.
+// Output that is not valid JSON is skipped up to the next newline, as are JSON
+// values that are not objects. Invalid UTF-8 inside strings is left for the
+// final decode to replace with U+FFFD, so binary output cannot corrupt the
+// stream. It returns io.EOF once stdout is exhausted.
+func (t *SubprocessTransport) readMessage() (json.RawMessage, error) {
+	for {
+		var raw json.RawMessage
+		err := t.decoder.Decode(&raw)
+		if err == nil {
+			t.limit.read = 0
+			if len(raw) == 0 || raw[0] != '{' {
+				continue
 			}
+			t.logFirstMessage()
+			return raw, nil
 		}
 
-		defer func() {
-			if r := recover(); r != nil {
-				// If we panic here, just silently ignore it
-				// The process is exiting anyway
-				fmt.Fprintf(os.Stderr, "recovered from panic during subprocess exit: %v\n", r)
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &syntaxErr):
+			if t.logger != nil {
+				t.logger.Debug("skipping invalid JSON output", slog.Any("error", err))
 			}
-		}()
+		case errors.Is(err, errMessageTooLarge):
+			if t.logger != nil {
+				t.logger.Warn("skipping oversized message from CLI", slog.Int("max_bytes", t.limit.max))
+			}
+		default:
+			return nil, err
+		}
+
+		// The decoder cannot recover from either error; discard the rest of
+		// the offending line and start a fresh decoder after it. Bytes are
+		// skipped one at a time so nothing past the newline is lost.
+		t.source = io.MultiReader(t.decoder.Buffered(), t.source)
+		if err := skipLine(t.source); err != nil {
+			return nil, err
+		}
+		t.resetDecoder()
+	}
+}
+
+// resetDecoder starts a fresh decoder on t.source, limited to the maximum
+// message size
+func (t *SubprocessTransport) resetDecoder() {
+	max := t.options.MaxMessageSize
+	if max <= 0 {
+		max = defaultMaxMessage
+	}
+	t.limit = &messageLimitReader{r: t.source, max: max}
+	t.decoder = json.NewDecoder(t.limit)
+}
+
+// errMessageTooLarge is returned by messageLimitReader once a message exceeds
+// the maximum size
+var errMessageTooLarge = errors.New("claude-code: message exceeds the maximum size")
+
+// messageLimitReader fails reads once more than max bytes have been read
+// since read was last reset, so that a single unterminated or oversized
+// message cannot grow the decoder's buffer without bound
+type messageLimitReader struct {
+	r    io.Reader
+	max  int
+	read int
+}
+
+// Read reads from the underlying reader up to the remaining limit
+func (l *messageLimitReader) Read(p []byte) (int, error) {
+	if l.read >= l.max {
+		return 0, errMessageTooLarge
+	}
+	if len(p) > l.max-l.read {
+		p = p[:l.max-l.read]
+	}
+	n, err := l.r.Read(p)
+	l.read += n
+	return n, err
+}
 
-		// Wait for process to exit
-		err := t.cmd.Wait()
+// skipLine reads from r up to and including the next newline
+func skipLine(r io.Reader) error {
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		if n == 1 && b[0] == '\n' {
+			return nil
+		}
 		if err != nil {
-			// Only log actual errors, not normal exits
-			// Check if this is a real error or just normal termination
-			if !t.connected.Load() {
-				// We're disconnecting, this is expected
-				return
+			return err
+		}
+	}
+}
+
+// awaitInit reads messages until the CLI's init system message arrives and
+// verifies that every required MCP server reports a connected status. Control
+// messages are handled as they arrive, since the CLI may wait on a control
+// response before initializing; other messages read here are replayed by
+// Receive. The process is killed if the init timeout expires or ctx is done
+// first.
+func (t *SubprocessTransport) awaitInit(ctx context.Context) error {
+	timeout := t.options.InitTimeout
+	if timeout <= 0 {
+		timeout = defaultInitTimeout
+	}
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		_ = t.cmd.Process.Kill()
+	})
+	defer timer.Stop()
+	stop := context.AfterFunc(ctx, func() { _ = t.cmd.Process.Kill() })
+	defer stop()
+
+	for {
+		raw, err := t.readMessage()
+		if err != nil {
+			if timedOut.Load() {
+				return &ClaudeError{
+					Code:    "INIT_TIMEOUT",
+					Message: fmt.Sprintf("CLI did not report init within %s", timeout),
+					Err:     ErrConnectionFailed,
+				}
 			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return fmt.Errorf("%w: %w", ErrConnectionFailed, ctxErr)
+			}
+			return fmt.Errorf("%w: process exited before init message", ErrConnectionFailed)
+		}
 
-			// Check if it's an exit error with a non-zero code
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				if t.connected.Load() {
-					stderr := t.readStderr()
-					if stderr != "" {
-						fmt.Fprintf(os.Stderr, "Claude Code failed with exit status %d\n", exitErr.ExitCode())
-						fmt.Fprintf(os.Stderr, "Error details:\n%s\n", stderr)
-					} else {
-						fmt.Fprintf(os.Stderr, "subprocess exited with error: %v\n", err)
-					}
+		switch peekEnvelope(raw).Type {
+		case "control_response":
+			t.handleControlResponse(raw)
+			continue
+		case "control_request":
+			go t.handleControlRequest(ctx, raw)
+			continue
+		}
+		t.pending = append(t.pending, raw)
+
+		var msg struct {
+			Type       string `json:"type"`
+			Subtype    string `json:"subtype"`
+			MCPServers []struct {
+				Name   string `json:"name"`
+				Status string `json:"status"`
+			} `json:"mcp_servers"`
+		}
+		if err := json.Unmarshal(raw, &msg); err != nil || msg.Type != "system" || msg.Subtype != "init" {
+			continue
+		}
+		t.markReady()
+
+		status := make(map[string]string)
+		for _, server := range msg.MCPServers {
+			status[server.Name] = server.Status
+		}
+
+		for _, name := range t.options.RequiredMCPServers {
+			if s, ok := status[name]; !ok || s != "connected" {
+				if !ok {
+					s = "missing"
+				}
+				return &ClaudeError{
+					Code:    "MCP_SERVER_UNAVAILABLE",
+					Message: fmt.Sprintf("required MCP server %q is not connected (status: %s)", name, s),
+					Err:     ErrConnectionFailed,
 				}
-			} else {
-				// This might be important, so log it to stderr
-				fmt.Fprintf(os.Stderr, "subprocess wait error: %v\n", err)
 			}
 		}
-	}()
 
-	return msgChan, nil
+		return nil
+	}
 }
 
-// Interrupt sends an interrupt signal
+// Ready returns a channel that is closed once the CLI's init system message
+// has been read. Messages are read by Receive, so the channel only closes
+// while a Receive call is consuming output or after Connect waited for init.
+func (t *SubprocessTransport) Ready() <-chan struct{} {
+	return t.ready
+}
+
+// markReady closes the ready channel
+func (t *SubprocessTransport) markReady() {
+	t.readyOnce.Do(func() { close(t.ready) })
+}
+
+// ExitError returns the error recorded when the process exited with a non-zero
+// status, or nil. It is only meaningful once the Receive channel has closed.
+func (t *SubprocessTransport) ExitError() error {
+	if perr := t.exitErr.Load(); perr != nil {
+		return perr
+	}
+	return nil
+}
+
+// Interrupt sends an interrupt signal without waiting for the CLI to
+// acknowledge it. The acknowledgment is passed to the control response
+// callback; use InterruptAndWait to wait for it.
 func (t *SubprocessTransport) Interrupt(ctx context.Context) error {
-	if !t.isStreaming {
-		return errors.New("interrupt requires streaming mode")
+	if err := t.checkInterrupt(); err != nil {
+		return err
 	}
+	return t.writeStdin(t.newControlRequest("interrupt"))
+}
 
-	if !t.connected.Load() || t.stdinClosed.Load() {
-		return ErrNotConnected
+// InterruptAndWait sends an interrupt signal and waits for the CLI to
+// acknowledge it, until ctx is done, returning an error if the CLI reports
+// that the interrupt failed. The acknowledgment is read by the receive loop,
+// so it must not be called from the goroutine consuming Receive.
+func (t *SubprocessTransport) InterruptAndWait(ctx context.Context) (ControlResponse, error) {
+	if err := t.checkInterrupt(); err != nil {
+		return ControlResponse{}, err
+	}
+	if !t.receiving.Load() {
+		return ControlResponse{}, errors.New("waiting for an interrupt requires messages to be received")
 	}
 
-	controlReq := map[string]any{
-		"type":       "control_request",
-		"request_id": fmt.Sprintf("req_%d", time.Now().UnixNano()),
-		"request": map[string]string{
-			"subtype": "interrupt",
-		},
+	resp, err := t.sendControlRequest(ctx, t.newControlRequest("interrupt"))
+	if err != nil {
+		return resp, err
 	}
+	return resp, controlError("interrupt", resp)
+}
 
-	encoder := json.NewEncoder(t.stdin)
-	return encoder.Encode(controlReq)
+// checkInterrupt returns an error if an interrupt cannot be written
+func (t *SubprocessTransport) checkInterrupt() error {
+	if !t.isStreaming {
+		return errors.New("interrupt requires streaming mode")
+	}
+	if !t.connected.Load() || t.stdinClosed.Load() {
+		return ErrNotConnected
+	}
+	return nil
 }
 
 // IsConnected returns true if connected
@@ -485,18 +1332,34 @@ func (t *SubprocessTransport) Close() error {
 	}
 
 	t.connected.Store(false)
+	close(t.closeCh)
+	unregisterTransport(t)
 
 	if !t.stdinClosed.Load() && t.stdin != nil {
 		t.stdin.Close()
 		t.stdinClosed.Store(true)
 	}
 
+	// Without a receive goroutine nothing waits for the process; claim the
+	// wait here so that Receive cannot start one concurrently
+	if t.receiving.CompareAndSwap(false, true) {
+		go func() {
+			defer close(t.receiveDone)
+			_ = t.wait()
+		}()
+	}
+
+	closeTimeout := t.options.CloseTimeout
+	if closeTimeout <= 0 {
+		closeTimeout = defaultCloseTimeout
+	}
+
 	// Wait for receive goroutine to finish first
 	// This ensures we don't have double Wait() calls
 	select {
 	case <-t.receiveDone:
 		// Receive goroutine has finished
-	case <-time.After(5 * time.Second):
+	case <-time.After(closeTimeout):
 		// Timeout waiting for receive goroutine
 		if t.cmd != nil && t.cmd.Process != nil {
 			// Force terminate
@@ -534,22 +1397,29 @@ func (t *SubprocessTransport) readStderr() string {
 
 	t.stderrFile.Seek(0, 0)
 
-	lines := make([]string, 0, stderrLines)
+	maxLines := t.options.MaxStderrLines
+	if maxLines <= 0 {
+		maxLines = defaultStderrLines
+	}
+
+	lines := make([]string, 0, min(maxLines, defaultStderrLines))
+	truncated := false
 	scanner := bufio.NewScanner(t.stderrFile)
 
 	for scanner.Scan() {
-		line := scanner.Text()
+		line := strings.ToValidUTF8(scanner.Text(), "\uFFFD")
 		if line != "" {
 			lines = append(lines, line)
-			if len(lines) > stderrLines {
+			if len(lines) > maxLines {
 				lines = lines[1:]
+				truncated = true
 			}
 		}
 	}
 
-	if len(lines) == stderrLines {
+	if truncated {
 		return fmt.Sprintf("[stderr truncated, showing last %d lines]\n%s",
-			stderrLines, strings.Join(lines, "\n"))
+			maxLines, strings.Join(lines, "\n"))
 	}
 
 	return strings.Join(lines, "\n")
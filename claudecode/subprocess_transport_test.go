@@ -1,13 +1,32 @@
 package claudecode
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
+// writeFakeCLI writes an executable shell script that stands in for the Claude CLI
+func writeFakeCLI(t *testing.T, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "claude")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("Failed to write fake CLI: %v", err)
+	}
+	return path
+}
+
 // TestSubprocessExitHandling tests that the subprocess transport handles Claude Code exits without panicking
 func TestSubprocessExitHandling(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
@@ -267,3 +286,1415 @@ func TestSubprocessPanicScenarios(t *testing.T) {
 		t.Log("Context cancel test completed without panic")
 	})
 }
+
+// TestBuildEnvPassthrough tests that only allow-listed variables are inherited
+func TestBuildEnvPassthrough(t *testing.T) {
+	t.Setenv("CLAUDE_SDK_TEST_ALLOWED", "yes")
+	t.Setenv("CLAUDE_SDK_TEST_SECRET", "hidden")
+
+	opts := DefaultOptions()
+	WithEnvPassthrough("CLAUDE_SDK_TEST_ALLOWED", "CLAUDE_SDK_TEST_UNSET")(opts)
+	WithEnv("CLAUDE_SDK_TEST_EXTRA", "added")(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+	env := transport.buildEnv()
+
+	got := make(map[string]string)
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		got[key] = value
+	}
+
+	want := map[string]string{
+		"CLAUDE_SDK_TEST_ALLOWED": "yes",
+		"CLAUDE_SDK_TEST_EXTRA":   "added",
+		"CLAUDE_CODE_ENTRYPOINT":  "sdk-go",
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected %d environment variables, got %d: %v", len(want), len(got), env)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("Expected %s=%q, got %q", key, value, got[key])
+		}
+	}
+}
+
+// TestDisableTelemetry tests that the telemetry variables reach the CLI process and override values from WithEnv
+func TestDisableTelemetry(t *testing.T) {
+	for _, disable := range []bool{true, false} {
+		envPath := filepath.Join(t.TempDir(), "env.txt")
+		cliPath := writeFakeCLI(t, `env > "$ENV_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'`)
+
+		c, err := New(
+			WithCLIPath(cliPath),
+			WithEnvPassthrough("PATH"),
+			WithEnv("ENV_CAPTURE", envPath),
+			WithEnv("DISABLE_TELEMETRY", "0"),
+			WithDisableTelemetry(disable),
+		)
+		if err != nil {
+			t.Fatalf("Failed to create client: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = c.Query(ctx, "Hello")
+		cancel()
+		c.Close()
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		data, err := os.ReadFile(envPath)
+		if err != nil {
+			t.Fatalf("Failed to read captured env: %v", err)
+		}
+		got := make(map[string]string)
+		for _, kv := range strings.Split(string(data), "\n") {
+			key, value, _ := strings.Cut(kv, "=")
+			got[key] = value
+		}
+
+		want := map[string]string{"DISABLE_TELEMETRY": "0", "DISABLE_ERROR_REPORTING": ""}
+		if disable {
+			want = map[string]string{"DISABLE_TELEMETRY": "1", "DISABLE_ERROR_REPORTING": "1"}
+		}
+		for key, value := range want {
+			if got[key] != value {
+				t.Errorf("DisableTelemetry=%v: expected %s=%q, got %q", disable, key, value, got[key])
+			}
+		}
+	}
+}
+
+// TestRequiredMCPServers tests that Connect enforces required MCP servers from the init message
+func TestRequiredMCPServers(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"system","subtype":"init","session_id":"s1","mcp_servers":[{"name":"filesystem","status":"connected"},{"name":"database","status":"failed"}]}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	tests := []struct {
+		name     string
+		required []string
+		wantErr  bool
+	}{
+		{name: "Connected", required: []string{"filesystem"}},
+		{name: "Failed", required: []string{"filesystem", "database"}, wantErr: true},
+		{name: "Missing", required: []string{"search"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			WithCLIPath(cliPath)(opts)
+			WithRequiredMCPServers(tt.required...)(opts)
+
+			transport := NewOneShotTransport(opts, "test")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err := transport.Connect(ctx)
+			if tt.wantErr {
+				if !errors.Is(err, ErrConnectionFailed) {
+					t.Fatalf("Expected ErrConnectionFailed, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer transport.Close()
+
+			msgChan, err := transport.Receive(ctx)
+			if err != nil {
+				t.Fatalf("Failed to start receive: %v", err)
+			}
+
+			var types []any
+			for msg := range msgChan {
+				types = append(types, msg["type"])
+			}
+			if len(types) != 2 || types[0] != "system" || types[1] != "result" {
+				t.Errorf("Expected init and result messages to be delivered, got %v", types)
+			}
+		})
+	}
+}
+
+// TestRequiredMCPServersInitTimeout tests that Connect gives up on the init
+// message once the init timeout expires
+func TestRequiredMCPServersInitTimeout(t *testing.T) {
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, "exec sleep 10"))(opts)
+	WithRequiredMCPServers("filesystem")(opts)
+	WithInitTimeout(200 * time.Millisecond)(opts)
+
+	start := time.Now()
+	err := NewOneShotTransport(opts, "test").Connect(context.Background())
+	var claudeErr *ClaudeError
+	if !errors.As(err, &claudeErr) || claudeErr.Code != "INIT_TIMEOUT" || !errors.Is(err, ErrConnectionFailed) {
+		t.Fatalf("Expected an INIT_TIMEOUT error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Connect took %s to time out", elapsed)
+	}
+}
+
+// TestRequiredMCPServersControlRequest tests that control requests sent
+// before the init message are answered while Connect waits for it
+func TestRequiredMCPServersControlRequest(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"control_request","request_id":"req_1","request":{"subtype":"ping"}}'
+read -r line
+case "$line" in
+  *req_1*) echo '{"type":"system","subtype":"init","session_id":"s1","mcp_servers":[{"name":"filesystem","status":"connected"}]}' ;;
+esac
+cat > /dev/null
+`)
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	WithRequiredMCPServers("filesystem")(opts)
+	WithInitTimeout(2 * time.Second)(opts)
+
+	transport := NewStreamingTransport(opts, make(chan map[string]any), false)
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	transport.Close()
+}
+
+// TestPrettyStdin tests that stdin JSON is indented when PrettyStdin is enabled
+func TestPrettyStdin(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "stdin.json")
+	cliPath := writeFakeCLI(t, `cat > "$STDIN_CAPTURE"`)
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	WithEnv("STDIN_CAPTURE", outPath)(opts)
+	WithPrettyStdin(true)(opts)
+
+	promptChan := make(chan map[string]any, 1)
+	promptChan <- map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hello"}}
+	close(promptChan)
+
+	transport := NewStreamingTransport(opts, promptChan, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	for range msgChan {
+		// Just consume
+	}
+	if err := transport.Close(); err != nil {
+		t.Errorf("Error closing transport: %v", err)
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+	if !strings.Contains(string(data), "{\n  \"message\": {\n    \"content\": \"hello\"") {
+		t.Errorf("Expected indented JSON on stdin, got:\n%s", data)
+	}
+}
+
+// TestBuildSettingsDisabledTools tests that settings-level disabled tools are merged into the settings JSON
+func TestBuildSettingsDisabledTools(t *testing.T) {
+	settingsPath := filepath.Join(t.TempDir(), "settings.json")
+	if err := os.WriteFile(settingsPath, []byte(`{"model":"sonnet","permissions":{"allow":["Read"],"deny":["WebFetch"]}}`), 0o644); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		settings string
+		want     string
+	}{
+		{
+			name: "Generated",
+			want: `{"permissions":{"deny":["Bash","WebSearch"]}}`,
+		},
+		{
+			name:     "MergedWithFile",
+			settings: settingsPath,
+			want:     `{"model":"sonnet","permissions":{"allow":["Read"],"deny":["WebFetch","Bash","WebSearch"]}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			WithSettings(tt.settings)(opts)
+			WithSettingsDisabledTools("Bash", "WebSearch", "Bash")(opts)
+
+			transport := NewOneShotTransport(opts, "test")
+			got, err := transport.buildSettings()
+			if err != nil {
+				t.Fatalf("buildSettings failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("buildSettings() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestBuildSettingsOutputStyle tests that the output style is serialized into the settings argument
+func TestBuildSettingsOutputStyle(t *testing.T) {
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, ""))(opts)
+	WithOutputStyle(OutputStyleExplanatory)(opts)
+	WithSettingsDisabledTools("Bash")(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+	args, err := transport.buildCommand()
+	if err != nil {
+		t.Fatalf("buildCommand failed: %v", err)
+	}
+
+	want := `{"outputStyle":"Explanatory","permissions":{"deny":["Bash"]}}`
+	for i, arg := range args {
+		if arg == "--settings" && i+1 < len(args) {
+			if args[i+1] != want {
+				t.Errorf("--settings = %s, want %s", args[i+1], want)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected --settings argument, got %v", args)
+}
+
+// TestBuildMCPConfigMerge tests that inline MCP servers are merged with the
+// config file and override file servers of the same name
+func TestBuildMCPConfigMerge(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "mcp.json")
+	fileConfig := `{"mcpServers":{"shared":{"type":"stdio","command":"shared-server"},"github":{"type":"http","url":"https://file.example.com/mcp"}}}`
+	if err := os.WriteFile(configPath, []byte(fileConfig), 0o644); err != nil {
+		t.Fatalf("Failed to write MCP config: %v", err)
+	}
+
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, ""))(opts)
+	WithMCPConfigFile(configPath)(opts)
+	WithMCPServer("github", MCPServer{Type: MCPServerTypeHTTP, URL: "https://inline.example.com/mcp"})(opts)
+	WithStrictMCPConfig()(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+	args, err := transport.buildCommand()
+	if err != nil {
+		t.Fatalf("buildCommand failed: %v", err)
+	}
+
+	var configs []string
+	strict := false
+	for i, arg := range args {
+		if arg == "--mcp-config" && i+1 < len(args) {
+			configs = append(configs, args[i+1])
+		}
+		if arg == "--strict-mcp-config" {
+			strict = true
+		}
+	}
+	if !strict {
+		t.Error("Expected --strict-mcp-config flag")
+	}
+
+	want := `{"mcpServers":{"github":{"type":"http","url":"https://inline.example.com/mcp"},"shared":{"type":"stdio","command":"shared-server"}}}`
+	if len(configs) != 1 || configs[0] != want {
+		t.Errorf("--mcp-config = %v, want [%s]", configs, want)
+	}
+
+	// Without inline servers the file path is passed through unchanged
+	opts = DefaultOptions()
+	WithMCPConfigFile(configPath)(opts)
+	got, err := NewOneShotTransport(opts, "test").buildMCPConfig()
+	if err != nil {
+		t.Fatalf("buildMCPConfig failed: %v", err)
+	}
+	if got != configPath {
+		t.Errorf("buildMCPConfig() = %s, want %s", got, configPath)
+	}
+}
+
+// TestBuildSettingsModelOptions tests that model options are merged into the settings argument
+func TestBuildSettingsModelOptions(t *testing.T) {
+	settingsPath := filepath.Join(t.TempDir(), "settings.json")
+	if err := os.WriteFile(settingsPath, []byte(`{"modelOptions":{"region":"us-east-1","top_k":10}}`), 0o644); err != nil {
+		t.Fatalf("Failed to write settings: %v", err)
+	}
+
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, ""))(opts)
+	WithSettings(settingsPath)(opts)
+	WithModelOption("top_k", 40)(opts)
+	WithModelOption("thinking_budget", "high")(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+	args, err := transport.buildCommand()
+	if err != nil {
+		t.Fatalf("buildCommand failed: %v", err)
+	}
+
+	want := `{"modelOptions":{"region":"us-east-1","thinking_budget":"high","top_k":40}}`
+	for i, arg := range args {
+		if arg == "--settings" && i+1 < len(args) {
+			if args[i+1] != want {
+				t.Errorf("--settings = %s, want %s", args[i+1], want)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected --settings argument, got %v", args)
+}
+
+// TestReceiveLargeMessage tests that a single JSON object larger than any line buffer is decoded
+func TestReceiveLargeMessage(t *testing.T) {
+	text := strings.Repeat("x", 2*1024*1024)
+	large, err := json.Marshal(map[string]any{
+		"type":    "assistant",
+		"message": map[string]any{"role": "assistant", "content": []any{map[string]any{"type": "text", "text": text}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "output.jsonl")
+	output := "not json output from the CLI\n" +
+		string(large) + "\n" +
+		"{\n  \"type\": \"result\",\n  \"subtype\": \"success\"\n}\n"
+	if err := os.WriteFile(outputPath, []byte(output), 0o644); err != nil {
+		t.Fatalf("Failed to write output: %v", err)
+	}
+
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `cat "`+outputPath+`"`))(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	var messages []map[string]any
+	for msg := range msgChan {
+		messages = append(messages, msg)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(messages))
+	}
+
+	msg, err := ParseMessage(messages[0])
+	if err != nil {
+		t.Fatalf("Failed to parse large message: %v", err)
+	}
+	blocks := msg.(*AssistantMessage).Content
+	if len(blocks) != 1 || blocks[0].Text == nil || len(*blocks[0].Text) != len(text) {
+		t.Errorf("Large text block was not decoded intact")
+	}
+	if messages[1]["type"] != "result" {
+		t.Errorf("Expected multi-line result message, got %v", messages[1])
+	}
+}
+
+// TestReceiveMaxMessageSize tests that a message over the maximum size is
+// skipped and the messages after it are still decoded
+func TestReceiveMaxMessageSize(t *testing.T) {
+	large, err := json.Marshal(map[string]any{
+		"type":    "assistant",
+		"message": map[string]any{"role": "assistant", "content": []any{map[string]any{"type": "text", "text": strings.Repeat("x", 256*1024)}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal message: %v", err)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "output.jsonl")
+	output := string(large) + "\n" + `{"type":"result","subtype":"success"}` + "\n"
+	if err := os.WriteFile(outputPath, []byte(output), 0o644); err != nil {
+		t.Fatalf("Failed to write output: %v", err)
+	}
+
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `cat "`+outputPath+`"`))(opts)
+	WithMaxMessageSize(64 * 1024)(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	var types []any
+	for msg := range msgChan {
+		types = append(types, msg["type"])
+	}
+	if len(types) != 1 || types[0] != "result" {
+		t.Errorf("Expected only the result message, got %v", types)
+	}
+}
+
+// TestMaxMessageSizeLog tests that oversized messages are logged with a type hint and still delivered
+func TestMaxMessageSizeLog(t *testing.T) {
+	text := strings.Repeat("x", 4096)
+	cliPath := writeFakeCLI(t, `echo '{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"`+text+`"}]}}'
+echo '{"type":"result","subtype":"success"}'
+`)
+
+	var buf bytes.Buffer
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	WithLogger(slog.New(slog.NewJSONHandler(&buf, nil)))(opts)
+	WithMaxMessageSizeLog(1024)(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	count := 0
+	for range msgChan {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected both messages to be delivered, got %d", count)
+	}
+
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Failed to decode log record %q: %v", line, err)
+		}
+		if record["msg"] == "oversized message from CLI" {
+			records = append(records, record)
+		}
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 oversized message log, got %d:\n%s", len(records), buf.String())
+	}
+	if records[0]["type"] != "user" {
+		t.Errorf("Expected type hint user, got %v", records[0]["type"])
+	}
+	head, _ := records[0]["head"].(string)
+	if !strings.HasPrefix(head, `{"type":"user"`) || len(head) != oversizedHeadBytes {
+		t.Errorf("Expected %d leading bytes of the message, got %q", oversizedHeadBytes, head)
+	}
+}
+
+// TestStdoutTee tests that the tee receives the exact bytes written by the CLI
+func TestStdoutTee(t *testing.T) {
+	output := "starting up\n" +
+		`{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"hi"}]}}` + "\n" +
+		"{\n  \"type\": \"result\",\n  \"subtype\": \"success\"\n}\n"
+	outputPath := filepath.Join(t.TempDir(), "output.txt")
+	if err := os.WriteFile(outputPath, []byte(output), 0o644); err != nil {
+		t.Fatalf("Failed to write output: %v", err)
+	}
+
+	var tee bytes.Buffer
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `cat "`+outputPath+`"`))(opts)
+	WithStdoutTee(&tee)(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	count := 0
+	for range msgChan {
+		count++
+	}
+
+	if count != 2 {
+		t.Errorf("Expected 2 parsed messages, got %d", count)
+	}
+	if tee.String() != output {
+		t.Errorf("Tee mismatch\ngot:  %q\nwant: %q", tee.String(), output)
+	}
+}
+
+// TestReceiveTwice tests that a second Receive call returns an error instead of panicking
+func TestReceiveTwice(t *testing.T) {
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `echo '{"type":"result","subtype":"success"}'`))(opts)
+
+	transport := NewOneShotTransport(opts, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	if _, err := transport.Receive(ctx); !errors.Is(err, ErrAlreadyReceiving) {
+		t.Errorf("Expected ErrAlreadyReceiving, got %v", err)
+	}
+
+	for range msgChan {
+		// Just consume
+	}
+}
+
+// TestInterruptOnContextCancel tests that cancelling the context sends an interrupt before closing
+func TestInterruptOnContextCancel(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "stdin.jsonl")
+	cliPath := writeFakeCLI(t, `while read -r line; do echo "$line" >> "$STDIN_CAPTURE"; done`)
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	WithEnv("STDIN_CAPTURE", outPath)(opts)
+	WithInterruptOnContextCancel(true)(opts)
+
+	promptChan := make(chan map[string]any)
+	transport := NewStreamingTransport(opts, promptChan, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	go func() {
+		for range msgChan {
+			// Just consume
+		}
+	}()
+
+	cancel()
+
+	select {
+	case <-transport.closeCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for transport to close after cancel")
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+	if !strings.Contains(string(data), `"subtype":"interrupt"`) {
+		t.Errorf("Expected interrupt control request before termination, got:\n%s", data)
+	}
+	if transport.IsConnected() {
+		t.Error("Expected transport to be disconnected")
+	}
+}
+
+// TestInterruptAcknowledged tests that InterruptAndWait waits for the CLI's
+// control response and that the response reaches the control response
+// callback
+func TestInterruptAcknowledged(t *testing.T) {
+	cliPath := writeFakeCLI(t, `while read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  echo "{\"type\":\"control_response\",\"response\":{\"subtype\":\"$ACK_SUBTYPE\",\"request_id\":\"$id\",\"error\":\"not running\"}}"
+done`)
+
+	for _, subtype := range []string{"success", "error"} {
+		t.Run(subtype, func(t *testing.T) {
+			acks := make(chan ControlResponse, 1)
+			opts := DefaultOptions()
+			WithCLIPath(cliPath)(opts)
+			WithEnv("ACK_SUBTYPE", subtype)(opts)
+			WithControlResponseCallback(func(resp ControlResponse) { acks <- resp })(opts)
+
+			transport := NewStreamingTransport(opts, make(chan map[string]any), false)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if err := transport.Connect(ctx); err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer transport.Close()
+
+			msgChan, err := transport.Receive(ctx)
+			if err != nil {
+				t.Fatalf("Failed to start receive: %v", err)
+			}
+			go func() {
+				for range msgChan {
+					// Just consume
+				}
+			}()
+
+			resp, err := transport.InterruptAndWait(ctx)
+			if subtype == "success" && err != nil {
+				t.Fatalf("InterruptAndWait failed: %v", err)
+			}
+			if subtype == "error" && (err == nil || !strings.Contains(err.Error(), "not running")) {
+				t.Fatalf("Expected the CLI's error from InterruptAndWait, got %v", err)
+			}
+			if resp.Subtype != subtype {
+				t.Errorf("Unexpected control response: %+v", resp)
+			}
+
+			select {
+			case ack := <-acks:
+				if ack.Subtype != subtype || !strings.HasPrefix(ack.RequestID, "req_") {
+					t.Errorf("Unexpected control response: %+v", ack)
+				}
+			default:
+				t.Error("Expected the control response callback to be called")
+			}
+		})
+	}
+}
+
+// TestControlRequestIDs tests that control requests built on a transport at
+// the same time have distinct IDs
+func TestControlRequestIDs(t *testing.T) {
+	transport := NewStreamingTransport(DefaultOptions(), nil, false)
+
+	seen := make(map[string]bool)
+	for _, subtype := range []string{"interrupt", "ping", "interrupt", "ping"} {
+		id := controlRequestID(transport.newControlRequest(subtype))
+		if id == "" || seen[id] {
+			t.Fatalf("Expected a new request ID, got %q after %v", id, seen)
+		}
+		seen[id] = true
+	}
+}
+
+// TestSessionInterruptFromReceiveLoop tests that Interrupt called from the
+// goroutine consuming Receive returns without waiting for the acknowledgment
+func TestSessionInterruptFromReceiveLoop(t *testing.T) {
+	cliPath := writeFakeCLI(t, `read -r line
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Working"}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Still working"}]}}'
+while read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  echo "{\"type\":\"control_response\",\"response\":{\"subtype\":\"success\",\"request_id\":\"$id\"}}"
+  echo '{"type":"result","subtype":"error_during_execution","session_id":"s1"}'
+done`)
+
+	acks := make(chan ControlResponse, 1)
+	c, err := New(WithCLIPath(cliPath), WithControlResponseCallback(func(resp ControlResponse) { acks <- resp }))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	msgChan, err := sess.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	if err := sess.Send(ctx, "Do something long"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	interrupted := false
+	for msg := range msgChan {
+		if !interrupted {
+			interrupted = true
+			if err := sess.Interrupt(ctx); err != nil {
+				t.Fatalf("Interrupt failed: %v", err)
+			}
+		}
+		if _, ok := msg.(*ResultMessage); ok {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		t.Fatal("Interrupt blocked until the context expired")
+	}
+
+	select {
+	case ack := <-acks:
+		if ack.Subtype != "success" {
+			t.Errorf("Unexpected control response: %+v", ack)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the acknowledgment to reach the control response callback")
+	}
+}
+
+// TestCancelGracePeriod tests that a CLI ignoring the interrupt is killed
+// once the cancel grace period elapses, without waiting for the close timeout
+func TestCancelGracePeriod(t *testing.T) {
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `trap '' INT
+exec sleep 30`))(opts)
+	WithInterruptOnContextCancel(true)(opts)
+	WithCancelGracePeriod(300 * time.Millisecond)(opts)
+	WithCloseTimeout(10 * time.Second)(opts)
+
+	promptChan := make(chan map[string]any)
+	transport := NewStreamingTransport(opts, promptChan, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	start := time.Now()
+	cancel()
+	for range msgChan {
+		// Just consume
+	}
+	elapsed := time.Since(start)
+
+	if elapsed < 300*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("CLI stopped %v after cancel, want about 300ms", elapsed)
+	}
+}
+
+// TestCLISearchPathsWithoutHome tests that home-relative locations are skipped when HOME is unset
+func TestCLISearchPathsWithoutHome(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("HOME is not used on Windows")
+	}
+
+	t.Setenv("HOME", "")
+
+	for _, loc := range cliSearchPaths() {
+		if !filepath.IsAbs(loc) || strings.HasPrefix(loc, "/.") || strings.HasPrefix(loc, "/node_modules") {
+			t.Errorf("Unexpected search path with HOME unset: %s", loc)
+		}
+	}
+
+	t.Setenv("HOME", "/home/tester")
+	found := false
+	for _, loc := range cliSearchPaths() {
+		if loc == "/home/tester/.local/bin/claude" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected home-relative search paths when HOME is set")
+	}
+}
+
+// TestCommandBuilder tests that a custom command builder's argv is used to start the CLI
+func TestCommandBuilder(t *testing.T) {
+	argsPath := filepath.Join(t.TempDir(), "args.txt")
+	cliPath := writeFakeCLI(t, `echo "$@" > "$ARGS_CAPTURE"
+echo '{"type":"result","subtype":"success"}'`)
+
+	var gotMode TransportMode
+	opts := DefaultOptions()
+	WithEnv("ARGS_CAPTURE", argsPath)(opts)
+	WithCommandBuilder(func(o *Options, mode TransportMode, prompt string) ([]string, error) {
+		gotMode = mode
+		return []string{cliPath, "-json", "-q", prompt}, nil
+	})(opts)
+
+	transport := NewOneShotTransport(opts, "hello")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+	for range msgChan {
+		// Just consume
+	}
+
+	if gotMode != TransportModeOneShot {
+		t.Errorf("Expected mode %q, got %q", TransportModeOneShot, gotMode)
+	}
+
+	data, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	if got := strings.TrimSpace(string(data)); got != "-json -q hello" {
+		t.Errorf("Expected custom argv %q, got %q", "-json -q hello", got)
+	}
+}
+
+// TestHeartbeatResponses tests that the CLI's responses to heartbeats are
+// not passed to the control response callback
+func TestHeartbeatResponses(t *testing.T) {
+	cliPath := writeFakeCLI(t, `while read -r line; do
+  id=$(echo "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  echo '{"type":"control_response","response":{"subtype":"error","request_id":"'$id'","error":"Unsupported control request subtype: ping"}}'
+done`)
+
+	var responses atomic.Int32
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	WithHeartbeat(20 * time.Millisecond)(opts)
+	WithControlResponseCallback(func(ControlResponse) { responses.Add(1) })(opts)
+
+	transport := NewStreamingTransport(opts, make(chan map[string]any), false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	transport.Close()
+	for range msgChan {
+		// Just consume
+	}
+
+	if n := responses.Load(); n != 0 {
+		t.Errorf("Expected heartbeat responses to be dropped, got %d callbacks", n)
+	}
+}
+
+// TestHeartbeat tests that pings are sent while idle and suppressed during an active turn
+func TestHeartbeat(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "stdin.log")
+	cliPath := writeFakeCLI(t, `while read -r line; do
+  echo "$line" >> "$STDIN_CAPTURE"
+  case "$line" in
+    *'"type":"user"'*)
+      (sleep 0.4
+       echo RESULT >> "$STDIN_CAPTURE"
+       echo '{"type":"result","subtype":"success"}') &
+      ;;
+  esac
+done`)
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	WithEnv("STDIN_CAPTURE", outPath)(opts)
+	WithHeartbeat(50 * time.Millisecond)(opts)
+
+	promptChan := make(chan map[string]any)
+	transport := NewStreamingTransport(opts, promptChan, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	promptChan <- map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hi"}}
+
+	select {
+	case msg := <-msgChan:
+		if msg["type"] != "result" {
+			t.Fatalf("Expected result, got %v", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timeout waiting for result")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	transport.Close()
+	for range msgChan {
+		// Just consume
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+
+	// The CLI records RESULT just before emitting the result, so pings are
+	// attributed to the phase in which they were written
+	var before, during, after int
+	phase := &before
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		switch {
+		case strings.Contains(line, `"type":"user"`):
+			phase = &during
+		case line == "RESULT":
+			phase = &after
+		case strings.Contains(line, `"subtype":"ping"`):
+			*phase++
+		}
+	}
+
+	if before < 2 {
+		t.Errorf("Expected heartbeats while idle before the turn, got %d", before)
+	}
+	if during != 0 {
+		t.Errorf("Expected no heartbeats during the turn, got %d", during)
+	}
+	if after < 2 {
+		t.Errorf("Expected heartbeats while idle after the turn, got %d", after)
+	}
+}
+
+// TestReceiveInvalidUTF8 tests that invalid UTF-8 bytes in output do not corrupt the message stream
+func TestReceiveInvalidUTF8(t *testing.T) {
+	cliPath := writeFakeCLI(t, `printf '{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"bin:\377\376 ok"}]}}\n'
+printf '\377\376\375 raw binary line\n'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	transport := NewOneShotTransport(opts, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	var messages []map[string]any
+	for msg := range msgChan {
+		messages = append(messages, msg)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d: %v", len(messages), messages)
+	}
+	if messages[1]["type"] != "result" {
+		t.Errorf("Expected result after invalid output, got %v", messages[1]["type"])
+	}
+
+	content := messages[0]["message"].(map[string]any)["content"].([]any)
+	text := content[0].(map[string]any)["content"].(string)
+	if !utf8.ValidString(text) {
+		t.Errorf("Expected valid UTF-8, got %q", text)
+	}
+	if text != "bin:�� ok" {
+		t.Errorf("Expected invalid bytes replaced with U+FFFD, got %q", text)
+	}
+}
+
+// TestReceiveRaw tests that ReceiveRaw delivers undecoded messages that ParseMessageJSON can parse
+func TestReceiveRaw(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"hi"}]}}'
+echo '{"type":"control_response","response":{}}'
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+`)
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	transport := NewOneShotTransport(opts, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := transport.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer transport.Close()
+
+	rawChan, err := transport.ReceiveRaw(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	var types []MessageType
+	for raw := range rawChan {
+		msg, err := ParseMessageJSON(raw)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", raw, err)
+		}
+		types = append(types, msg.Type())
+	}
+
+	if len(types) != 2 || types[0] != MessageTypeAssistant || types[1] != MessageTypeResult {
+		t.Errorf("Expected assistant and result messages, got %v", types)
+	}
+}
+
+// TestReceiveNotConnected tests that receiving before a successful Connect,
+// or from a closed session, returns ErrNotConnected
+func TestReceiveNotConnected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	transport := NewStreamingTransport(DefaultOptions(), nil, false)
+	if _, err := transport.Receive(ctx); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Receive() before Connect error = %v, want ErrNotConnected", err)
+	}
+	if _, err := transport.ReceiveRaw(ctx); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("ReceiveRaw() before Connect error = %v, want ErrNotConnected", err)
+	}
+
+	opts := DefaultOptions()
+	WithCLIPath(filepath.Join(t.TempDir(), "missing-claude"))(opts)
+	failed := NewStreamingTransport(opts, nil, false)
+	if err := failed.Connect(ctx); err == nil {
+		t.Fatal("Expected Connect to fail for a missing CLI")
+	}
+	if _, err := failed.Receive(ctx); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Receive() after failed Connect error = %v, want ErrNotConnected", err)
+	}
+
+	c, err := New(WithCLIPath(writeFakeCLI(t, "cat > /dev/null")))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	session, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	session.Close()
+	if _, err := session.Receive(ctx); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Receive() on closed session error = %v, want ErrNotConnected", err)
+	}
+}
+
+// TestStreamingPromptBeforeEOF tests that a buffered prompt is fully written to stdin before it is closed
+func TestStreamingPromptBeforeEOF(t *testing.T) {
+	stdinPath := filepath.Join(t.TempDir(), "stdin.jsonl")
+	cliPath := writeFakeCLI(t, `cat > "$STDIN_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'`)
+
+	opts := DefaultOptions()
+	WithCLIPath(cliPath)(opts)
+	WithEnv("STDIN_CAPTURE", stdinPath)(opts)
+
+	prompt, err := EncodeMessage(NewUserMessage("Hello"), MessageMeta{SessionID: "default"})
+	if err != nil {
+		t.Fatalf("Failed to encode prompt: %v", err)
+	}
+	want, err := json.Marshal(prompt)
+	if err != nil {
+		t.Fatalf("Failed to marshal prompt: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		promptChan := make(chan map[string]any, 1)
+		promptChan <- prompt
+		close(promptChan)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		transport := NewStreamingTransport(opts, promptChan, true)
+		if err := transport.Connect(ctx); err != nil {
+			cancel()
+			t.Fatalf("Connect failed: %v", err)
+		}
+		if !transport.stdinClosed.Load() {
+			t.Error("Expected stdin to be closed once Connect returns")
+		}
+
+		msgChan, err := transport.Receive(ctx)
+		if err != nil {
+			cancel()
+			t.Fatalf("Receive failed: %v", err)
+		}
+		for range msgChan {
+		}
+		transport.Close()
+		cancel()
+
+		data, err := os.ReadFile(stdinPath)
+		if err != nil {
+			t.Fatalf("Failed to read captured stdin: %v", err)
+		}
+		if string(data) != string(want)+"\n" {
+			t.Fatalf("Captured stdin = %q, want %q", data, string(want)+"\n")
+		}
+	}
+}
+
+// TestCloseTimeout tests that Close waits for the configured timeout before killing a process that does not exit
+func TestCloseTimeout(t *testing.T) {
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `exec sleep 30`))(opts)
+	WithCloseTimeout(300 * time.Millisecond)(opts)
+
+	promptChan := make(chan map[string]any)
+	transport := NewStreamingTransport(opts, promptChan, false)
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	start := time.Now()
+	if err := transport.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Close took %v, want about 300ms", elapsed)
+	}
+}
+
+// TestStdinBurstOrdering tests that a burst of prompts, coalesced into fewer
+// writes, reaches the CLI intact and in order
+func TestStdinBurstOrdering(t *testing.T) {
+	outPath := filepath.Join(t.TempDir(), "stdin.jsonl")
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `cat > "$STDIN_CAPTURE"`))(opts)
+	WithEnv("STDIN_CAPTURE", outPath)(opts)
+
+	const count = 500
+	promptChan := make(chan map[string]any, count)
+	transport := NewStreamingTransport(opts, promptChan, true)
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.Receive(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start receive: %v", err)
+	}
+
+	go func() {
+		for i := 0; i < count; i++ {
+			promptChan <- map[string]any{"type": "user", "seq": i, "text": strings.Repeat("x", i%97)}
+		}
+		close(promptChan)
+	}()
+	for range msgChan {
+		// Wait for the CLI to exit
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != count {
+		t.Fatalf("Expected %d lines, got %d", count, len(lines))
+	}
+	for i, line := range lines {
+		var msg struct {
+			Seq  int    `json:"seq"`
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("Line %d is not intact JSON: %v", i, err)
+		}
+		if msg.Seq != i || len(msg.Text) != i%97 {
+			t.Fatalf("Line %d out of order or corrupted: %s", i, line)
+		}
+	}
+}
+
+// countingWriteCloser counts the writes made to it
+type countingWriteCloser struct {
+	writes int
+}
+
+func (w *countingWriteCloser) Write(p []byte) (int, error) {
+	w.writes++
+	return len(p), nil
+}
+
+func (w *countingWriteCloser) Close() error { return nil }
+
+// BenchmarkStdinWrites compares the stdin writes made for a burst of messages
+// sent one at a time and as a batch
+func BenchmarkStdinWrites(b *testing.B) {
+	msgs := make([]map[string]any, 32)
+	for i := range msgs {
+		msgs[i] = map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hello"}}
+	}
+
+	for _, batched := range []bool{false, true} {
+		name := "PerMessage"
+		if batched {
+			name = "Batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			stdin := &countingWriteCloser{}
+			transport := NewStreamingTransport(DefaultOptions(), nil, false)
+			transport.stdin = stdin
+
+			for i := 0; i < b.N; i++ {
+				if batched {
+					_ = transport.writeStdinBatch(msgs)
+					continue
+				}
+				for _, msg := range msgs {
+					_ = transport.writeStdin(msg)
+				}
+			}
+			b.ReportMetric(float64(stdin.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// TestReceiveMessagesLazyDecode tests that received messages are only
+// decoded as maps when a callback needs them
+func TestReceiveMessagesLazyDecode(t *testing.T) {
+	opts := DefaultOptions()
+	WithCLIPath(writeFakeCLI(t, `echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"hi"}],"usage":{"input_tokens":3}}}'`))(opts)
+
+	transport := NewOneShotTransport(opts, "Hello")
+	if err := transport.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer transport.Close()
+
+	msgChan, err := transport.receiveMessages(context.Background())
+	if err != nil {
+		t.Fatalf("receiveMessages failed: %v", err)
+	}
+	received, ok := <-msgChan
+	if !ok {
+		t.Fatal("Expected a message")
+	}
+
+	observeReceived(opts, nil, &received)
+	if _, err := received.parse(opts.ProtocolVersion); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if received.data != nil {
+		t.Error("Expected the message not to be decoded as a map without callbacks")
+	}
+
+	var usage Usage
+	WithUsageCallback(func(u Usage) { usage = u })(opts)
+	observeReceived(opts, nil, &received)
+	if received.data == nil || usage.InputTokens != 3 {
+		t.Errorf("Expected the usage callback to see the decoded message, got %+v", usage)
+	}
+}
+
+// BenchmarkReceiveMessages measures the client's receive path, from the CLI's
+// stdout to typed messages, with and without a callback that needs each
+// message decoded as a map
+func BenchmarkReceiveMessages(b *testing.B) {
+	const messages = 1000
+
+	dir := b.TempDir()
+	var out bytes.Buffer
+	for i := 0; i < messages; i++ {
+		out.WriteString(parseSamples[i%len(parseSamples)])
+		out.WriteByte('\n')
+	}
+	outPath := filepath.Join(dir, "messages.jsonl")
+	if err := os.WriteFile(outPath, out.Bytes(), 0o644); err != nil {
+		b.Fatalf("Failed to write messages: %v", err)
+	}
+	cliPath := filepath.Join(dir, "claude")
+	if err := os.WriteFile(cliPath, []byte("#!/bin/sh\nexec cat \"$MESSAGES\"\n"), 0o755); err != nil {
+		b.Fatalf("Failed to write fake CLI: %v", err)
+	}
+
+	for _, bm := range []struct {
+		name string
+		opts []Option
+	}{
+		{name: "Parse"},
+		{name: "UsageCallback", opts: []Option{WithUsageCallback(func(Usage) {})}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			opts := DefaultOptions()
+			WithCLIPath(cliPath)(opts)
+			WithEnv("MESSAGES", outPath)(opts)
+			for _, opt := range bm.opts {
+				opt(opts)
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				transport := NewOneShotTransport(opts, "Hello")
+				if err := transport.Connect(context.Background()); err != nil {
+					b.Fatalf("Connect failed: %v", err)
+				}
+				msgChan, err := transport.receiveMessages(context.Background())
+				if err != nil {
+					b.Fatalf("receiveMessages failed: %v", err)
+				}
+				for received := range msgChan {
+					observeReceived(opts, nil, &received)
+					if _, err := received.parse(opts.ProtocolVersion); err != nil {
+						b.Fatalf("parse failed: %v", err)
+					}
+				}
+				transport.Close()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*messages), "ns/msg")
+		})
+	}
+}
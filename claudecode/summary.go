@@ -0,0 +1,95 @@
+package claudecode
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// summaryTokenFields lists the usage fields reported in a run summary, in
+// display order
+var summaryTokenFields = []struct {
+	key   string
+	label string
+}{
+	{"input_tokens", "input"},
+	{"output_tokens", "output"},
+	{"cache_read_input_tokens", "cache read"},
+	{"cache_creation_input_tokens", "cache write"},
+}
+
+// timeNow returns the current time; tests replace it for stable output
+var timeNow = time.Now
+
+// writeSummary writes the run summary for m to the configured summary
+// writer. It also attaches the configured result formatter to m, since it is
+// called for every final result.
+func writeSummary(opts *Options, m *ResultMessage) {
+	m.formatter = opts.ResultFormatter
+	if opts.SummaryWriter == nil {
+		return
+	}
+
+	summary := formatSummary(m, opts.formatTime(timeNow()))
+	if m.formatter != nil {
+		summary = m.format()
+		if !strings.HasSuffix(summary, "\n") {
+			summary += "\n"
+		}
+	}
+	_, _ = io.WriteString(opts.SummaryWriter, summary)
+}
+
+// String returns a one-line description of the result, or the output of the
+// result formatter when one is configured with WithResultFormatter
+func (m *ResultMessage) String() string {
+	if m.formatter != nil {
+		return m.format()
+	}
+
+	s := fmt.Sprintf("%s after %d turns in %s", m.Subtype, m.NumTurns, time.Duration(m.DurationMS)*time.Millisecond)
+	if m.TotalCostUSD != nil {
+		s += fmt.Sprintf(" ($%.4f)", *m.TotalCostUSD)
+	}
+	return s
+}
+
+// format renders m with its result formatter. The formatter is given a copy
+// of m without the formatter attached, so that it can call String or format
+// the message with %v without recursing.
+func (m *ResultMessage) format() string {
+	plain := *m
+	plain.formatter = nil
+	return m.formatter(&plain)
+}
+
+// formatSummary renders a result message as a plain text summary block,
+// stamped with the rendered completion time
+func formatSummary(m *ResultMessage, completed string) string {
+	var b strings.Builder
+
+	b.WriteString("Summary:\n")
+	fmt.Fprintf(&b, "- Result: %s\n", m.Subtype)
+	fmt.Fprintf(&b, "- Completed: %s\n", completed)
+	fmt.Fprintf(&b, "- Duration: %s (API %s)\n",
+		time.Duration(m.DurationMS)*time.Millisecond,
+		time.Duration(m.DurationAPIMS)*time.Millisecond)
+	fmt.Fprintf(&b, "- Turns: %d\n", m.NumTurns)
+
+	if m.TotalCostUSD != nil {
+		fmt.Fprintf(&b, "- Cost: $%.4f\n", *m.TotalCostUSD)
+	}
+
+	var tokens []string
+	for _, field := range summaryTokenFields {
+		if n, ok := m.Usage[field.key].(float64); ok {
+			tokens = append(tokens, fmt.Sprintf("%d %s", int64(n), field.label))
+		}
+	}
+	if len(tokens) > 0 {
+		fmt.Fprintf(&b, "- Tokens: %s\n", strings.Join(tokens, ", "))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,131 @@
+package claudecode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubTimeNow fixes the time used for rendered timestamps for the test
+func stubTimeNow(t *testing.T, now time.Time) {
+	t.Helper()
+	orig := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = orig })
+}
+
+func TestSummaryWriter(t *testing.T) {
+	stubTimeNow(t, time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC))
+
+	cliPath := writeFakeCLI(t, `echo '{"type":"result","subtype":"success","session_id":"s1","duration_ms":2500,"duration_api_ms":2100,"num_turns":3,"total_cost_usd":0.0421,"usage":{"input_tokens":1200,"output_tokens":340,"cache_read_input_tokens":5000}}'`)
+
+	var buf bytes.Buffer
+	c, err := New(WithCLIPath(cliPath), WithSummaryWriter(&buf))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Query(ctx, "Hello"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	want := "Summary:\n" +
+		"- Result: success\n" +
+		"- Completed: 2026-03-14T15:09:26Z\n" +
+		"- Duration: 2.5s (API 2.1s)\n" +
+		"- Turns: 3\n" +
+		"- Cost: $0.0421\n" +
+		"- Tokens: 1200 input, 340 output, 5000 cache read\n"
+	if got := buf.String(); got != want {
+		t.Errorf("Summary mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSummaryTimeFormat(t *testing.T) {
+	stubTimeNow(t, time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC))
+
+	cliPath := writeFakeCLI(t, `echo '{"type":"result","subtype":"success","session_id":"s1","num_turns":1}'`)
+
+	var buf bytes.Buffer
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithSummaryWriter(&buf),
+		WithTimeFormat("Jan 2, 2006 15:04 MST"),
+		WithTimeZone(time.FixedZone("JST", 9*60*60)),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := c.Query(ctx, "Hello"); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if want := "- Completed: Mar 15, 2026 00:09 JST\n"; !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected summary to contain %q, got:\n%s", want, buf.String())
+	}
+}
+
+func TestResultFormatter(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"result","subtype":"success","session_id":"s1","duration_ms":2500,"num_turns":3,"total_cost_usd":0.0421}'`)
+
+	var buf bytes.Buffer
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithSummaryWriter(&buf),
+		WithResultFormatter(func(m *ResultMessage) string {
+			return fmt.Sprintf(`{"subtype":%q,"turns":%d}`, m.Subtype, m.NumTurns)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Hello")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	want := `{"subtype":"success","turns":3}`
+	if got := buf.String(); got != want+"\n" {
+		t.Errorf("Summary = %q, want %q", got, want+"\n")
+	}
+	if got := messages[0].(*ResultMessage).String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	cost := 0.0421
+	plain := &ResultMessage{Subtype: "success", NumTurns: 3, DurationMS: 2500, TotalCostUSD: &cost}
+	if got, want := plain.String(), "success after 3 turns in 2.5s ($0.0421)"; got != want {
+		t.Errorf("Default String() = %q, want %q", got, want)
+	}
+}
+
+// TestResultFormatterString tests that a result formatter can use the
+// default rendering of the message without recursing
+func TestResultFormatterString(t *testing.T) {
+	m := &ResultMessage{Subtype: "success", NumTurns: 2, DurationMS: 1000}
+	m.formatter = func(m *ResultMessage) string {
+		return fmt.Sprintf("[%s] [%v]", m.String(), m)
+	}
+
+	want := "[success after 2 turns in 1s] [success after 2 turns in 1s]"
+	if got := m.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,50 @@
+package claudecode
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// charsPerToken is the average number of characters per token for English
+// text and source code
+const charsPerToken = 4
+
+// EstimateTokens returns an approximate token count for text. The CLI does not
+// expose a token counting command, so this uses a local heuristic: words are
+// counted at roughly four characters per token, punctuation and symbols count
+// as one token each, and ideographic characters count as one token each. The
+// estimate is intended for proactively trimming or splitting inputs, not for
+// billing.
+func EstimateTokens(text string) int {
+	tokens := 0
+	wordLen := 0
+
+	flushWord := func() {
+		if wordLen > 0 {
+			tokens += (wordLen + charsPerToken - 1) / charsPerToken
+			wordLen = 0
+		}
+	}
+
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		text = text[size:]
+
+		switch {
+		case unicode.IsSpace(r):
+			flushWord()
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+			unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flushWord()
+			tokens++
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			wordLen++
+		default:
+			flushWord()
+			tokens++
+		}
+	}
+	flushWord()
+
+	return tokens
+}
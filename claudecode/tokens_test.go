@@ -0,0 +1,52 @@
+package claudecode
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		min, max int
+	}{
+		{name: "Empty", text: "", min: 0, max: 0},
+		{name: "Greeting", text: "Hello, world!", min: 3, max: 6},
+		{name: "Sentence", text: "The quick brown fox jumps over the lazy dog.", min: 9, max: 14},
+		{name: "Code", text: "func main() { fmt.Println(\"hi\") }", min: 10, max: 20},
+		{name: "Ideographic", text: "你好世界", min: 4, max: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EstimateTokens(tt.text)
+			if got < tt.min || got > tt.max {
+				t.Errorf("EstimateTokens(%q) = %d, want between %d and %d", tt.text, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestClientCountTokens(t *testing.T) {
+	c, err := New(WithSystemPrompt("You are a helpful assistant."))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	prompt := strings.Repeat("word ", 1000)
+	got, err := c.CountTokens(context.Background(), prompt)
+	if err != nil {
+		t.Fatalf("CountTokens failed: %v", err)
+	}
+
+	want := EstimateTokens("You are a helpful assistant.") + EstimateTokens(prompt)
+	if got != want {
+		t.Errorf("CountTokens() = %d, want %d", got, want)
+	}
+	if got < 1000 || got > 1100 {
+		t.Errorf("CountTokens() = %d, expected roughly one token per short word", got)
+	}
+}
@@ -0,0 +1,157 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// sdkMCPServerName is the name of the in-process MCP server that exposes the
+// registered tool providers to the CLI. Claude sees each provided tool as
+// mcp__sdk__<name>.
+const sdkMCPServerName = "sdk"
+
+// mcpProtocolVersion is the MCP protocol version the in-process server speaks
+const mcpProtocolVersion = "2024-11-05"
+
+// ToolProvider is a tool fulfilled by the SDK itself rather than by the CLI
+// or an external MCP server
+type ToolProvider interface {
+	// Description tells Claude what the tool does and when to use it
+	Description() string
+
+	// InputSchema is the JSON Schema of the tool input
+	InputSchema() map[string]any
+
+	// Call runs the tool and returns its text output. A returned error is
+	// reported to Claude as a failed tool result.
+	Call(ctx context.Context, input map[string]any) (string, error)
+}
+
+// funcToolProvider is a ToolProvider backed by a function
+type funcToolProvider struct {
+	description string
+	schema      map[string]any
+	fn          func(ctx context.Context, input map[string]any) (string, error)
+}
+
+// NewToolProvider returns a ToolProvider with the given description and input
+// schema that runs fn
+func NewToolProvider(description string, schema map[string]any, fn func(ctx context.Context, input map[string]any) (string, error)) ToolProvider {
+	return &funcToolProvider{description: description, schema: schema, fn: fn}
+}
+
+func (p *funcToolProvider) Description() string         { return p.description }
+func (p *funcToolProvider) InputSchema() map[string]any { return p.schema }
+
+func (p *funcToolProvider) Call(ctx context.Context, input map[string]any) (string, error) {
+	return p.fn(ctx, input)
+}
+
+// providedToolNames returns the names Claude uses for the registered tool
+// providers, sorted
+func (o *Options) providedToolNames() []string {
+	names := make([]string, 0, len(o.ToolProviders))
+	for name := range o.ToolProviders {
+		names = append(names, "mcp__"+sdkMCPServerName+"__"+name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonRPCMessage is a JSON-RPC request or notification from the CLI to the
+// in-process MCP server
+type jsonRPCMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// answerMCPMessage handles a JSON-RPC message for the in-process MCP server,
+// returning the control response carrying the JSON-RPC response
+func (t *SubprocessTransport) answerMCPMessage(ctx context.Context, req *controlRequest) (map[string]any, error) {
+	var msg jsonRPCMessage
+	if err := json.Unmarshal(req.Request.Message, &msg); err != nil {
+		return nil, fmt.Errorf("invalid MCP message: %w", err)
+	}
+
+	response := map[string]any{"jsonrpc": "2.0"}
+	if msg.ID != nil {
+		response["id"] = msg.ID
+	}
+	result, rpcErr := t.callMCPMethod(ctx, &msg)
+	if rpcErr != nil {
+		response["error"] = rpcErr
+	} else {
+		response["result"] = result
+	}
+
+	return map[string]any{
+		"subtype":    "success",
+		"request_id": req.RequestID,
+		"response":   map[string]any{"mcp_response": response},
+	}, nil
+}
+
+// callMCPMethod runs an MCP method against the registered tool providers,
+// returning its result or a JSON-RPC error object
+func (t *SubprocessTransport) callMCPMethod(ctx context.Context, msg *jsonRPCMessage) (any, map[string]any) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": sdkMCPServerName, "version": "1.0.0"},
+		}, nil
+
+	case "notifications/initialized":
+		return map[string]any{}, nil
+
+	case "tools/list":
+		names := make([]string, 0, len(t.options.ToolProviders))
+		for name := range t.options.ToolProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		tools := make([]map[string]any, 0, len(names))
+		for _, name := range names {
+			provider := t.options.ToolProviders[name]
+			schema := provider.InputSchema()
+			if schema == nil {
+				schema = map[string]any{"type": "object"}
+			}
+			tools = append(tools, map[string]any{
+				"name":        name,
+				"description": provider.Description(),
+				"inputSchema": schema,
+			})
+		}
+		return map[string]any{"tools": tools}, nil
+
+	case "tools/call":
+		var params struct {
+			Name      string         `json:"name"`
+			Arguments map[string]any `json:"arguments"`
+		}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return nil, map[string]any{"code": -32602, "message": "invalid params: " + err.Error()}
+		}
+		provider, ok := t.options.ToolProviders[params.Name]
+		if !ok {
+			return nil, map[string]any{"code": -32602, "message": "unknown tool: " + params.Name}
+		}
+
+		text, err := provider.Call(ctx, params.Arguments)
+		if err != nil {
+			text = err.Error()
+		}
+		return map[string]any{
+			"content": []map[string]any{{"type": "text", "text": text}},
+			"isError": err != nil,
+		}, nil
+	}
+
+	return nil, map[string]any{"code": -32601, "message": "method not found: " + msg.Method}
+}
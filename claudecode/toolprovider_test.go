@@ -0,0 +1,127 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestToolProvider tests that a provided tool is listed to the CLI and that
+// its calls are fulfilled by the provider within a session
+func TestToolProvider(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args.txt")
+	responsePath := filepath.Join(dir, "responses.jsonl")
+	cliPath := writeFakeCLI(t, `printf '%s\n' "$@" > "$ARGS_CAPTURE"
+read line
+echo '{"type":"control_request","request_id":"r1","request":{"subtype":"mcp_message","server_name":"sdk","message":{"jsonrpc":"2.0","id":1,"method":"tools/list"}}}'
+read resp; echo "$resp" >> "$RESPONSE_CAPTURE"
+echo '{"type":"control_request","request_id":"r2","request":{"subtype":"mcp_message","server_name":"sdk","message":{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"lookup_order","arguments":{"id":"A-17"}}}}}'
+read resp; echo "$resp" >> "$RESPONSE_CAPTURE"
+echo '{"type":"control_request","request_id":"r3","request":{"subtype":"mcp_message","server_name":"sdk","message":{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"lookup_order","arguments":{"id":"B-2"}}}}}'
+read resp; echo "$resp" >> "$RESPONSE_CAPTURE"
+echo '{"type":"result","subtype":"success","session_id":"s1"}'
+cat > /dev/null
+`)
+
+	provider := NewToolProvider(
+		"Looks up an order by ID",
+		map[string]any{"type": "object", "properties": map[string]any{"id": map[string]any{"type": "string"}}},
+		func(ctx context.Context, input map[string]any) (string, error) {
+			if input["id"] != "A-17" {
+				return "", errors.New("order not found")
+			}
+			return "order A-17: shipped", nil
+		},
+	)
+
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithEnv("ARGS_CAPTURE", argsPath),
+		WithEnv("RESPONSE_CAPTURE", responsePath),
+		WithToolProvider("lookup_order", provider),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := c.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer sess.Close()
+
+	if err := sess.Send(ctx, "Where is order A-17?"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := sess.ReceiveOne(ctx); err != nil {
+		t.Fatalf("ReceiveOne failed: %v", err)
+	}
+
+	args, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	if !strings.Contains(string(args), `"sdk":{"name":"sdk","type":"sdk"}`) {
+		t.Errorf("Expected the SDK MCP server in the config, got:\n%s", args)
+	}
+	if !strings.Contains(string(args), "mcp__sdk__lookup_order") {
+		t.Errorf("Expected the provided tool to be allowed, got:\n%s", args)
+	}
+
+	data, err := os.ReadFile(responsePath)
+	if err != nil {
+		t.Fatalf("Failed to read captured responses: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 responses, got %d:\n%s", len(lines), data)
+	}
+
+	type toolResult struct {
+		Tools []struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		} `json:"tools"`
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	results := make([]toolResult, len(lines))
+	for i, line := range lines {
+		var resp struct {
+			Response struct {
+				RequestID string `json:"request_id"`
+				Response  struct {
+					MCPResponse struct {
+						Result toolResult `json:"result"`
+					} `json:"mcp_response"`
+				} `json:"response"`
+			} `json:"response"`
+		}
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("Failed to decode response %q: %v", line, err)
+		}
+		results[i] = resp.Response.Response.MCPResponse.Result
+	}
+
+	if len(results[0].Tools) != 1 || results[0].Tools[0].Name != "lookup_order" || results[0].Tools[0].Description != "Looks up an order by ID" {
+		t.Errorf("Unexpected tools/list result: %+v", results[0])
+	}
+	if len(results[1].Content) != 1 || results[1].Content[0].Text != "order A-17: shipped" || results[1].IsError {
+		t.Errorf("Unexpected tools/call result: %+v", results[1])
+	}
+	if len(results[2].Content) != 1 || results[2].Content[0].Text != "order not found" || !results[2].IsError {
+		t.Errorf("Expected a failed tool result, got %+v", results[2])
+	}
+}
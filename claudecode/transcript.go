@@ -0,0 +1,97 @@
+package claudecode
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transcript renders a conversation as markdown as messages are recorded
+type transcript struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+// addUser records a prompt sent by the user
+func (tr *transcript) addUser(text string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	tr.section("User")
+	tr.buf.WriteString(text)
+	tr.buf.WriteString("\n")
+}
+
+// add records a received message. Messages without a markdown representation
+// are ignored.
+func (tr *transcript) add(msg Message) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	switch m := msg.(type) {
+	case *AssistantMessage:
+		tr.section("Assistant")
+		for i, block := range m.Content {
+			if i > 0 {
+				tr.buf.WriteString("\n")
+			}
+			switch {
+			case block.Type == "text" && block.Text != nil:
+				tr.buf.WriteString(*block.Text)
+				tr.buf.WriteString("\n")
+			case block.Tool != nil:
+				input, err := json.MarshalIndent(block.Tool.Input, "", "  ")
+				if err != nil {
+					input = []byte("{}")
+				}
+				fmt.Fprintf(&tr.buf, "**Tool: %s**\n\n```json\n%s\n```\n", block.Tool.Name, input)
+			}
+		}
+
+	case *ResultMessage:
+		if tr.buf.Len() > 0 {
+			tr.buf.WriteString("\n")
+		}
+		tr.buf.WriteString("---\n")
+		tr.buf.WriteString(formatResultFooter(m))
+		tr.buf.WriteString("\n")
+	}
+}
+
+// section starts a new markdown section with the given heading
+func (tr *transcript) section(heading string) {
+	if tr.buf.Len() > 0 {
+		tr.buf.WriteString("\n")
+	}
+	fmt.Fprintf(&tr.buf, "## %s\n\n", heading)
+}
+
+// String returns the markdown rendered so far
+func (tr *transcript) String() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.buf.String()
+}
+
+// formatResultFooter renders the summary line for a result message
+func formatResultFooter(m *ResultMessage) string {
+	parts := []string{m.Subtype}
+	if m.IsError {
+		parts[0] = "error"
+	}
+
+	turns := "turns"
+	if m.NumTurns == 1 {
+		turns = "turn"
+	}
+	parts = append(parts, fmt.Sprintf("%d %s", m.NumTurns, turns))
+	parts = append(parts, (time.Duration(m.DurationMS) * time.Millisecond).String())
+
+	if m.TotalCostUSD != nil {
+		parts = append(parts, fmt.Sprintf("$%.4f", *m.TotalCostUSD))
+	}
+
+	return "*Result: " + strings.Join(parts, " · ") + "*"
+}
@@ -0,0 +1,63 @@
+package claudecode
+
+import "testing"
+
+func TestTranscriptMarkdown(t *testing.T) {
+	cost := 0.0123
+	tr := &transcript{}
+
+	tr.addUser("What is in main.go?")
+	tr.add(&AssistantMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+		Content: []ContentBlock{
+			textBlock("Let me read it."),
+			{Type: "tool_use", Tool: &ToolUse{ID: "toolu_1", Name: "Read", Input: map[string]any{"file_path": "main.go"}}},
+		},
+	})
+	tr.add(&SystemMessage{BaseMessage: BaseMessage{MessageType: MessageTypeSystem}, Subtype: "init"})
+	tr.add(&AssistantMessage{
+		BaseMessage: BaseMessage{MessageType: MessageTypeAssistant},
+		Content:     []ContentBlock{textBlock("It defines the main package.")},
+	})
+	tr.add(&ResultMessage{
+		BaseMessage:  BaseMessage{MessageType: MessageTypeResult},
+		Subtype:      "success",
+		DurationMS:   1500,
+		NumTurns:     2,
+		TotalCostUSD: &cost,
+	})
+
+	want := "## User\n" +
+		"\n" +
+		"What is in main.go?\n" +
+		"\n" +
+		"## Assistant\n" +
+		"\n" +
+		"Let me read it.\n" +
+		"\n" +
+		"**Tool: Read**\n" +
+		"\n" +
+		"```json\n" +
+		"{\n" +
+		"  \"file_path\": \"main.go\"\n" +
+		"}\n" +
+		"```\n" +
+		"\n" +
+		"## Assistant\n" +
+		"\n" +
+		"It defines the main package.\n" +
+		"\n" +
+		"---\n" +
+		"*Result: success · 2 turns · 1.5s · $0.0123*\n"
+
+	if got := tr.String(); got != want {
+		t.Errorf("Transcript mismatch.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestSessionTranscriptDisabled(t *testing.T) {
+	s := &session{}
+	if got := s.Transcript(); got != "" {
+		t.Errorf("Expected empty transcript, got %q", got)
+	}
+}
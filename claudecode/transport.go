@@ -3,6 +3,7 @@ package claudecode
 import (
 	"context"
 	"io"
+	"iter"
 )
 
 // Transport defines the interface for communication with Claude
@@ -16,7 +17,8 @@ type Transport interface {
 	// Send sends messages to Claude
 	Send(ctx context.Context, messages []map[string]any) error
 
-	// Receive returns a channel for receiving messages
+	// Receive returns a channel for receiving messages. It returns
+	// ErrNotConnected if called before a successful Connect or after Close.
 	Receive(ctx context.Context) (<-chan map[string]any, error)
 
 	// Interrupt sends an interrupt signal
@@ -42,9 +44,36 @@ type Client interface {
 	// QueryStream sends a query and returns a channel for streaming responses
 	QueryStream(ctx context.Context, prompt string, opts ...QueryOption) (<-chan Message, error)
 
+	// Stream sends a query and returns an iterator over the response
+	// messages. Errors are yielded inline, and breaking out of the loop stops
+	// the CLI.
+	Stream(ctx context.Context, prompt string, opts ...QueryOption) iter.Seq2[Message, error]
+
+	// QueryFile sends the contents of a file as a one-shot query. Large
+	// files are streamed to the CLI's stdin rather than passed as an argument.
+	QueryFile(ctx context.Context, path string, opts ...QueryOption) ([]Message, error)
+
+	// QueryWithAttachments sends a one-shot query with references to files
+	// for Claude to read, which must be within the allowed directories
+	QueryWithAttachments(ctx context.Context, prompt string, files []string, opts ...QueryOption) ([]Message, error)
+
+	// QueryJSON sends a one-shot query and returns only its result, without
+	// streaming the intermediate messages
+	QueryJSON(ctx context.Context, prompt string, opts ...QueryOption) (*ResultMessage, error)
+
+	// CountTokens returns an approximate token count for a prompt
+	CountTokens(ctx context.Context, prompt string) (int, error)
+
 	// NewSession creates a new interactive session
 	NewSession(ctx context.Context, opts ...SessionOption) (Session, error)
 
+	// RestoreSession resumes a session from state saved with Session.SaveState
+	RestoreSession(ctx context.Context, path string, opts ...SessionOption) (Session, error)
+
+	// DiagnosticBundle returns a JSON report of the CLI and environment for
+	// bug reports, with secrets redacted
+	DiagnosticBundle(ctx context.Context) ([]byte, error)
+
 	// Close closes the client and releases resources
 	Close() error
 }
@@ -54,18 +83,52 @@ type Session interface {
 	// Send sends a message in the session
 	Send(ctx context.Context, message string) error
 
-	// SendMessage sends a pre-constructed message
+	// SendMessage sends a pre-constructed message. Messages sent while a
+	// turn is in progress are queued and written once its result arrives.
 	SendMessage(ctx context.Context, msg Message) error
 
-	// Receive returns a channel for receiving messages
+	// CancelPending discards queued messages that have not been written,
+	// returning how many were discarded
+	CancelPending() int
+
+	// Receive returns a channel for receiving messages, which closes when
+	// ctx is done or the session ends. Messages it did not deliver are left
+	// for the next receive call. It returns ErrNotConnected once the session
+	// is closed.
 	Receive(ctx context.Context) (<-chan Message, error)
 
 	// ReceiveOne receives messages until a ResultMessage is received
 	ReceiveOne(ctx context.Context) ([]Message, error)
 
-	// Interrupt sends an interrupt signal
+	// ReceiveUntil receives messages until a ResultMessage is received or
+	// ctx is done, reporting whether the result was seen
+	ReceiveUntil(ctx context.Context) ([]Message, bool, error)
+
+	// Interrupt sends an interrupt signal without waiting for the CLI to
+	// acknowledge it; the acknowledgment is passed to the control response
+	// callback
 	Interrupt(ctx context.Context) error
 
+	// ToolResultFor returns the result of the tool use with the given ID,
+	// reporting false until the result has been received
+	ToolResultFor(toolUseID string) (*ToolResult, bool)
+
+	// Ready returns a channel closed once the CLI has initialized
+	Ready() <-chan struct{}
+
+	// Transcript returns the conversation rendered as markdown
+	Transcript() string
+
+	// SessionID returns the session ID reported by the CLI or resumed, or
+	// the ID sent with messages until it is known
+	SessionID() string
+
+	// State returns the session ID and cumulative cost and turn count
+	State() SessionState
+
+	// SaveState writes the state needed to resume the session to a file
+	SaveState(path string) error
+
 	// Close closes the session
 	Close() error
 }
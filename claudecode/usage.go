@@ -0,0 +1,52 @@
+package claudecode
+
+// Usage is the token usage reported by the CLI on assistant and result
+// messages
+type Usage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+
+	// ServiceTier is the processing tier the request was served with, such
+	// as "standard" or "priority", when reported
+	ServiceTier string `json:"service_tier,omitempty"`
+}
+
+// TokenUsage returns the result's usage map as a Usage
+func (m *ResultMessage) TokenUsage() Usage {
+	usage, _ := parseUsage(m.Usage)
+	return usage
+}
+
+// parseUsage converts a raw usage object into a Usage, reporting false if it
+// is missing or malformed
+func parseUsage(raw any) (Usage, bool) {
+	var usage Usage
+	if _, ok := raw.(map[string]any); !ok {
+		return usage, false
+	}
+	if err := remarshal(raw, &usage); err != nil {
+		return Usage{}, false
+	}
+	return usage, true
+}
+
+// dispatchUsage calls the usage callback for a raw message that carries
+// usage, either at the top level as on results or in the nested message as
+// on assistant messages
+func dispatchUsage(opts *Options, rawMsg map[string]any) {
+	if opts.OnUsage == nil {
+		return
+	}
+
+	raw, ok := rawMsg["usage"]
+	if !ok {
+		if message, isMap := rawMsg["message"].(map[string]any); isMap {
+			raw = message["usage"]
+		}
+	}
+	if usage, ok := parseUsage(raw); ok {
+		opts.OnUsage(usage)
+	}
+}
@@ -0,0 +1,70 @@
+package claudecode
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestUsageCallback tests that the usage callback fires for each message
+// that reports usage
+func TestUsageCallback(t *testing.T) {
+	cliPath := writeFakeCLI(t, `
+echo '{"type":"system","subtype":"init","session_id":"s1","data":{}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Looking."}],"usage":{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":100}}}'
+echo '{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"ok"}]}}'
+echo '{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Done."}],"usage":{"input_tokens":20,"output_tokens":8}}}'
+echo '{"type":"result","subtype":"success","session_id":"s1","usage":{"input_tokens":30,"output_tokens":13,"cache_read_input_tokens":100,"cache_creation_input_tokens":7}}'
+`)
+
+	var got []Usage
+	c, err := New(
+		WithCLIPath(cliPath),
+		WithUsageCallback(func(u Usage) {
+			got = append(got, u)
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messages, err := c.Query(ctx, "Hello")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	want := []Usage{
+		{InputTokens: 10, OutputTokens: 5, CacheReadInputTokens: 100},
+		{InputTokens: 20, OutputTokens: 8},
+		{InputTokens: 30, OutputTokens: 13, CacheReadInputTokens: 100, CacheCreationInputTokens: 7},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Usage updates = %+v, want %+v", got, want)
+	}
+
+	result := messages[len(messages)-1].(*ResultMessage)
+	if usage := result.TokenUsage(); usage != want[2] {
+		t.Errorf("TokenUsage() = %+v, want %+v", usage, want[2])
+	}
+}
+
+// TestParseUsageServiceTier tests that the service tier is parsed from a
+// usage map
+func TestParseUsageServiceTier(t *testing.T) {
+	raw := `{"type":"result","subtype":"success","session_id":"s1","usage":{"input_tokens":12,"output_tokens":4,"service_tier":"priority"}}`
+
+	msg, err := ParseMessageJSON([]byte(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse result: %v", err)
+	}
+
+	want := Usage{InputTokens: 12, OutputTokens: 4, ServiceTier: "priority"}
+	if usage := msg.(*ResultMessage).TokenUsage(); usage != want {
+		t.Errorf("TokenUsage() = %+v, want %+v", usage, want)
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/mhpenta/claude-code-sdk-go
 
-go 1.21
+go 1.23